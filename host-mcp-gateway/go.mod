@@ -3,6 +3,7 @@ module host-mcp-gateway
 go 1.22
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	go.opentelemetry.io/otel v1.27.0
 	go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc v1.27.0
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.27.0
@@ -2,28 +2,47 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
+	"maps"
+	"math"
+	mathrand "math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
@@ -31,46 +50,260 @@ import (
 )
 
 const (
-	serviceName             = "host-mcp-gateway"
-	serviceVersion          = "0.1.0"
-	defaultPort             = 7411
-	defaultRequestTimeoutMS = 30000
-	defaultRestartBackoffMS = 2000
+	serviceName               = "host-mcp-gateway"
+	serviceVersion            = "0.1.0"
+	mcpProtocolVersion        = "2025-06-18"
+	defaultPort               = 7411
+	defaultBindRetryDelayMS   = 500
+	defaultRequestTimeoutMS   = 30000
+	defaultRestartBackoffMS   = 2000
+	defaultStartupTimeoutMS   = 30000
+	defaultProbeIntervalMS    = 250
+	defaultProbeMaxInterval   = 5000
+	defaultRecentRequestsSize = 200
+	defaultSelftestTimeoutMS  = 5000
+	defaultMaxLineBytes       = 8 << 20
+	defaultCacheMaxEntries    = 1000
+	defaultMaxHeaderBytes     = 64 << 10
+	defaultMaxBatchSize       = 100
+	spillHeadBytes            = 64 << 10
+	defaultRequestIDHeader    = "X-Request-Id"
+	defaultTLSMinVersion      = "1.2"
+	defaultStderrBufferLines  = 256
+	stderrTailLines           = 20
+	defaultBatchConcurrency   = 4
+	defaultDependencyTimeout  = 60000
+	dependencyPollInterval    = 50 * time.Millisecond
+	defaultIdempotencyMaxKeys = 1000
+	memorySampleInterval      = time.Second
+	drainPollInterval         = 50 * time.Millisecond
+	replaceDrainTimeout       = 30 * time.Second
+	stopGracePeriod           = 5 * time.Second
+	streamBufferMessages      = 64
+	lifetimeCheckInterval     = time.Second
+	defaultShutdownDrainMS    = 10000
+	defaultShutdownTimeoutMS  = 30000
+	configWatchDebounce       = 500 * time.Millisecond
+	retryAfterSeconds         = 1
+	sloWindowSize             = 100
+	sloMinSamples             = 20
+	sloAlertCooldown          = time.Minute
+	exportWarnCooldown        = time.Minute
+	hookTimeout               = 30 * time.Second
+)
+
+var (
+	errProbeDeadline    = errors.New("startup timeout exceeded")
+	errServerPaused     = errors.New("server is paused")
+	errRequestTimeout   = errors.New("request timeout (request_timeout_ms) exceeded")
+	errSessionConflict  = errors.New("session conflict")
+	errFirstByteTimeout = errors.New("first byte timeout (first_byte_timeout_ms) exceeded")
+	errNoHealthy        = errors.New("no healthy instances")
+	errShuttingDown     = errors.New("gateway is shutting down")
+	errUnknownSession   = errors.New("unknown or expired session")
+	errLineTooLong      = errors.New("stdout line exceeds max_line_bytes")
+	errServerStopped    = errors.New("server was stopped")
+	errServerBusy       = errors.New("server has too many pending requests")
+	errStdinClosed      = errors.New("server closed its stdin")
+	errOverloaded       = errors.New("gateway is shedding load")
+	errServerStarting   = errors.New("server is still starting")
+	errRateLimited      = errors.New("server rate limit exceeded")
+	errDependencyWait   = errors.New("dependency not ready in time")
+	errIdempotencyReuse = errors.New("idempotency key reused for a different request")
 )
 
 type Config struct {
-	BindHost         string         `json:"bind_host"`
-	BindPort         int            `json:"bind_port"`
-	AuthToken        string         `json:"auth_token"`
-	AllowedClients   []string       `json:"allowed_clients"`
-	RequestTimeoutMS int            `json:"request_timeout_ms"`
-	RestartBackoffMS int            `json:"restart_backoff_ms"`
-	Servers          []ServerConfig `json:"servers"`
+	BindHost               string         `json:"bind_host"`
+	BindPort               int            `json:"bind_port"`
+	BindRetryAttempts      int            `json:"bind_retry_attempts"`
+	BindRetryDelayMS       int            `json:"bind_retry_delay_ms"`
+	AuthToken              string         `json:"auth_token"`
+	AllowedClients         []string       `json:"allowed_clients"`
+	AllowedClientsFile     string         `json:"allowed_clients_file"`
+	RequestTimeoutMS       int            `json:"request_timeout_ms"`
+	FirstByteTimeoutMS     int            `json:"first_byte_timeout_ms"`
+	RestartBackoffMS       int            `json:"restart_backoff_ms"`
+	RestartBackoffMaxMS    int            `json:"restart_backoff_max_ms"`
+	RestartResetMS         int            `json:"restart_reset_ms"`
+	DependencyTimeoutMS    int            `json:"dependency_timeout_ms"`
+	LandingPage            string         `json:"landing_page"`
+	RecentRequestsSize     int            `json:"recent_requests_size"`
+	MaxServers             int            `json:"max_servers"`
+	CompactResponses       bool           `json:"compact_responses"`
+	StartupSelftest        bool           `json:"startup_selftest"`
+	SelftestTimeoutMS      int            `json:"selftest_timeout_ms"`
+	StrictSessions         bool           `json:"strict_sessions"`
+	StreamableHTTP         bool           `json:"streamable_http"`
+	MaxTotalConcurrent     int            `json:"max_total_concurrent_requests"`
+	MaxConcurrentStarts    int            `json:"max_concurrent_starts"`
+	MaxStartWaitMS         int            `json:"max_start_wait_ms"`
+	ShutdownDrainMS        int            `json:"shutdown_drain_ms"`
+	ShutdownTimeoutMS      int            `json:"shutdown_timeout_ms"`
+	ShedHighWater          int            `json:"shed_high_water"`
+	ShedLowWater           int            `json:"shed_low_water"`
+	MemoryHighWatermark    int            `json:"memory_high_watermark_bytes"`
+	MaxLineBytes           int            `json:"max_line_bytes"`
+	MaxHeaderBytes         *int           `json:"max_header_bytes"`
+	TLSCertFile            string         `json:"tls_cert_file"`
+	TLSKeyFile             string         `json:"tls_key_file"`
+	TLSMinVersion          string         `json:"tls_min_version"`
+	TLSCipherSuites        []string       `json:"tls_cipher_suites"`
+	MaxBatchSize           int            `json:"max_batch_size"`
+	StderrBufferLines      int            `json:"stderr_buffer_lines"`
+	BatchConcurrency       int            `json:"batch_concurrency"`
+	WatchConfig            bool           `json:"watch_config"`
+	ServerTiming           bool           `json:"server_timing"`
+	JSONRPCErrors          bool           `json:"jsonrpc_errors"`
+	DebugErrors            bool           `json:"debug_errors"`
+	VersionHeader          bool           `json:"version_header"`
+	RequestIDHeader        string         `json:"request_id_header"`
+	RequestIDFromTrace     bool           `json:"request_id_from_trace"`
+	SpillThresholdBytes    int            `json:"spill_threshold_bytes"`
+	RecordDir              string         `json:"record_dir"`
+	RecordRedactKeys       []string       `json:"record_redact_keys"`
+	RedactHeaders          []string       `json:"redact_headers"`
+	TraceSampleRatio       *float64       `json:"trace_sample_ratio"`
+	MetricExportIntervalMS int            `json:"metric_export_interval_ms"`
+	MetricFullCardinality  bool           `json:"metric_full_cardinality"`
+	AdminEnabled           bool           `json:"admin_enabled"`
+	CapabilitiesEndpoint   bool           `json:"capabilities_endpoint"`
+	ToolRouting            bool           `json:"tool_routing"`
+	ToolRoutingTieBreak    string         `json:"tool_routing_tie_break"`
+	AdminBind              string         `json:"admin_bind"`
+	AdminAllowedClients    []string       `json:"admin_allowed_clients"`
+	HealthSkipAuth         bool           `json:"health_skip_auth"`
+	Servers                []ServerConfig `json:"servers"`
 }
 
 type ServerConfig struct {
-	ServerID         string            `json:"server_id"`
-	Command          string            `json:"command"`
-	Args             []string          `json:"args"`
-	WorkingDir       string            `json:"working_dir"`
-	Env              map[string]string `json:"env"`
-	Autostart        bool              `json:"autostart"`
-	RestartPolicy    string            `json:"restart_policy"`
-	StartupTimeoutMS int               `json:"startup_timeout_ms"`
+	ServerID             string            `json:"server_id"`
+	Transport            string            `json:"transport"`
+	BaseURL              string            `json:"base_url"`
+	Command              string            `json:"command"`
+	Args                 []string          `json:"args"`
+	WorkingDir           string            `json:"working_dir"`
+	Env                  map[string]string `json:"env"`
+	EnvFile              string            `json:"env_file"`
+	Autostart            bool              `json:"autostart"`
+	Required             bool              `json:"required"`
+	CacheInitialize      bool              `json:"cache_initialize"`
+	InitializeConflict   string            `json:"initialize_conflict"`
+	CoalesceReads        bool              `json:"coalesce_reads"`
+	CacheTTLMS           int               `json:"cache_ttl_ms"`
+	CacheMaxEntries      int               `json:"cache_max_entries"`
+	StaleWhileRevalidate bool              `json:"stale_while_revalidate"`
+	MaxStaleMS           int               `json:"max_stale_ms"`
+	MaxStaleOnOutageMS   int               `json:"max_stale_on_outage_ms"`
+	IdempotencyWindowMS  int               `json:"idempotency_window_ms"`
+	IdempotencyMaxKeys   int               `json:"idempotency_max_keys"`
+	SelftestMethod       string            `json:"selftest_method"`
+	SessionEndMethod     string            `json:"session_end_method"`
+	LatencySLOMS         int               `json:"latency_slo_ms"`
+	MethodTimeoutsMS     map[string]int    `json:"method_timeouts_ms"`
+	MaxPendingRequests   int               `json:"max_pending_requests"`
+	RateLimitRPS         float64           `json:"rate_limit_rps"`
+	RateLimitBurst       int               `json:"rate_limit_burst"`
+	Priority             int               `json:"priority"`
+	BackupFor            string            `json:"backup_for"`
+	ResponseEnvelope     bool              `json:"response_envelope"`
+	Nice                 *int              `json:"nice"`
+	IOPrio               string            `json:"ioprio"`
+	PausePolicy          string            `json:"pause_policy"`
+	ReaderMode           string            `json:"reader_mode"`
+	OrderedDelivery      bool              `json:"ordered_delivery"`
+	RestartPolicy        string            `json:"restart_policy"`
+	RestartMode          string            `json:"restart_mode"`
+	RestartBackoffMS     *int              `json:"restart_backoff_ms"`
+	RestartBackoffMaxMS  *int              `json:"restart_backoff_max_ms"`
+	RestartResetMS       *int              `json:"restart_reset_ms"`
+	StartupTimeoutMS     int               `json:"startup_timeout_ms"`
+	StartupDelayMS       int               `json:"startup_delay_ms"`
+	DependsOn            []string          `json:"depends_on"`
+	DependencyTimeoutMS  *int              `json:"dependency_timeout_ms"`
+	StdioIdleRecycleMS   int               `json:"stdio_idle_recycle_ms"`
+	MaxLifetimeMS        int               `json:"max_lifetime_ms"`
+	LogFields            map[string]any    `json:"log_fields"`
+	Warmup               []json.RawMessage `json:"warmup"`
+	PostStartHook        []string          `json:"post_start_hook"`
+	PreStopHook          []string          `json:"pre_stop_hook"`
+	ReadinessProbe       bool              `json:"readiness_probe"`
+	ReadinessTCP         string            `json:"readiness_tcp"`
+	ReadinessHTTP        string            `json:"readiness_http"`
+	StartupHandshake     bool              `json:"startup_handshake"`
+	ProbeIntervalMS      int               `json:"probe_interval_ms"`
+	ProbeMaxInterval     int               `json:"probe_max_interval_ms"`
 }
 
 type Gateway struct {
-	cfg           Config
-	logger        *Logger
-	servers       map[string]*ManagedServer
-	allowedIPs    []net.IP
-	allowedCIDRs  []*net.IPNet
-	startTime     time.Time
-	tracer        trace.Tracer
-	meter         metric.Meter
-	metrics       *GatewayMetrics
-	shutdownTrace func(context.Context) error
-	shutdownMet   func(context.Context) error
+	cfg            Config
+	logger         *Logger
+	servers        map[string]*ManagedServer
+	serversMu      sync.RWMutex
+	allowlist      *clientAllowlist
+	adminAllowlist *clientAllowlist
+	startTime      time.Time
+	tracer         trace.Tracer
+	meter          metric.Meter
+	metrics        *GatewayMetrics
+	recentRequests *requestRing
+	recorder       *trafficRecorder
+	requestSlots   chan struct{}
+	shedder        *loadShedder
+	memory         *memoryGuard
+	version        string
+	tlsConfig      *tls.Config
+	redactHeaders  map[string]bool
+	lifetime       context.Context
+	endLifetime    context.CancelCauseFunc
+	draining       context.Context
+	startDraining  context.CancelFunc
+	streamsMu      sync.Mutex
+	streams        sync.WaitGroup
+	configPath     string
+	reloadMu       sync.Mutex
+	shutdownTrace  func(context.Context) error
+	shutdownMet    func(context.Context) error
+}
+
+type loadShedder struct {
+	mu        sync.Mutex
+	high      int
+	low       int
+	inFlight  int
+	active    bool
+	protected int
+	logger    *Logger
+}
+
+type memoryGuard struct {
+	mu        sync.Mutex
+	high      uint64
+	rss       uint64
+	pressured bool
+	logger    *Logger
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+type reloadSummary struct {
+	Added                  []string `json:"added"`
+	Removed                []string `json:"removed"`
+	Changed                []string `json:"changed"`
+	Reconfigured           []string `json:"reconfigured"`
+	Unchanged              []string `json:"unchanged"`
+	SettingsRequireRestart bool     `json:"settings_require_restart"`
+}
+
+type clientAllowlist struct {
+	mu    sync.RWMutex
+	ips   []net.IP
+	cidrs []*net.IPNet
 }
 
 type GatewayMetrics struct {
@@ -78,6 +311,11 @@ type GatewayMetrics struct {
 	latency      metric.Int64Histogram
 	restarts     metric.Int64Counter
 	authFailures metric.Int64Counter
+	decodeErrors metric.Int64Counter
+	stderrDrops  metric.Int64Counter
+	failovers    metric.Int64Counter
+	stdinBytes   metric.Int64Counter
+	stdoutBytes  metric.Int64Counter
 }
 
 type GatewayRequest struct {
@@ -92,19 +330,293 @@ type GatewayResponse struct {
 }
 
 type GatewayError struct {
-	ErrorCode string `json:"error_code"`
-	Message   string `json:"message"`
+	ErrorCode string          `json:"error_code"`
+	Message   string          `json:"message"`
+	ServerID  string          `json:"server_id,omitempty"`
+	RequestID json.RawMessage `json:"request_id,omitempty"`
+	Detail    string          `json:"detail,omitempty"`
+}
+
+type requestSummary struct {
+	Timestamp string `json:"timestamp"`
 	ServerID  string `json:"server_id,omitempty"`
+	Method    string `json:"method,omitempty"`
 	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+	Client    string `json:"client"`
+	Status    int    `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
 }
 
-type Logger struct {
+type requestSummaryKey struct{}
+
+type callTiming struct {
+	queue  time.Duration
+	server time.Duration
+	// stale is the age of a cached response served during an outage.
+	stale time.Duration
+}
+
+type callTimingKey struct{}
+
+type sessionIDKey struct{}
+
+type idempotencyKey struct{}
+
+type eventStreamKey struct{}
+
+type eventStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	started bool
+	done    bool
+}
+
+type streamSubscriber struct {
+	closed   chan struct{}
+	done     chan struct{}
+	messages chan streamMessage
+}
+
+type streamMessage struct {
+	payload json.RawMessage
+	written chan struct{}
+}
+
+type trafficRecorder struct {
 	mu     sync.Mutex
+	dir    string
+	redact map[string]bool
+}
+
+func newTrafficRecorder(dir string, redactKeys []string) (*trafficRecorder, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("record_dir: %w", err)
+	}
+	redact := make(map[string]bool, len(redactKeys))
+	for _, key := range redactKeys {
+		redact[key] = true
+	}
+	return &trafficRecorder{dir: dir, redact: redact}, nil
+}
+
+func (r *trafficRecorder) Record(serverID string, request, response json.RawMessage, callErr error) error {
+	entry := map[string]any{
+		"time":    formatTime(time.Now()),
+		"request": r.redactPayload(request),
+	}
+	if response != nil {
+		entry["response"] = r.redactPayload(response)
+	}
+	if callErr != nil {
+		entry["error"] = callErr.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, err := os.OpenFile(filepath.Join(r.dir, serverID+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := writeAll(file, append(line, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (r *trafficRecorder) redactPayload(payload json.RawMessage) any {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return string(payload)
+	}
+	return r.redactValue(value)
+}
+
+func (r *trafficRecorder) redactValue(value any) any {
+	switch typed := value.(type) {
+	case map[string]any:
+		for key, nested := range typed {
+			if r.redact[key] {
+				typed[key] = "[REDACTED]"
+			} else {
+				typed[key] = r.redactValue(nested)
+			}
+		}
+	case []any:
+		for i, nested := range typed {
+			typed[i] = r.redactValue(nested)
+		}
+	}
+	return value
+}
+
+type reloadQueue struct {
+	ready   chan struct{}
+	pending atomic.Int64
+}
+
+type requestRing struct {
+	mu      sync.Mutex
+	entries []requestSummary
+	next    int
+	count   int
+}
+
+func newReloadQueue() *reloadQueue {
+	return &reloadQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *reloadQueue) request() {
+	q.pending.Add(1)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *reloadQueue) take() int64 {
+	return q.pending.Swap(0)
+}
+
+func newRequestRing(size int) *requestRing {
+	return &requestRing{entries: make([]requestSummary, size)}
+}
+
+func (r *requestRing) Add(entry requestSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.count < len(r.entries) {
+		r.count++
+	}
+}
+
+func (r *requestRing) Recent(n int) []requestSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n <= 0 || n > r.count {
+		n = r.count
+	}
+	recent := make([]requestSummary, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return recent
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+type exportMonitor struct {
+	logger     *Logger
+	mu         sync.Mutex
+	failures   metric.Int64Counter
+	lastWarn   time.Time
+	suppressed int
+}
+
+func (m *exportMonitor) observe(ctx context.Context, signal string, err error) error {
+	if err == nil {
+		return nil
+	}
+	m.mu.Lock()
+	failures := m.failures
+	warn := time.Since(m.lastWarn) >= exportWarnCooldown
+	suppressed := m.suppressed
+	if warn {
+		m.lastWarn = time.Now()
+		m.suppressed = 0
+	} else {
+		m.suppressed++
+	}
+	m.mu.Unlock()
+
+	if failures != nil {
+		failures.Add(ctx, 1, metric.WithAttributes(attribute.String("signal", signal)))
+	}
+	if warn {
+		m.logger.Log(ctx, "warn", "otel_export_failed", map[string]any{"signal": signal, "error": err.Error(), "suppressed": suppressed})
+	}
+	return err
+}
+
+type monitoredSpanExporter struct {
+	sdktrace.SpanExporter
+	monitor *exportMonitor
+}
+
+func (e monitoredSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	return e.monitor.observe(ctx, "traces", e.SpanExporter.ExportSpans(ctx, spans))
+}
+
+type monitoredMetricExporter struct {
+	sdkmetric.Exporter
+	monitor *exportMonitor
+}
+
+func (e monitoredMetricExporter) Export(ctx context.Context, metrics *metricdata.ResourceMetrics) error {
+	return e.monitor.observe(ctx, "metrics", e.Exporter.Export(ctx, metrics))
+}
+
+type Logger struct {
+	mu     *sync.Mutex
 	writer io.Writer
+	fields map[string]any
 }
 
 func NewLogger(writer io.Writer) *Logger {
-	return &Logger{writer: writer}
+	return &Logger{mu: &sync.Mutex{}, writer: writer}
+}
+
+// With returns a logger sharing the same output that adds fields to every
+// entry; fields passed to Log take precedence.
+func (l *Logger) With(fields map[string]any) *Logger {
+	if len(fields) == 0 {
+		return l
+	}
+	merged := maps.Clone(l.fields)
+	if merged == nil {
+		merged = make(map[string]any, len(fields))
+	}
+	maps.Copy(merged, fields)
+	return &Logger{mu: l.mu, writer: l.writer, fields: merged}
 }
 
 func (l *Logger) Log(ctx context.Context, level, message string, fields map[string]any) {
@@ -124,6 +636,9 @@ func (l *Logger) Log(ctx context.Context, level, message string, fields map[stri
 		}
 	}
 
+	for key, value := range l.fields {
+		entry[key] = value
+	}
 	for key, value := range fields {
 		entry[key] = value
 	}
@@ -140,31 +655,89 @@ func (l *Logger) Log(ctx context.Context, level, message string, fields map[stri
 }
 
 type ManagedServer struct {
-	cfg            ServerConfig
-	logger         *Logger
-	mu             sync.Mutex
-	status         string
-	cmd            *exec.Cmd
-	stdin          io.WriteCloser
-	stdout         *bufio.Reader
-	decoder        *json.Decoder
-	stderr         io.ReadCloser
-	sessionID      string
-	requests       chan serverRequest
-	workerOnce     sync.Once
-	metrics        *GatewayMetrics
-	requestTimeout time.Duration
-	restartBackoff time.Duration
-	restartCount   int
-	lastExitCode   int
-	lastExitAt     time.Time
+	settings           atomic.Pointer[serverSettings]
+	mu                 sync.Mutex
+	status             string
+	cmd                *exec.Cmd
+	stdin              io.WriteCloser
+	stdout             *bufio.Reader
+	stdoutReplay       *bytes.Reader
+	decoder            *json.Decoder
+	stderr             io.ReadCloser
+	sessionID          string
+	subscribers        map[string]map[*streamSubscriber]struct{}
+	upstreamSession    string
+	pending            *pendingCalls
+	writeSem           chan struct{}
+	metrics            *GatewayMetrics
+	requestTimeout     time.Duration
+	firstByteTimeout   time.Duration
+	lifetime           context.Context
+	endLifetime        context.CancelCauseFunc
+	strictSessions     bool
+	maxLineBytes       int
+	stderrBuffer       int
+	stderrTail         []string
+	latencies          []time.Duration
+	latencyNext        int
+	lastSLOAlert       time.Time
+	restartCount       int
+	restartTotal       int
+	readySince         time.Time
+	lastExitCode       int
+	lastExitAt         time.Time
+	lastError          string
+	startDone          chan struct{}
+	exitStatus         string
+	exitReason         string
+	recycling          bool
+	lastActivity       time.Time
+	activeCalls        int
+	replacement        *ManagedServer
+	draining           *ManagedServer
+	maxStartWait       time.Duration
+	probeAttempts      int
+	initSem            chan struct{}
+	initializeResult   json.RawMessage
+	toolList           json.RawMessage
+	initInFlight       bool
+	sessionInitialized bool
+	coalesceMu         sync.Mutex
+	inflight           map[string]*inflightCall
+	cacheMu            sync.Mutex
+	cache              map[string]*cachedResponse
+	cacheOrder         []string
+	idempotencyMu      sync.Mutex
+	idempotent         map[string]*idempotentCall
+	idempotentOrder    []string
+	recorder           *trafficRecorder
+	shedder            *loadShedder
+	paused             bool
+	resumeCh           chan struct{}
+}
+
+type serverSettings struct {
+	cfg               ServerConfig
+	logger            *Logger
+	restartBackoff    time.Duration
+	restartBackoffMax time.Duration
+	restartReset      time.Duration
+	startupTimeout    time.Duration
+	dependencyTimeout time.Duration
+	probeInterval     time.Duration
+	probeMaxInterval  time.Duration
+	cacheTTL          time.Duration
+	maxStale          time.Duration
+	maxStaleOnOutage  time.Duration
+	idempotencyWindow time.Duration
+	pendingSlots      chan struct{}
+	rateLimiter       *tokenBucket
 }
 
 type serverRequest struct {
-	ctx       context.Context
 	payload   []byte
+	source    io.ReadSeeker
 	requestID string
-	response  chan serverResponse
 }
 
 type serverResponse struct {
@@ -172,6 +745,114 @@ type serverResponse struct {
 	err     error
 }
 
+type pendingCalls struct {
+	mu       sync.Mutex
+	waiters  map[string]*pendingCall
+	lastID   uint64
+	reading  bool
+	err      error
+	outputAt time.Time
+}
+
+type pendingCall struct {
+	response chan serverResponse
+}
+
+type lineLimitReader struct {
+	reader io.Reader
+	max    int
+	run    int
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if l.max > 0 && l.run > l.max {
+		return 0, errLineTooLong
+	}
+	n, err := l.reader.Read(p)
+	if l.max <= 0 {
+		return n, err
+	}
+	if idx := bytes.LastIndexByte(p[:n], '\n'); idx >= 0 {
+		l.run = n - idx - 1
+	} else {
+		l.run += n
+	}
+	if l.run > l.max {
+		return n, errLineTooLong
+	}
+	return n, err
+}
+
+type countingReader struct {
+	reader io.Reader
+	add    func(n int)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.add(n)
+	return n, err
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	add func(n int)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.add(n)
+	return n, err
+}
+
+type spilledBody struct {
+	file *os.File
+	head []byte
+}
+
+func (b *spilledBody) Close() {
+	_ = b.file.Close()
+	_ = os.Remove(b.file.Name())
+}
+
+type cachedResponse struct {
+	response   json.RawMessage
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+type inflightCall struct {
+	done     chan struct{}
+	response json.RawMessage
+	err      error
+}
+
+// idempotentCall holds an Idempotency-Key from the call that claimed it
+// until its response is past the window; done closes once it is answered.
+type idempotentCall struct {
+	key         string
+	fingerprint string
+	done        chan struct{}
+	response    json.RawMessage
+	answeredAt  time.Time
+}
+
+// expired reports whether an answered call is past the window; one still in
+// flight never is.
+func (c *idempotentCall) expired(window time.Duration) bool {
+	return !c.answeredAt.IsZero() && time.Since(c.answeredAt) >= window
+}
+
+var idempotentMethods = map[string]bool{
+	"ping":                     true,
+	"tools/list":               true,
+	"resources/list":           true,
+	"resources/templates/list": true,
+	"resources/read":           true,
+	"prompts/list":             true,
+	"prompts/get":              true,
+}
+
 func main() {
 	configPath := flag.String("config", "~/.config/brain/host-mcp-gateway.json", "Path to gateway config")
 	flag.Parse()
@@ -184,38 +865,128 @@ func main() {
 
 	logger := NewLogger(os.Stdout)
 	ctx := context.Background()
-	tracer, meter, shutdownTrace, shutdownMet, err := setupObservability(ctx)
+	tracer, meter, shutdownTrace, shutdownMet, err := setupObservability(ctx, *cfg, logger)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to setup observability: %v\n", err)
 		os.Exit(1)
 	}
-	defer func() {
-		_ = shutdownTrace(context.Background())
-		_ = shutdownMet(context.Background())
-	}()
 
 	gateway, err := NewGateway(*cfg, logger, tracer, meter, shutdownTrace, shutdownMet)
 	if err != nil {
 		logger.Log(ctx, "error", "gateway_init_failed", map[string]any{"error": err.Error()})
 		os.Exit(1)
 	}
+	gateway.configPath = *configPath
 
 	gateway.logger.Log(ctx, "info", "gateway_starting", map[string]any{"bind_host": gateway.cfg.BindHost, "bind_port": gateway.cfg.BindPort})
-	gateway.startAutostartServers(ctx)
+	if err := gateway.startAutostartServers(ctx); err != nil {
+		gateway.logger.Log(ctx, "error", "gateway_required_server_failed", map[string]any{"error": err.Error()})
+		os.Exit(1)
+	}
 
 	addr := fmt.Sprintf("%s:%d", gateway.cfg.BindHost, gateway.cfg.BindPort)
-	server := &http.Server{
-		Addr:    addr,
-		Handler: gateway.routes(),
+	listeners := []*http.Server{gateway.newListener(addr, gateway.routes())}
+	if gateway.cfg.AdminBind != "" {
+		listeners = append(listeners, gateway.newListener(gateway.cfg.AdminBind, gateway.adminRoutes()))
+	}
+
+	signalCtx, stopSignals := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	reloads := newReloadQueue()
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	go func() {
+		for range hangups {
+			reloads.request()
+		}
+	}()
+	// Status dumps go to the log so they work even when the listener is wedged.
+	dumps := make(chan os.Signal, 1)
+	signal.Notify(dumps, syscall.SIGUSR1)
+	defer signal.Stop(dumps)
+	go func() {
+		for range dumps {
+			gateway.logger.Log(ctx, "info", "gateway_status_dump", map[string]any{"servers": gateway.collectServerStatuses()})
+		}
+	}()
+	if gateway.memory != nil {
+		go gateway.memory.watch(signalCtx)
+	}
+	go gateway.recycleAged(signalCtx)
+	if gateway.cfg.WatchConfig {
+		watchPath, err := expandPath(*configPath)
+		if err == nil {
+			err = watchConfig(signalCtx, watchPath, gateway.logger, reloads.request)
+		}
+		if err != nil {
+			gateway.logger.Log(ctx, "error", "gateway_config_watch_failed", map[string]any{"error": err.Error()})
+			os.Exit(1)
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-signalCtx.Done():
+				return
+			case <-reloads.ready:
+				// Signals that arrived while a reload ran are answered by one
+				// reload of the config as it is now.
+				signals := reloads.take()
+				if signals == 0 {
+					continue
+				}
+				if signals > 1 {
+					gateway.logger.Log(ctx, "info", "gateway_reload_coalesced", map[string]any{"signals": signals, "coalesced": signals - 1})
+				}
+				if _, err := gateway.reload(ctx, gateway.configPath); err != nil {
+					gateway.logger.Log(ctx, "error", "gateway_config_reload_failed", map[string]any{"error": err.Error()})
+				}
+			}
+		}
+	}()
+
+	listenErrs := make(chan map[string]any, len(listeners))
+	for _, listener := range listeners {
+		go func(listener *http.Server) {
+			ln, err := gateway.listen(signalCtx, listener.Addr)
+			if err != nil {
+				listenErrs <- listenFailure(listener.Addr, err)
+				return
+			}
+			gateway.logger.Log(ctx, "info", "gateway_listening", map[string]any{"addr": listener.Addr, "tls": listener.TLSConfig != nil})
+			if listener.TLSConfig != nil {
+				err = listener.ServeTLS(ln, gateway.cfg.TLSCertFile, gateway.cfg.TLSKeyFile)
+			} else {
+				err = listener.Serve(ln)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				listenErrs <- listenFailure(listener.Addr, err)
+			}
+		}(listener)
 	}
 
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		gateway.logger.Log(ctx, "error", "gateway_listen_failed", map[string]any{"error": err.Error()})
+	select {
+	case fields := <-listenErrs:
+		gateway.logger.Log(ctx, "error", "gateway_listen_failed", fields)
 		os.Exit(1)
+	case <-signalCtx.Done():
 	}
+
+	gateway.logger.Log(ctx, "info", "gateway_shutting_down", nil)
+	shutdownTimeout := time.Duration(gateway.cfg.ShutdownTimeoutMS) * time.Millisecond
+	// A step that ignores its context must not keep the process up.
+	time.AfterFunc(shutdownTimeout, func() {
+		gateway.logger.Log(ctx, "error", "gateway_shutdown_timeout", map[string]any{"shutdown_timeout_ms": gateway.cfg.ShutdownTimeoutMS})
+		os.Exit(1)
+	})
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	gateway.shutdown(shutdownCtx, listeners)
 }
 
-func setupObservability(ctx context.Context) (trace.Tracer, metric.Meter, func(context.Context) error, func(context.Context) error, error) {
+func setupObservability(ctx context.Context, cfg Config, logger *Logger) (trace.Tracer, metric.Meter, func(context.Context) error, func(context.Context) error, error) {
 	endpoint := strings.TrimSpace(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
 	if endpoint == "" {
 		return nil, nil, nil, nil, errors.New("OTEL_EXPORTER_OTLP_ENDPOINT is required")
@@ -231,13 +1002,21 @@ func setupObservability(ctx context.Context) (trace.Tracer, metric.Meter, func(c
 		return nil, nil, nil, nil, err
 	}
 
+	// The SDK drops failed batches silently; the monitor makes collector
+	// outages visible without changing export behavior.
+	monitor := &exportMonitor{logger: logger}
 	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
+	sampler, err := newTraceSampler(cfg.TraceSampleRatio, os.Getenv)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
 	traceProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithResource(res),
-		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithBatcher(monitoredSpanExporter{SpanExporter: traceExporter, monitor: monitor}),
 	)
 	otel.SetTracerProvider(traceProvider)
 
@@ -245,7 +1024,13 @@ func setupObservability(ctx context.Context) (trace.Tracer, metric.Meter, func(c
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
-	metricReader := sdkmetric.NewPeriodicReader(metricExporter)
+	// Without an explicit interval the reader falls back to
+	// OTEL_METRIC_EXPORT_INTERVAL, then the SDK default of 60s.
+	var readerOpts []sdkmetric.PeriodicReaderOption
+	if cfg.MetricExportIntervalMS > 0 {
+		readerOpts = append(readerOpts, sdkmetric.WithInterval(time.Duration(cfg.MetricExportIntervalMS)*time.Millisecond))
+	}
+	metricReader := sdkmetric.NewPeriodicReader(monitoredMetricExporter{Exporter: metricExporter, monitor: monitor}, readerOpts...)
 	metricProvider := sdkmetric.NewMeterProvider(
 		sdkmetric.WithResource(res),
 		sdkmetric.WithReader(metricReader),
@@ -255,37 +1040,93 @@ func setupObservability(ctx context.Context) (trace.Tracer, metric.Meter, func(c
 	tracer := otel.Tracer(serviceName)
 	meter := otel.Meter(serviceName)
 
+	failures, err := meter.Int64Counter(
+		"brain.mcp.gateway.otel_export_failures",
+		metric.WithDescription("Failed OTLP exports by signal"),
+	)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	monitor.mu.Lock()
+	monitor.failures = failures
+	monitor.mu.Unlock()
+
 	return tracer, meter, traceProvider.Shutdown, metricProvider.Shutdown, nil
 }
 
+func newTraceSampler(ratio *float64, getenv func(string) string) (sdktrace.Sampler, error) {
+	if ratio != nil {
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*ratio)), nil
+	}
+
+	name := strings.ToLower(strings.TrimSpace(getenv("OTEL_TRACES_SAMPLER")))
+	arg := strings.TrimSpace(getenv("OTEL_TRACES_SAMPLER_ARG"))
+	envRatio := 1.0
+	if arg != "" && strings.HasSuffix(name, "traceidratio") {
+		parsed, err := strconv.ParseFloat(arg, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q (expected a ratio between 0 and 1)", arg)
+		}
+		envRatio = parsed
+	}
+
+	switch name {
+	case "", "parentbased_traceidratio":
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(envRatio)), nil
+	case "traceidratio":
+		return sdktrace.TraceIDRatioBased(envRatio), nil
+	case "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	case "parentbased_always_on":
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", name)
+	}
+}
+
 func NewGateway(cfg Config, logger *Logger, tracer trace.Tracer, meter metric.Meter, shutdownTrace func(context.Context) error, shutdownMet func(context.Context) error) (*Gateway, error) {
 	cfg = applyConfigDefaults(cfg)
 	if cfg.RequestTimeoutMS < 0 {
 		return nil, errors.New("request_timeout_ms must be >= 0")
 	}
-	if cfg.RestartBackoffMS < 0 {
-		return nil, errors.New("restart_backoff_ms must be >= 0")
+	if cfg.RestartBackoffMS < 0 || cfg.RestartBackoffMaxMS < 0 || cfg.RestartResetMS < 0 {
+		return nil, errors.New("restart_backoff_ms, restart_backoff_max_ms, and restart_reset_ms must be >= 0")
+	}
+	if cfg.DependencyTimeoutMS < 0 {
+		return nil, errors.New("dependency_timeout_ms must be >= 0")
+	}
+	if cfg.FirstByteTimeoutMS < 0 {
+		return nil, errors.New("first_byte_timeout_ms must be >= 0")
+	}
+	if cfg.RecentRequestsSize < 0 {
+		return nil, errors.New("recent_requests_size must be >= 0")
+	}
+	if cfg.MaxTotalConcurrent < 0 {
+		return nil, errors.New("max_total_concurrent_requests must be >= 0")
+	}
+	if err := checkServerLimit(cfg.MaxServers, len(cfg.Servers)); err != nil {
+		return nil, err
 	}
 
-	allowedIPs, allowedCIDRs, err := parseAllowlist(cfg.AllowedClients)
+	allowedIPs, allowedCIDRs, err := loadClientAllowlist(cfg)
 	if err != nil {
 		return nil, err
 	}
+	adminIPs, adminCIDRs, err := parseAllowlist(cfg.AdminAllowedClients)
+	if err != nil {
+		return nil, fmt.Errorf("admin_allowed_clients: %w", err)
+	}
 
-	servers := make(map[string]*ManagedServer)
+	seen := make(map[string]bool)
 	for _, server := range cfg.Servers {
-		if _, exists := servers[server.ServerID]; exists {
+		if seen[server.ServerID] {
 			return nil, fmt.Errorf("duplicate server_id: %s", server.ServerID)
 		}
-		servers[server.ServerID] = &ManagedServer{
-			cfg:            server,
-			logger:         logger,
-			status:         "stopped",
-			requests:       make(chan serverRequest),
-			metrics:        nil,
-			requestTimeout: time.Duration(cfg.RequestTimeoutMS) * time.Millisecond,
-			restartBackoff: time.Duration(cfg.RestartBackoffMS) * time.Millisecond,
-		}
+		seen[server.ServerID] = true
 	}
 
 	metrics, err := initMetrics(meter)
@@ -293,560 +1134,4064 @@ func NewGateway(cfg Config, logger *Logger, tracer trace.Tracer, meter metric.Me
 		return nil, err
 	}
 
+	recorder, err := newTrafficRecorder(cfg.RecordDir, cfg.RecordRedactKeys)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	redactHeaders := make(map[string]bool, len(cfg.RedactHeaders))
+	for _, name := range cfg.RedactHeaders {
+		redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+
+	var requestSlots chan struct{}
+	if cfg.MaxTotalConcurrent > 0 {
+		requestSlots = make(chan struct{}, cfg.MaxTotalConcurrent)
+	}
+	var shedder *loadShedder
+	if cfg.ShedHighWater > 0 {
+		shedder = &loadShedder{high: cfg.ShedHighWater, low: cfg.ShedLowWater, logger: logger}
+		shedder.protect(cfg.Servers)
+	}
+	var memory *memoryGuard
+	if cfg.MemoryHighWatermark > 0 {
+		memory = &memoryGuard{high: uint64(cfg.MemoryHighWatermark), logger: logger}
+	}
+
+	version := ""
+	if cfg.VersionHeader {
+		version = buildVersion()
+	}
+
+	lifetime, endLifetime := context.WithCancelCause(context.Background())
+	// Draining ends with the lifetime at the latest.
+	draining, startDraining := context.WithCancel(lifetime)
 	gateway := &Gateway{
-		cfg:           cfg,
-		logger:        logger,
-		servers:       servers,
-		allowedIPs:    allowedIPs,
-		allowedCIDRs:  allowedCIDRs,
-		startTime:     time.Now(),
-		tracer:        tracer,
-		meter:         meter,
-		metrics:       metrics,
-		shutdownTrace: shutdownTrace,
-		shutdownMet:   shutdownMet,
+		cfg:            cfg,
+		logger:         logger,
+		servers:        make(map[string]*ManagedServer),
+		allowlist:      &clientAllowlist{ips: allowedIPs, cidrs: allowedCIDRs},
+		adminAllowlist: &clientAllowlist{ips: adminIPs, cidrs: adminCIDRs},
+		startTime:      time.Now(),
+		recentRequests: newRequestRing(cfg.RecentRequestsSize),
+		recorder:       recorder,
+		requestSlots:   requestSlots,
+		shedder:        shedder,
+		memory:         memory,
+		version:        version,
+		tlsConfig:      tlsConfig,
+		redactHeaders:  redactHeaders,
+		lifetime:       lifetime,
+		endLifetime:    endLifetime,
+		draining:       draining,
+		startDraining:  startDraining,
+		tracer:         tracer,
+		meter:          meter,
+		metrics:        metrics,
+		shutdownTrace:  shutdownTrace,
+		shutdownMet:    shutdownMet,
+	}
+
+	for _, server := range cfg.Servers {
+		gateway.servers[server.ServerID] = gateway.newManagedServer(server)
 	}
 
-	for _, server := range gateway.servers {
-		server.metrics = metrics
+	if err := gateway.registerServerGauges(meter); err != nil {
+		endLifetime(err)
+		return nil, err
 	}
 
 	return gateway, nil
 }
 
-func initMetrics(meter metric.Meter) (*GatewayMetrics, error) {
-	requests, err := meter.Int64Counter(
-		"brain.mcp.gateway.requests",
-		metric.WithDescription("Total gateway MCP requests"),
-	)
-	if err != nil {
-		return nil, err
+func (g *Gateway) newManagedServer(server ServerConfig) *ManagedServer {
+	lifetime, endLifetime := context.WithCancelCause(g.lifetime)
+	// HTTP upstreams have no process to manage, so they are always ready.
+	status := "stopped"
+	if server.Transport == "http" {
+		status = "ready"
 	}
-	latency, err := meter.Int64Histogram(
-		"brain.mcp.gateway.latency",
-		metric.WithDescription("Gateway MCP latency"),
-		metric.WithUnit("ms"),
-	)
-	if err != nil {
-		return nil, err
+	var pendingSlots chan struct{}
+	if server.MaxPendingRequests > 0 {
+		pendingSlots = make(chan struct{}, server.MaxPendingRequests)
 	}
-	restarts, err := meter.Int64Counter(
-		"brain.mcp.gateway.restarts",
-		metric.WithDescription("Gateway MCP server restarts"),
-	)
-	if err != nil {
-		return nil, err
+	var rateLimiter *tokenBucket
+	if server.RateLimitRPS > 0 {
+		rateLimiter = newTokenBucket(server.RateLimitRPS, server.RateLimitBurst)
 	}
-	authFailures, err := meter.Int64Counter(
-		"brain.mcp.gateway.auth_failures",
-		metric.WithDescription("Gateway authentication failures"),
-	)
-	if err != nil {
-		return nil, err
+	managed := &ManagedServer{
+		status:           status,
+		initSem:          make(chan struct{}, 1),
+		writeSem:         make(chan struct{}, 1),
+		metrics:          g.metrics,
+		requestTimeout:   time.Duration(g.cfg.RequestTimeoutMS) * time.Millisecond,
+		firstByteTimeout: time.Duration(g.cfg.FirstByteTimeoutMS) * time.Millisecond,
+		stderrBuffer:     g.cfg.StderrBufferLines,
+		lifetime:         lifetime,
+		endLifetime:      endLifetime,
+		maxStartWait:     time.Duration(g.cfg.MaxStartWaitMS) * time.Millisecond,
+		strictSessions:   g.cfg.StrictSessions || g.cfg.StreamableHTTP,
+		maxLineBytes:     g.cfg.MaxLineBytes,
+		recorder:         g.recorder,
+		shedder:          g.shedder,
 	}
-
-	return &GatewayMetrics{
-		requests:     requests,
-		latency:      latency,
-		restarts:     restarts,
-		authFailures: authFailures,
-	}, nil
+	managed.settings.Store(&serverSettings{
+		cfg:               server,
+		logger:            g.logger.With(server.LogFields),
+		restartBackoff:    overrideMS(server.RestartBackoffMS, g.cfg.RestartBackoffMS),
+		restartBackoffMax: overrideMS(server.RestartBackoffMaxMS, g.cfg.RestartBackoffMaxMS),
+		restartReset:      overrideMS(server.RestartResetMS, g.cfg.RestartResetMS),
+		startupTimeout:    time.Duration(defaultInt(server.StartupTimeoutMS, defaultStartupTimeoutMS)) * time.Millisecond,
+		dependencyTimeout: overrideMS(server.DependencyTimeoutMS, g.cfg.DependencyTimeoutMS),
+		probeInterval:     time.Duration(defaultInt(server.ProbeIntervalMS, defaultProbeIntervalMS)) * time.Millisecond,
+		probeMaxInterval:  time.Duration(defaultInt(server.ProbeMaxInterval, defaultProbeMaxInterval)) * time.Millisecond,
+		cacheTTL:          time.Duration(server.CacheTTLMS) * time.Millisecond,
+		maxStale:          time.Duration(server.MaxStaleMS) * time.Millisecond,
+		maxStaleOnOutage:  time.Duration(server.MaxStaleOnOutageMS) * time.Millisecond,
+		idempotencyWindow: time.Duration(server.IdempotencyWindowMS) * time.Millisecond,
+		pendingSlots:      pendingSlots,
+		rateLimiter:       rateLimiter,
+	})
+	return managed
 }
 
-func (g *Gateway) routes() http.Handler {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", g.handleHealth)
-	mux.HandleFunc("/servers", g.handleServers)
-	mux.HandleFunc("/rpc", g.handleRPCWrapper)
-	mux.HandleFunc("/", g.handleRPCDirect)
-	return g.withMiddleware(mux)
+func (s *ManagedServer) reconfigure(next *ManagedServer) {
+	// next is a never-started server built from the new config; only its
+	// derived settings are taken over.
+	next.endLifetime(nil)
+	settings := *next.settings.Load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Calls holding a pending slot give it back to the channel they took it
+	// from, so in-flight work is not counted against the new limit.
+	if current := s.settings.Load(); cap(current.pendingSlots) == cap(settings.pendingSlots) {
+		settings.pendingSlots = current.pendingSlots
+	}
+	// Calls, readers, and probes read the settings without s.mu, so they are
+	// replaced as a whole instead of field by field.
+	s.settings.Store(&settings)
 }
 
-func (g *Gateway) withMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		if !g.isAllowedClient(r) {
-			g.metrics.authFailures.Add(ctx, 1)
-			g.logger.Log(ctx, "warn", "gateway_auth_denied", map[string]any{"remote": r.RemoteAddr})
-			writeError(w, http.StatusForbidden, GatewayError{ErrorCode: "auth_denied", Message: "client not allowed"})
-			return
-		}
+func (s *ManagedServer) config() *ServerConfig {
+	return &s.settings.Load().cfg
+}
 
-		if !g.checkAuth(r) {
-			g.metrics.authFailures.Add(ctx, 1)
-			g.logger.Log(ctx, "warn", "gateway_auth_failed", map[string]any{"remote": r.RemoteAddr})
-			writeError(w, http.StatusUnauthorized, GatewayError{ErrorCode: "auth_failed", Message: "invalid auth token"})
-			return
-		}
+func (s *ManagedServer) log() *Logger {
+	return s.settings.Load().logger
+}
 
-		next.ServeHTTP(w, r)
-	})
+func (g *Gateway) server(serverID string) (*ManagedServer, bool) {
+	g.serversMu.RLock()
+	defer g.serversMu.RUnlock()
+	server, ok := g.servers[serverID]
+	return server, ok
 }
 
-func (g *Gateway) checkAuth(r *http.Request) bool {
-	token := r.Header.Get("Authorization")
-	const prefix = "Bearer "
-	if !strings.HasPrefix(token, prefix) {
-		return false
+func (g *Gateway) serverIDAttr(serverID string) attribute.KeyValue {
+	// Request metrics can carry a server_id straight from the client; each
+	// distinct value would become its own series.
+	if _, ok := g.server(serverID); !ok && !g.cfg.MetricFullCardinality {
+		serverID = "unknown"
 	}
-	return strings.TrimSpace(strings.TrimPrefix(token, prefix)) == g.cfg.AuthToken
+	return attribute.String("server_id", serverID)
 }
 
-func (g *Gateway) isAllowedClient(r *http.Request) bool {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		host = r.RemoteAddr
-	}
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return false
-	}
-	for _, allowedIP := range g.allowedIPs {
-		if allowedIP.Equal(ip) {
-			return true
-		}
+func (g *Gateway) serverForTool(payload []byte) (string, int, *GatewayError) {
+	var request struct {
+		Method string `json:"method"`
+		Params struct {
+			Name string `json:"name"`
+		} `json:"params"`
 	}
-	for _, cidr := range g.allowedCIDRs {
-		if cidr.Contains(ip) {
-			return true
-		}
+	if json.Unmarshal(payload, &request) != nil || request.Method != "tools/call" || request.Params.Name == "" {
+		return "", http.StatusNotFound, &GatewayError{ErrorCode: "server_not_found", Message: "missing server_id (only tools/call can be routed by tool name)"}
 	}
-	return false
-}
 
-func (g *Gateway) handleHealth(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	status := "ok"
-	serverStatuses := g.collectServerStatuses()
-	for _, s := range serverStatuses {
-		statusValue, _ := s["status"].(string)
-		if statusValue != "ready" {
-			status = "degraded"
-			break
+	// Only tool lists a client already fetched are consulted; routing never
+	// calls tools/list itself.
+	var candidates []*ManagedServer
+	for _, server := range g.serverList() {
+		if server.providesTool(request.Params.Name) {
+			candidates = append(candidates, server)
 		}
 	}
-
-	response := map[string]any{
-		"status":         status,
-		"version":        serviceVersion,
-		"uptime_seconds": int(time.Since(g.startTime).Seconds()),
-		"servers":        serverStatuses,
+	if len(candidates) > 1 && g.cfg.ToolRoutingTieBreak == "priority" {
+		top := slices.MaxFunc(candidates, func(a, b *ManagedServer) int { return a.config().Priority - b.config().Priority }).config().Priority
+		candidates = slices.DeleteFunc(candidates, func(server *ManagedServer) bool { return server.config().Priority < top })
 	}
-
-	g.writeJSON(ctx, w, http.StatusOK, response)
-}
-
-func (g *Gateway) handleServers(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	g.writeJSON(ctx, w, http.StatusOK, map[string]any{
-		"servers": g.collectServerStatuses(),
-	})
-}
-
-func (g *Gateway) handleRPCWrapper(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	start := time.Now()
-
-	var req GatewayRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
-		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "invalid json"})
-		return
+	switch len(candidates) {
+	case 0:
+		return "", http.StatusNotFound, &GatewayError{ErrorCode: "tool_not_found", Message: fmt.Sprintf("no ready server lists tool %q", request.Params.Name)}
+	case 1:
+		return candidates[0].config().ServerID, 0, nil
 	}
-
-	requestID := extractRequestID(req.Payload)
-	spanCtx, span := g.tracer.Start(ctx, "mcp_gateway.request",
-		trace.WithAttributes(
-			attribute.String("server_id", req.ServerID),
-			attribute.String("request_id", requestID),
-		),
-	)
-	defer span.End()
-
-	server, ok := g.servers[req.ServerID]
-	if !ok {
-		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("status", "not_found")))
-		g.logger.Log(spanCtx, "warn", "gateway_server_not_found", map[string]any{"server_id": req.ServerID})
-		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: req.ServerID, RequestID: requestID})
-		return
+	ids := make([]string, 0, len(candidates))
+	for _, server := range candidates {
+		ids = append(ids, server.config().ServerID)
 	}
+	slices.Sort(ids)
+	return "", http.StatusConflict, &GatewayError{ErrorCode: "tool_ambiguous", Message: fmt.Sprintf("tool %q is listed by %s", request.Params.Name, strings.Join(ids, ", "))}
+}
 
-	if isNotification(req.Payload) {
-		if err := server.Send(spanCtx, req.Payload); err != nil {
-			g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("server_id", req.ServerID), attribute.String("status", "error")))
-			g.logger.Log(spanCtx, "error", "gateway_request_failed", map[string]any{"server_id": req.ServerID, "error": err.Error(), "request_id": requestID})
-			writeError(w, http.StatusBadGateway, GatewayError{ErrorCode: "server_error", Message: err.Error(), ServerID: req.ServerID, RequestID: requestID})
-			return
+func (g *Gateway) backupFor(serverID string) *ManagedServer {
+	g.serversMu.RLock()
+	defer g.serversMu.RUnlock()
+	for _, server := range g.servers {
+		if server.config().BackupFor == serverID {
+			return server
 		}
-		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("server_id", req.ServerID), attribute.String("status", "accepted")))
-		w.WriteHeader(http.StatusAccepted)
-		return
 	}
+	return nil
+}
 
-	responsePayload, err := server.Call(spanCtx, req.Payload, requestID)
-	statusLabel := "success"
-	if err != nil {
-		statusLabel = "error"
+func (g *Gateway) callWithFailover(ctx context.Context, server *ManagedServer, payload []byte, requestID string) (json.RawMessage, error) {
+	response, err := server.Call(ctx, payload, requestID)
+	if err == nil || ctx.Err() != nil {
+		return response, err
 	}
-	g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("server_id", req.ServerID), attribute.String("status", statusLabel)))
-	g.metrics.latency.Record(spanCtx, time.Since(start).Milliseconds(), metric.WithAttributes(attribute.String("server_id", req.ServerID)))
-
-	if err != nil {
-		g.logger.Log(spanCtx, "error", "gateway_request_failed", map[string]any{"server_id": req.ServerID, "error": err.Error(), "request_id": requestID})
-		writeError(w, http.StatusBadGateway, GatewayError{ErrorCode: "server_error", Message: err.Error(), ServerID: req.ServerID, RequestID: requestID})
-		return
+	// Only reads are retried: a write may have reached the primary before
+	// it died. A primary that is still ready failed the call itself (a
+	// timeout or a full queue), which is not a reason to go elsewhere.
+	if _, _, ok := readKey(payload); !ok || server.currentStatus() == "ready" {
+		return response, err
 	}
-
-	g.logger.Log(spanCtx, "info", "gateway_request_ok", map[string]any{"server_id": req.ServerID, "request_id": requestID})
-	g.writeJSON(spanCtx, w, http.StatusOK, GatewayResponse{ServerID: req.ServerID, Payload: responsePayload})
-}
-
-func (g *Gateway) handleRPCDirect(w http.ResponseWriter, r *http.Request) {
-	if !strings.HasSuffix(r.URL.Path, "/rpc") {
-		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "not_found", Message: "unknown endpoint"})
-		return
+	backup := g.backupFor(server.config().ServerID)
+	if backup == nil {
+		return response, err
 	}
+	attrs := metric.WithAttributes(attribute.String("server_id", server.config().ServerID), attribute.String("backup_id", backup.config().ServerID))
+	g.metrics.failovers.Add(ctx, 1, attrs)
+	server.log().Log(ctx, "warn", "gateway_failover", map[string]any{"server_id": server.config().ServerID, "backup_id": backup.config().ServerID, "request_id": requestID, "error": err.Error()})
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("backup_id", backup.config().ServerID))
+	return backup.Call(ctx, payload, requestID)
+}
 
-	serverID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/rpc")
-	if serverID == "" {
-		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "missing server_id"})
-		return
+func (g *Gateway) serverList() []*ManagedServer {
+	g.serversMu.RLock()
+	defer g.serversMu.RUnlock()
+	servers := make([]*ManagedServer, 0, len(g.servers))
+	for _, server := range g.servers {
+		servers = append(servers, server)
 	}
+	return servers
+}
 
-	ctx := r.Context()
-	start := time.Now()
+func (g *Gateway) reload(ctx context.Context, path string) (reloadSummary, error) {
+	// SIGHUP, the config watcher, and POST /reload may race.
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
 
-	if r.Method == http.MethodGet {
-		g.handleRPCStream(ctx, w, r, serverID)
-		return
+	next, err := loadConfig(path)
+	if err != nil {
+		return reloadSummary{}, err
 	}
 
-	body, err := io.ReadAll(r.Body)
+	// A bad allowlist fails the whole reload, keeping the previous one.
+	allowedIPs, allowedCIDRs, err := loadClientAllowlist(*next)
 	if err != nil {
-		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
-		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "invalid body"})
-		return
+		return reloadSummary{}, err
 	}
-
-	requestID := extractRequestID(body)
-	spanCtx, span := g.tracer.Start(ctx, "mcp_gateway.request",
-		trace.WithAttributes(
-			attribute.String("server_id", serverID),
-			attribute.String("request_id", requestID),
-		),
-	)
-	defer span.End()
-
-	server, ok := g.servers[serverID]
-	if !ok {
-		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("status", "not_found")))
-		g.logger.Log(spanCtx, "warn", "gateway_server_not_found", map[string]any{"server_id": serverID})
-		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: serverID, RequestID: requestID})
-		return
+	g.allowlist.replace(allowedIPs, allowedCIDRs)
+
+	current := g.cfg
+	current.Servers, current.AllowedClients, current.AllowedClientsFile = nil, nil, ""
+	settings := *next
+	settings.Servers, settings.AllowedClients, settings.AllowedClientsFile = nil, nil, ""
+	settingsChanged := !reflect.DeepEqual(current, settings)
+
+	summary := reloadSummary{Added: []string{}, Removed: []string{}, Changed: []string{}, Reconfigured: []string{}, Unchanged: []string{}, SettingsRequireRestart: settingsChanged}
+	var stopped, started []*ManagedServer
+	replaced := make(map[*ManagedServer]*ManagedServer)
+	wanted := make(map[string]bool)
+	g.serversMu.Lock()
+	for _, serverCfg := range next.Servers {
+		wanted[serverCfg.ServerID] = true
+		existing, ok := g.servers[serverCfg.ServerID]
+		// A graceful replacement still starting is what the server is about
+		// to become, so it is kept if the config still asks for it, and
+		// otherwise stopped before the running process is diffed as usual.
+		if ok {
+			superseded, kept := existing.reconcileReplacement(serverCfg)
+			if kept {
+				summary.Unchanged = append(summary.Unchanged, serverCfg.ServerID)
+				continue
+			}
+			if superseded != nil {
+				stopped = append(stopped, superseded)
+				g.logger.Log(ctx, "info", "gateway_server_replace_superseded", map[string]any{"server_id": serverCfg.ServerID})
+			}
+		}
+		if ok && reflect.DeepEqual(*existing.config(), serverCfg) {
+			summary.Unchanged = append(summary.Unchanged, serverCfg.ServerID)
+			continue
+		}
+		if ok && !processChanged(*existing.config(), serverCfg) {
+			summary.Reconfigured = append(summary.Reconfigured, serverCfg.ServerID)
+			existing.reconfigure(g.newManagedServer(serverCfg))
+			g.logger.Log(ctx, "info", "gateway_server_reloaded", map[string]any{"server_id": serverCfg.ServerID, "action": "in_place"})
+			continue
+		}
+		// A running server being replaced gracefully keeps its slot in
+		// g.servers until the replacement is ready.
+		if ok && serverCfg.RestartMode == "graceful_replace" && existing.currentStatus() == "ready" {
+			summary.Changed = append(summary.Changed, serverCfg.ServerID)
+			replaced[existing] = existing.beginReplacement(g.newManagedServer(serverCfg))
+			g.logger.Log(ctx, "info", "gateway_server_reloaded", map[string]any{"server_id": serverCfg.ServerID, "action": "graceful_replace"})
+			continue
+		}
+		if ok {
+			summary.Changed = append(summary.Changed, serverCfg.ServerID)
+			stopped = append(stopped, existing)
+			g.logger.Log(ctx, "info", "gateway_server_reloaded", map[string]any{"server_id": serverCfg.ServerID, "action": "restart"})
+		} else {
+			summary.Added = append(summary.Added, serverCfg.ServerID)
+		}
+		server := g.newManagedServer(serverCfg)
+		g.servers[serverCfg.ServerID] = server
+		started = append(started, server)
 	}
-
-	if isNotification(body) {
-		if err := server.Send(spanCtx, body); err != nil {
-			g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("server_id", serverID), attribute.String("status", "error")))
-			g.logger.Log(spanCtx, "error", "gateway_request_failed", map[string]any{"server_id": serverID, "error": err.Error(), "request_id": requestID})
-			writeError(w, http.StatusBadGateway, GatewayError{ErrorCode: "server_error", Message: err.Error(), ServerID: serverID, RequestID: requestID})
-			return
+	g.shedder.protect(next.Servers)
+	for serverID, existing := range g.servers {
+		if !wanted[serverID] {
+			summary.Removed = append(summary.Removed, serverID)
+			stopped = append(stopped, existing)
+			delete(g.servers, serverID)
 		}
-		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("server_id", serverID), attribute.String("status", "accepted")))
-		w.WriteHeader(http.StatusAccepted)
-		return
 	}
+	g.serversMu.Unlock()
 
-	responsePayload, err := server.Call(spanCtx, body, requestID)
-	statusLabel := "success"
-	if err != nil {
-		statusLabel = "error"
+	for _, server := range stopped {
+		server.Close(ctx)
 	}
-	g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("server_id", serverID), attribute.String("status", statusLabel)))
-	g.metrics.latency.Record(spanCtx, time.Since(start).Milliseconds(), metric.WithAttributes(attribute.String("server_id", serverID)))
-
-	if err != nil {
-		g.logger.Log(spanCtx, "error", "gateway_request_failed", map[string]any{"server_id": serverID, "error": err.Error(), "request_id": requestID})
-		writeError(w, http.StatusBadGateway, GatewayError{ErrorCode: "server_error", Message: err.Error(), ServerID: serverID, RequestID: requestID})
-		return
+	// Starts run in the background so a reload adding many servers returns
+	// promptly; their progress shows in /servers. Required servers only gate
+	// boot, so after a reload they are logged like the rest.
+	go g.startServers(g.lifetime, started)
+	for old, next := range replaced {
+		go g.replaceServer(g.lifetime, old, next)
 	}
 
-	g.logger.Log(spanCtx, "info", "gateway_request_ok", map[string]any{"server_id": serverID, "request_id": requestID})
-	g.writeRawJSON(spanCtx, w, http.StatusOK, responsePayload, server)
+	slices.Sort(summary.Added)
+	slices.Sort(summary.Removed)
+	slices.Sort(summary.Changed)
+	slices.Sort(summary.Reconfigured)
+	slices.Sort(summary.Unchanged)
+	g.logger.Log(ctx, "info", "gateway_config_reloaded", map[string]any{
+		"added":        summary.Added,
+		"removed":      summary.Removed,
+		"changed":      summary.Changed,
+		"reconfigured": summary.Reconfigured,
+		"unchanged":    summary.Unchanged,
+		// Gateway-level settings are fixed at startup; only the server set
+		// and the client allowlist are applied live.
+		"settings_require_restart": settingsChanged,
+	})
+	return summary, nil
 }
 
-func (g *Gateway) handleRPCStream(ctx context.Context, w http.ResponseWriter, r *http.Request, serverID string) {
-	server, ok := g.servers[serverID]
-	if !ok {
-		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: serverID})
+// replaceServer starts next, which the caller has passed to
+// old.beginReplacement, and swaps it in for old once it is ready.
+func (g *Gateway) replaceServer(ctx context.Context, old, next *ManagedServer) {
+	serverID := next.config().ServerID
+	err := next.Start(ctx)
+
+	// The swap and clearing the replacement happen under serversMu, so a
+	// reload sees either the pending replacement or the swapped server.
+	g.serversMu.Lock()
+	old.mu.Lock()
+	current := old.replacement == next
+	if current {
+		old.replacement = nil
+	}
+	old.mu.Unlock()
+	swapped := current && err == nil && g.servers[serverID] == old
+	if swapped {
+		g.servers[serverID] = next
+	}
+	g.serversMu.Unlock()
+	// A later reload superseded the replacement and stops it.
+	if !current {
 		return
 	}
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	if sessionID := server.ensureSessionID(); sessionID != "" {
-		w.Header().Set("MCP-Session-Id", sessionID)
+	if err != nil {
+		next.Close(ctx)
+		g.logger.Log(ctx, "error", "gateway_server_replace_failed", map[string]any{"server_id": serverID, "error": err.Error()})
+		return
 	}
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		writeError(w, http.StatusInternalServerError, GatewayError{ErrorCode: "streaming_not_supported", Message: "response does not support streaming"})
+	// A later reload already replaced or removed the server.
+	if !swapped {
+		next.Close(ctx)
 		return
 	}
 
-	// Initial comment to establish stream
-	_, _ = w.Write([]byte(": ok\n\n"))
-	flusher.Flush()
+	next.mu.Lock()
+	next.draining = old
+	next.mu.Unlock()
+	drained := old.drain(ctx, replaceDrainTimeout)
+	old.Close(ctx)
+	next.mu.Lock()
+	next.draining = nil
+	next.mu.Unlock()
+	g.logger.Log(ctx, "info", "gateway_server_replaced", map[string]any{"server_id": serverID, "pid": next.pid(), "drained": drained})
+}
 
-	ticker := time.NewTicker(25 * time.Second)
+func (g *Gateway) recycleAged(ctx context.Context) {
+	ticker := time.NewTicker(lifetimeCheckInterval)
 	defer ticker.Stop()
-
 	for {
 		select {
+		case <-ticker.C:
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			_, _ = w.Write([]byte(": keep-alive\n\n"))
-			flusher.Flush()
 		}
-	}
-}
-
-func (g *Gateway) writeJSON(ctx context.Context, w http.ResponseWriter, status int, payload any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		g.logger.Log(ctx, "error", "gateway_write_failed", map[string]any{"error": err.Error()})
-	}
-}
 
-func (g *Gateway) writeRawJSON(ctx context.Context, w http.ResponseWriter, status int, payload json.RawMessage, server *ManagedServer) {
-	w.Header().Set("Content-Type", "application/json")
-	if server != nil && isInitializeRequest(payload) {
-		sessionID := server.ensureSessionID()
-		if sessionID != "" {
-			w.Header().Set("MCP-Session-Id", sessionID)
+		// Only the oldest expired server is recycled per pass, and the next
+		// pass waits for it to be back, so servers started together are not
+		// all restarted together.
+		var oldest *ManagedServer
+		var oldestAge time.Duration
+		for _, server := range g.serverList() {
+			if age, ok := server.expired(); ok && age > oldestAge {
+				oldest, oldestAge = server, age
+			}
 		}
-	}
-	w.WriteHeader(status)
-	if _, err := w.Write(payload); err != nil {
-		g.logger.Log(ctx, "error", "gateway_write_failed", map[string]any{"error": err.Error()})
-	}
-}
-
-func (g *Gateway) collectServerStatuses() []map[string]any {
-	statuses := make([]map[string]any, 0, len(g.servers))
-	for _, server := range g.servers {
-		statuses = append(statuses, server.Status())
-	}
-	return statuses
-}
-
-func (g *Gateway) startAutostartServers(ctx context.Context) {
-	for _, server := range g.servers {
-		if !server.cfg.Autostart {
+		if oldest == nil {
 			continue
 		}
-		if err := server.Start(ctx); err != nil {
-			g.logger.Log(ctx, "error", "gateway_server_start_failed", map[string]any{"server_id": server.cfg.ServerID, "error": err.Error()})
+		cfg := *oldest.config()
+		g.logger.Log(ctx, "info", "mcp_server_lifetime_recycle", map[string]any{"server_id": cfg.ServerID, "pid": oldest.pid(), "age_ms": oldestAge.Milliseconds(), "restart_mode": cfg.RestartMode})
+		if cfg.RestartMode == "graceful_replace" {
+			g.replaceServer(ctx, oldest, oldest.beginReplacement(g.newManagedServer(cfg)))
+			continue
 		}
+		oldest.recycle(ctx)
 	}
 }
 
-func (s *ManagedServer) Start(ctx context.Context) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if s.status == "ready" || s.status == "starting" {
-		return nil
+func checkDependencies(servers []ServerConfig) error {
+	dependsOn := make(map[string][]string, len(servers))
+	for _, server := range servers {
+		dependsOn[server.ServerID] = server.DependsOn
 	}
-
-	cmd := exec.Command(s.cfg.Command, s.cfg.Args...)
-	if s.cfg.WorkingDir != "" {
-		cmd.Dir = s.cfg.WorkingDir
+	for _, server := range servers {
+		for _, dependencyID := range server.DependsOn {
+			if _, ok := dependsOn[dependencyID]; !ok || dependencyID == server.ServerID {
+				return fmt.Errorf("depends_on %q for server_id %s must name another server", dependencyID, server.ServerID)
+			}
+		}
 	}
-	cmd.Env = os.Environ()
-	for key, value := range s.cfg.Env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	// A cycle would leave every server in it waiting out its timeout.
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(servers))
+	var visit func(serverID string) error
+	visit = func(serverID string) error {
+		switch state[serverID] {
+		case visiting:
+			return fmt.Errorf("depends_on cycle through server_id %s", serverID)
+		case done:
+			return nil
+		}
+		state[serverID] = visiting
+		for _, dependencyID := range dependsOn[serverID] {
+			if err := visit(dependencyID); err != nil {
+				return err
+			}
+		}
+		state[serverID] = done
+		return nil
+	}
+	for _, server := range servers {
+		if err := visit(server.ServerID); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	stdin, err := cmd.StdinPipe()
+func processChanged(current, next ServerConfig) bool {
+	// Everything else only shapes how the gateway talks to the process, or
+	// is read again at the next start.
+	return current.Command != next.Command ||
+		!slices.Equal(current.Args, next.Args) ||
+		!maps.Equal(current.Env, next.Env) ||
+		current.EnvFile != next.EnvFile ||
+		current.WorkingDir != next.WorkingDir ||
+		current.Transport != next.Transport ||
+		current.BaseURL != next.BaseURL
+}
+
+func watchConfig(ctx context.Context, path string, logger *Logger, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
+	// Watching the directory catches atomic replacements (rename over the
+	// file, or a configmap-style symlink swap) that drop a file-only watch.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
 		return err
 	}
-	stderr, err := cmd.StderrPipe()
+	_ = watcher.Add(path)
+	last, _ := os.ReadFile(path)
+
+	go func() {
+		defer watcher.Close()
+		debounce := time.NewTimer(configWatchDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-watcher.Events:
+				debounce.Reset(configWatchDebounce)
+			case err := <-watcher.Errors:
+				logger.Log(ctx, "warn", "gateway_config_watch_error", map[string]any{"error": err.Error()})
+			case <-debounce.C:
+				// Re-add the file watch in case the old inode was replaced.
+				_ = watcher.Remove(path)
+				if err := watcher.Add(path); err != nil {
+					logger.Log(ctx, "warn", "gateway_config_watch_error", map[string]any{"path": path, "error": err.Error()})
+				}
+				data, err := os.ReadFile(path)
+				if err != nil || bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
+
+func (g *Gateway) registerServerGauges(meter metric.Meter) error {
+	_, err := meter.Int64ObservableGauge(
+		"brain.mcp.gateway.paused",
+		metric.WithDescription("Whether a gateway MCP server is paused (1) or accepting requests (0)"),
+		metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+			for _, server := range g.serverList() {
+				value := int64(0)
+				if server.isPaused() {
+					value = 1
+				}
+				observer.Observe(value, metric.WithAttributes(attribute.String("server_id", server.config().ServerID)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	if g.shedder != nil {
+		_, err = meter.Int64ObservableGauge(
+			"brain.mcp.gateway.shedding",
+			metric.WithDescription("1 while the gateway is shedding load, else 0"),
+			metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+				var value int64
+				if g.shedder.isActive() {
+					value = 1
+				}
+				observer.Observe(value)
+				return nil
+			}),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = meter.Float64ObservableGauge(
+		"brain.mcp.gateway.utilization",
+		metric.WithDescription("In-flight requests divided by the server's max_pending_requests, or busy (1) versus idle (0) without it"),
+		metric.WithFloat64Callback(func(_ context.Context, observer metric.Float64Observer) error {
+			for _, server := range g.serverList() {
+				// HTTP upstreams have no gateway-side concurrency limit.
+				if server.config().Transport == "http" {
+					continue
+				}
+				observer.Observe(server.utilization(), metric.WithAttributes(attribute.String("server_id", server.config().ServerID)))
+			}
+			return nil
+		}),
+	)
+	return err
+}
+
+func initMetrics(meter metric.Meter) (*GatewayMetrics, error) {
+	requests, err := meter.Int64Counter(
+		"brain.mcp.gateway.requests",
+		metric.WithDescription("Total gateway MCP requests"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	latency, err := meter.Int64Histogram(
+		"brain.mcp.gateway.latency",
+		metric.WithDescription("Gateway MCP latency"),
+		metric.WithUnit("ms"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	restarts, err := meter.Int64Counter(
+		"brain.mcp.gateway.restarts",
+		metric.WithDescription("Gateway MCP server restarts"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	authFailures, err := meter.Int64Counter(
+		"brain.mcp.gateway.auth_failures",
+		metric.WithDescription("Gateway authentication failures"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	decodeErrors, err := meter.Int64Counter(
+		"brain.mcp.gateway.decode_errors",
+		metric.WithDescription("Unparseable lines skipped on MCP server stdout"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	stderrDrops, err := meter.Int64Counter(
+		"brain.mcp.gateway.stderr_lines_dropped",
+		metric.WithDescription("MCP server stderr lines dropped because logging fell behind"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	failovers, err := meter.Int64Counter(
+		"brain.mcp.gateway.failovers",
+		metric.WithDescription("Calls routed to a backup server because the primary had failed"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	stdinBytes, err := meter.Int64Counter(
+		"brain.mcp.gateway.stdin_bytes",
+		metric.WithDescription("Bytes written to MCP server stdin"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	stdoutBytes, err := meter.Int64Counter(
+		"brain.mcp.gateway.stdout_bytes",
+		metric.WithDescription("Bytes read from MCP server stdout"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GatewayMetrics{
+		requests:     requests,
+		latency:      latency,
+		restarts:     restarts,
+		authFailures: authFailures,
+		decodeErrors: decodeErrors,
+		stderrDrops:  stderrDrops,
+		failovers:    failovers,
+		stdinBytes:   stdinBytes,
+		stdoutBytes:  stdoutBytes,
+	}, nil
+}
+
+func (g *Gateway) listen(ctx context.Context, addr string) (net.Listener, error) {
+	delay := time.Duration(g.cfg.BindRetryDelayMS) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ln, err := net.Listen("tcp", addr)
+		// Only a port that is still held, typically by the previous process
+		// right after a restart, is worth waiting out.
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || attempt > g.cfg.BindRetryAttempts {
+			return ln, err
+		}
+		g.logger.Log(ctx, "warn", "gateway_bind_retry", map[string]any{"addr": addr, "attempt": attempt, "max_attempts": g.cfg.BindRetryAttempts, "delay_ms": delay.Milliseconds(), "error": err.Error()})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+func (g *Gateway) newListener(addr string, handler http.Handler) *http.Server {
+	// net/http answers 431 itself once a request's headers exceed the limit.
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: g.tlsConfig,
+	}
+	if g.cfg.MaxHeaderBytes != nil {
+		server.MaxHeaderBytes = *g.cfg.MaxHeaderBytes
+	}
+	return server
+}
+
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	versions := map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+	minVersion, ok := versions[cfg.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls_min_version %q (expected 1.0, 1.1, 1.2, or 1.3)", cfg.TLSMinVersion)
+	}
+	// Suites Go considers insecure are deliberately not accepted by name.
+	var suites []uint16
+	for _, name := range cfg.TLSCipherSuites {
+		idx := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool { return suite.Name == name })
+		if idx < 0 {
+			return nil, fmt.Errorf("unknown cipher suite %q in tls_cipher_suites", name)
+		}
+		suites = append(suites, tls.CipherSuites()[idx].ID)
+	}
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	return &tls.Config{MinVersion: minVersion, CipherSuites: suites}, nil
+}
+
+func (g *Gateway) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc", g.handleRPCWrapper)
+	mux.HandleFunc("/", g.handleRPCDirect)
+	if g.cfg.CapabilitiesEndpoint {
+		mux.HandleFunc("/capabilities", g.handleCapabilities)
+	}
+	if g.cfg.AdminBind == "" {
+		g.registerAdminRoutes(mux)
+	}
+	return g.withMiddleware(mux, g.allowlist)
+}
+
+func (g *Gateway) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+	g.registerAdminRoutes(mux)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && g.cfg.LandingPage != "off" {
+			g.handleLandingPage(w, r)
+			return
+		}
+		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "not_found", Message: "unknown endpoint"})
+	})
+	return g.withMiddleware(mux, g.adminAllowlist)
+}
+
+func (g *Gateway) registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/health", g.handleHealth)
+	mux.HandleFunc("/servers", g.handleServers)
+	mux.HandleFunc("/servers/", g.handleServerAdmin)
+	mux.HandleFunc("/requests/recent", g.handleRecentRequests)
+	mux.HandleFunc("/reload", g.handleReload)
+}
+
+func (g *Gateway) withMiddleware(next http.Handler, allowlist *clientAllowlist) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !allowlist.allows(r.RemoteAddr) {
+			g.metrics.authFailures.Add(ctx, 1)
+			g.logger.Log(ctx, "warn", "gateway_auth_denied", map[string]any{"remote": r.RemoteAddr})
+			writeError(w, http.StatusForbidden, GatewayError{ErrorCode: "auth_denied", Message: "client not allowed"})
+			return
+		}
+
+		// Orchestrator probes often cannot carry a token; the allowlist
+		// above still applies to them.
+		healthProbe := g.cfg.HealthSkipAuth && r.Method == http.MethodGet && r.URL.Path == "/health"
+		authenticated := g.checkAuth(r)
+		if !healthProbe && !authenticated {
+			g.metrics.authFailures.Add(ctx, 1)
+			g.logger.Log(ctx, "warn", "gateway_auth_failed", map[string]any{"remote": r.RemoteAddr, "headers": g.loggableHeaders(r.Header)})
+			writeError(w, http.StatusUnauthorized, GatewayError{ErrorCode: "auth_failed", Message: "invalid auth token"})
+			return
+		}
+		// The revision tells an attacker which fixes are missing, so only
+		// authenticated clients see it.
+		if g.version != "" && authenticated {
+			w.Header().Set("X-Gateway-Version", g.version)
+		}
+
+		// GETs are status reads or long-lived streams; only work-bearing
+		// requests count against the gateway-wide limit.
+		if g.requestSlots != nil && r.Method != http.MethodGet {
+			select {
+			case g.requestSlots <- struct{}{}:
+				defer func() { <-g.requestSlots }()
+			default:
+				g.logger.Log(ctx, "warn", "gateway_busy", map[string]any{"remote": r.RemoteAddr, "limit": cap(g.requestSlots)})
+				writeError(w, http.StatusServiceUnavailable, GatewayError{ErrorCode: "gateway_busy", Message: "too many concurrent requests"})
+				return
+			}
+		}
+		if g.memory != nil && r.Method != http.MethodGet && g.memory.isPressured() {
+			writeError(w, http.StatusServiceUnavailable, GatewayError{ErrorCode: "memory_pressure", Message: "gateway memory above high watermark"})
+			return
+		}
+		if g.shedder != nil && r.Method != http.MethodGet {
+			g.shedder.enter(ctx)
+			defer g.shedder.leave(ctx)
+		}
+
+		start := time.Now()
+		summary := &requestSummary{Client: r.RemoteAddr}
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(ctx, requestSummaryKey{}, summary)))
+		if summary.ServerID != "" {
+			summary.Timestamp = start.UTC().Format(time.RFC3339Nano)
+			summary.Status = recorder.status
+			summary.LatencyMS = time.Since(start).Milliseconds()
+			g.recentRequests.Add(*summary)
+		}
+	})
+}
+
+func buildVersion() string {
+	// Only binaries built from a checkout carry the VCS revision.
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return serviceVersion
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && setting.Value != "" {
+			return serviceVersion + "+" + setting.Value
+		}
+	}
+	return serviceVersion
+}
+
+func (g *Gateway) loggableHeaders(header http.Header) map[string]string {
+	// Header values reach the logs only through here. Only a fixed set of
+	// correlation headers is logged at all, so credentials such as
+	// Authorization or Cookie never are; redact_headers masks any of the set.
+	fields := map[string]string{}
+	for _, name := range []string{"User-Agent", "X-Forwarded-For", g.cfg.RequestIDHeader} {
+		name = http.CanonicalHeaderKey(name)
+		values := header.Values(name)
+		if name == "" || len(values) == 0 {
+			continue
+		}
+		if g.redactHeaders[name] {
+			fields[name] = "***"
+			continue
+		}
+		fields[name] = strings.Join(values, ", ")
+	}
+	return fields
+}
+
+func annotateRequest(ctx context.Context, serverID string, payload []byte, requestID string) {
+	summary, ok := ctx.Value(requestSummaryKey{}).(*requestSummary)
+	if !ok {
+		return
+	}
+	summary.ServerID = serverID
+	summary.Method, _ = parseMethodAndID(payload)
+	summary.RequestID = requestID
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.IsValid() {
+		summary.TraceID = spanCtx.TraceID().String()
+	}
+}
+
+func (g *Gateway) checkAuth(r *http.Request) bool {
+	token := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(token, prefix) {
+		return false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(token, prefix)) == g.cfg.AuthToken
+}
+
+func (a *clientAllowlist) replace(ips []net.IP, cidrs []*net.IPNet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ips = ips
+	a.cidrs = cidrs
+}
+
+func (a *clientAllowlist) allows(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, allowedIP := range a.ips {
+		if allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	for _, cidr := range a.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	serverStatuses := g.collectServerStatuses()
+	counts := map[string]int{"ready": 0, "starting": 0, "stopped": 0, "error": 0}
+	for _, s := range serverStatuses {
+		statusValue, _ := s["status"].(string)
+		counts[statusValue]++
+	}
+
+	// Starting is transient, so it only sets the overall status when no
+	// server is down outright.
+	status := "ok"
+	switch {
+	case counts["ready"]+counts["starting"] < len(serverStatuses):
+		status = "degraded"
+	case counts["starting"] > 0:
+		status = "starting"
+	}
+
+	response := map[string]any{
+		"status":         status,
+		"counts":         counts,
+		"version":        serviceVersion,
+		"uptime_seconds": int(time.Since(g.startTime).Seconds()),
+		"servers":        serverStatuses,
+	}
+	if g.shedder != nil {
+		response["shedding"] = g.shedder.state()
+	}
+	if g.memory != nil {
+		response["memory"] = g.memory.state()
+	}
+
+	g.writeJSON(ctx, w, http.StatusOK, response)
+}
+
+func (g *Gateway) handleServers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g.writeJSON(ctx, w, http.StatusOK, map[string]any{
+		"servers": g.collectServerStatuses(),
+	})
+}
+
+func (g *Gateway) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, GatewayError{ErrorCode: "method_not_allowed", Message: "use GET"})
+		return
+	}
+	includeTools := r.URL.Query().Get("tools") == "true"
+	servers := map[string]any{}
+	for _, server := range g.serverList() {
+		if document := server.capabilities(includeTools); document != nil {
+			servers[server.config().ServerID] = document
+		}
+	}
+	g.writeJSON(r.Context(), w, http.StatusOK, map[string]any{"servers": servers})
+}
+
+func (g *Gateway) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !g.cfg.AdminEnabled {
+		writeError(w, http.StatusForbidden, GatewayError{ErrorCode: "admin_disabled", Message: "admin endpoints are disabled"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, GatewayError{ErrorCode: "method_not_allowed", Message: "use POST"})
+		return
+	}
+
+	ctx := r.Context()
+	g.logger.Log(ctx, "warn", "gateway_admin_action", map[string]any{"action": "reload", "remote": r.RemoteAddr})
+	// The reload outlives a client that gives up waiting on it.
+	summary, err := g.reload(context.WithoutCancel(ctx), g.configPath)
+	if err != nil {
+		g.logger.Log(ctx, "error", "gateway_config_reload_failed", map[string]any{"error": err.Error()})
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_config", Message: err.Error()})
+		return
+	}
+	g.writeJSON(ctx, w, http.StatusAccepted, summary)
+}
+
+func (g *Gateway) handleRecentRequests(w http.ResponseWriter, r *http.Request) {
+	if !g.cfg.AdminEnabled {
+		writeError(w, http.StatusForbidden, GatewayError{ErrorCode: "admin_disabled", Message: "admin endpoints are disabled"})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, GatewayError{ErrorCode: "method_not_allowed", Message: "use GET"})
+		return
+	}
+
+	n := 0
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "n must be a positive integer"})
+			return
+		}
+		n = parsed
+	}
+
+	g.writeJSON(r.Context(), w, http.StatusOK, map[string]any{
+		"requests": g.recentRequests.Recent(n),
+	})
+}
+
+func (g *Gateway) handleServerAdmin(w http.ResponseWriter, r *http.Request) {
+	serverID, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/servers/"), "/"), "/")
+	if !g.cfg.AdminEnabled {
+		writeError(w, http.StatusForbidden, GatewayError{ErrorCode: "admin_disabled", Message: "admin endpoints are disabled", ServerID: serverID})
+		return
+	}
+
+	server, ok := g.server(serverID)
+	if !ok {
+		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: serverID})
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, GatewayError{ErrorCode: "method_not_allowed", Message: "use GET", ServerID: serverID})
+			return
+		}
+		g.writeJSON(r.Context(), w, http.StatusOK, server.Status())
+	case "stdin":
+		g.handleServerStdin(w, r, server)
+	case "pause", "resume":
+		g.handleServerPause(w, r, server, action)
+	case "start", "stop", "restart":
+		g.handleServerLifecycle(w, r, server, action)
+	default:
+		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "not_found", Message: "unknown endpoint", ServerID: serverID})
+	}
+}
+
+func (g *Gateway) handleServerStdin(w http.ResponseWriter, r *http.Request, server *ManagedServer) {
+	ctx := r.Context()
+	serverID := server.config().ServerID
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, GatewayError{ErrorCode: "method_not_allowed", Message: "use POST", ServerID: serverID})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "invalid body", ServerID: serverID})
+		return
+	}
+
+	err = server.Send(ctx, body)
+	auditFields := map[string]any{"server_id": serverID, "action": "stdin", "remote": r.RemoteAddr, "bytes": len(body)}
+	if err != nil {
+		auditFields["error"] = err.Error()
+	}
+	g.logger.Log(ctx, "warn", "gateway_admin_action", auditFields)
+
+	if err != nil {
+		status, code := classifyCallError(err)
+		writeError(w, status, GatewayError{ErrorCode: code, Message: err.Error(), ServerID: serverID})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (g *Gateway) handleServerPause(w http.ResponseWriter, r *http.Request, server *ManagedServer, action string) {
+	ctx := r.Context()
+	serverID := server.config().ServerID
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, GatewayError{ErrorCode: "method_not_allowed", Message: "use POST", ServerID: serverID})
+		return
+	}
+
+	if action == "pause" {
+		server.Pause()
+	} else {
+		server.Resume()
+	}
+	g.logger.Log(ctx, "warn", "gateway_admin_action", map[string]any{"server_id": serverID, "action": action, "remote": r.RemoteAddr})
+	g.writeJSON(ctx, w, http.StatusOK, server.Status())
+}
+
+func (g *Gateway) handleServerLifecycle(w http.ResponseWriter, r *http.Request, server *ManagedServer, action string) {
+	ctx := r.Context()
+	serverID := server.config().ServerID
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, GatewayError{ErrorCode: "method_not_allowed", Message: "use POST", ServerID: serverID})
+		return
+	}
+	if server.config().Transport == "http" {
+		writeError(w, http.StatusConflict, GatewayError{ErrorCode: "invalid_request", Message: "http servers have no process to manage", ServerID: serverID})
+		return
+	}
+
+	// A client that hangs up must not leave the server half stopped or
+	// abandon a start partway through its probes.
+	actionCtx := context.WithoutCancel(ctx)
+	var err error
+	switch action {
+	case "start":
+		err = server.Start(actionCtx)
+	case "stop":
+		err = server.Stop(actionCtx)
+	default:
+		err = server.Restart(actionCtx)
+	}
+	auditFields := map[string]any{"server_id": serverID, "action": action, "remote": r.RemoteAddr}
+	if err != nil {
+		auditFields["error"] = err.Error()
+	}
+	g.logger.Log(ctx, "warn", "gateway_admin_action", auditFields)
+
+	if err != nil {
+		status, code := classifyCallError(err)
+		writeError(w, status, GatewayError{ErrorCode: code, Message: err.Error(), ServerID: serverID})
+		return
+	}
+	g.writeJSON(ctx, w, http.StatusOK, server.Status())
+}
+
+func (g *Gateway) handleRPCWrapper(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeAllow(w, http.MethodPost, http.MethodOptions)
+		return
+	}
+	ctx := r.Context()
+	start := time.Now()
+
+	var req GatewayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "invalid json"})
+		return
+	}
+	// Without tool routing there is nothing to pick a server from.
+	if req.ServerID == "" && !g.cfg.ToolRouting {
+		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "missing server_id"})
+		return
+	}
+	// A JSON null decodes to the literal, not to an empty payload.
+	if payload := bytes.TrimSpace(req.Payload); len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "missing payload", ServerID: req.ServerID})
+		return
+	}
+	if isBatch(req.Payload) {
+		g.handleBatch(w, r, req.ServerID, req.Payload, true)
+		return
+	}
+	if req.ServerID == "" && g.cfg.ToolRouting {
+		serverID, status, gatewayErr := g.serverForTool(req.Payload)
+		if gatewayErr != nil {
+			g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "not_routed")))
+			g.logger.Log(ctx, "warn", "gateway_tool_route_failed", map[string]any{"error_code": gatewayErr.ErrorCode, "error": gatewayErr.Message})
+			gatewayErr.RequestID = rawRequestID(req.Payload)
+			writeError(w, status, *gatewayErr)
+			return
+		}
+		req.ServerID = serverID
+	}
+
+	rawID := rawRequestID(req.Payload)
+	requestID := g.requestID(w, r, req.Payload)
+	spanCtx, span := g.tracer.Start(ctx, "mcp_gateway.request",
+		trace.WithAttributes(
+			attribute.String("server_id", req.ServerID),
+			attribute.String("request_id", requestID),
+		),
+	)
+	defer span.End()
+	annotateRequest(spanCtx, req.ServerID, req.Payload, requestID)
+
+	server, ok := g.server(req.ServerID)
+	if !ok {
+		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("status", "not_found")))
+		g.logger.Log(spanCtx, "warn", "gateway_server_not_found", map[string]any{"server_id": req.ServerID})
+		writeSpanError(span, w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: req.ServerID, RequestID: rawID})
+		return
+	}
+
+	timing := &callTiming{}
+	callCtx := context.WithValue(context.WithValue(spanCtx, sessionIDKey{}, r.Header.Get("MCP-Session-Id")), callTimingKey{}, timing)
+	callCtx = context.WithValue(callCtx, idempotencyKey{}, r.Header.Get("Idempotency-Key"))
+	if isOneWay(req.Payload) {
+		if err := server.Send(callCtx, req.Payload); err != nil {
+			g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(g.serverIDAttr(req.ServerID), attribute.String("status", "error")))
+			server.log().Log(spanCtx, "error", "gateway_request_failed", map[string]any{"server_id": req.ServerID, "error": err.Error(), "request_id": requestID})
+			status, code := classifyCallError(err)
+			writeSpanError(span, w, status, GatewayError{ErrorCode: code, Message: err.Error(), ServerID: req.ServerID, RequestID: rawID})
+			return
+		}
+		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(g.serverIDAttr(req.ServerID), attribute.String("status", "accepted")))
+		span.SetStatus(codes.Ok, "")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	responsePayload, err := g.callWithFailover(callCtx, server, req.Payload, requestID)
+	// net/http cancels the request context when the client hangs up, which
+	// already ended the call; there is nobody left to answer.
+	disconnected := err != nil && ctx.Err() != nil
+	statusLabel := "success"
+	switch {
+	case disconnected:
+		statusLabel = "client_disconnected"
+	case err != nil:
+		statusLabel = "error"
+	}
+	g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(g.serverIDAttr(req.ServerID), attribute.String("status", statusLabel)))
+	g.metrics.latency.Record(spanCtx, time.Since(start).Milliseconds(), metric.WithAttributes(g.serverIDAttr(req.ServerID)))
+	server.observeLatency(spanCtx, time.Since(start))
+
+	if disconnected {
+		server.log().Log(spanCtx, "warn", "gateway_client_disconnected", map[string]any{"server_id": req.ServerID, "request_id": requestID})
+		recordSpanError(span, GatewayError{ErrorCode: "client_disconnected", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		server.log().Log(spanCtx, "error", "gateway_request_failed", map[string]any{"server_id": req.ServerID, "error": err.Error(), "request_id": requestID})
+		status, code := classifyCallError(err)
+		gatewayErr := GatewayError{ErrorCode: code, Message: err.Error(), ServerID: req.ServerID, RequestID: rawID, Detail: g.errorDetail(server, code)}
+		if payload, ok := g.jsonrpcError(gatewayErr); ok {
+			recordSpanError(span, gatewayErr)
+			g.writeJSON(spanCtx, w, http.StatusOK, GatewayResponse{ServerID: req.ServerID, Payload: payload})
+			return
+		}
+		writeSpanError(span, w, status, gatewayErr)
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	server.log().Log(spanCtx, "info", "gateway_request_ok", map[string]any{"server_id": req.ServerID, "request_id": requestID})
+	g.setServerTiming(w, timing, time.Since(start))
+	setStaleHeaders(w, timing)
+	g.writeJSON(spanCtx, w, http.StatusOK, GatewayResponse{ServerID: req.ServerID, Payload: responsePayload})
+}
+
+func (g *Gateway) handleRPCDirect(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" && g.cfg.LandingPage != "off" {
+		g.handleLandingPage(w, r)
+		return
+	}
+	// The query never reaches the path, and a trailing slash is the same
+	// route; anything but a single segment before /rpc is not a server.
+	serverID, ok := strings.CutSuffix(strings.TrimRight(r.URL.Path, "/"), "/rpc")
+	serverID = strings.TrimPrefix(serverID, "/")
+	if !ok || strings.Contains(serverID, "/") {
+		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "not_found", Message: "unknown endpoint"})
+		return
+	}
+	if serverID == "" {
+		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "missing server_id"})
+		return
+	}
+	if r.Method == http.MethodOptions {
+		writeAllow(w, http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		g.handleSessionDelete(w, r, serverID)
+		return
+	}
+
+	ctx := r.Context()
+	start := time.Now()
+
+	if r.Method == http.MethodGet {
+		g.handleRPCStream(ctx, w, r, serverID)
+		return
+	}
+
+	body, spilled, err := readRequestBody(r.Body, g.cfg.SpillThresholdBytes)
+	if err != nil {
+		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "invalid body"})
+		return
+	}
+	// Spilled bodies are past the threshold, so only a buffered one can be empty.
+	if spilled == nil && len(bytes.TrimSpace(body)) == 0 {
+		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "body is empty", ServerID: serverID})
+		return
+	}
+	if spilled != nil {
+		defer spilled.Close()
+		body = spilled.head
+	}
+	if g.missingSession(r, body) {
+		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "session_required", Message: "missing MCP-Session-Id header", ServerID: serverID, RequestID: rawRequestID(body)})
+		return
+	}
+	if spilled == nil && isBatch(body) {
+		g.handleBatch(w, r, serverID, body, g.wantsEnvelope(r, serverID))
+		return
+	}
+
+	rawID := rawRequestID(body)
+	requestID := g.requestID(w, r, body)
+	spanCtx, span := g.tracer.Start(ctx, "mcp_gateway.request",
+		trace.WithAttributes(
+			attribute.String("server_id", serverID),
+			attribute.String("request_id", requestID),
+		),
+	)
+	defer span.End()
+	annotateRequest(spanCtx, serverID, body, requestID)
+
+	server, ok := g.server(serverID)
+	if !ok {
+		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("status", "not_found")))
+		g.logger.Log(spanCtx, "warn", "gateway_server_not_found", map[string]any{"server_id": serverID})
+		writeSpanError(span, w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: serverID, RequestID: rawID})
+		return
+	}
+
+	timing := &callTiming{}
+	callCtx := context.WithValue(context.WithValue(spanCtx, sessionIDKey{}, r.Header.Get("MCP-Session-Id")), callTimingKey{}, timing)
+	callCtx = context.WithValue(callCtx, idempotencyKey{}, r.Header.Get("Idempotency-Key"))
+	if isOneWay(body) {
+		if spilled != nil {
+			err = server.SendSpilled(callCtx, spilled)
+		} else {
+			err = server.Send(callCtx, body)
+		}
+		if err != nil {
+			g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(g.serverIDAttr(serverID), attribute.String("status", "error")))
+			server.log().Log(spanCtx, "error", "gateway_request_failed", map[string]any{"server_id": serverID, "error": err.Error(), "request_id": requestID})
+			status, code := classifyCallError(err)
+			writeSpanError(span, w, status, GatewayError{ErrorCode: code, Message: err.Error(), ServerID: serverID, RequestID: rawID})
+			return
+		}
+		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(g.serverIDAttr(serverID), attribute.String("status", "accepted")))
+		span.SetStatus(codes.Ok, "")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// A client accepting an event stream gets one once the server streams
+	// messages ahead of its response; until then the answer stays plain JSON.
+	var stream *eventStream
+	if g.cfg.StreamableHTTP && !isInitializeRequest(body) && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		stream = &eventStream{w: w}
+		callCtx = context.WithValue(callCtx, eventStreamKey{}, stream)
+	}
+
+	var responsePayload json.RawMessage
+	if spilled != nil {
+		responsePayload, err = server.CallSpilled(callCtx, spilled, requestID)
+	} else {
+		responsePayload, err = g.callWithFailover(callCtx, server, body, requestID)
+	}
+	streamed := stream != nil && stream.finish()
+	// net/http cancels the request context when the client hangs up, which
+	// already ended the call; there is nobody left to answer.
+	disconnected := err != nil && ctx.Err() != nil
+	statusLabel := "success"
+	switch {
+	case disconnected:
+		statusLabel = "client_disconnected"
+	case err != nil:
+		statusLabel = "error"
+	}
+	g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(g.serverIDAttr(serverID), attribute.String("status", statusLabel)))
+	g.metrics.latency.Record(spanCtx, time.Since(start).Milliseconds(), metric.WithAttributes(g.serverIDAttr(serverID)))
+	server.observeLatency(spanCtx, time.Since(start))
+
+	if disconnected {
+		server.log().Log(spanCtx, "warn", "gateway_client_disconnected", map[string]any{"server_id": serverID, "request_id": requestID})
+		recordSpanError(span, GatewayError{ErrorCode: "client_disconnected", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		server.log().Log(spanCtx, "error", "gateway_request_failed", map[string]any{"server_id": serverID, "error": err.Error(), "request_id": requestID})
+		status, code := classifyCallError(err)
+		gatewayErr := GatewayError{ErrorCode: code, Message: err.Error(), ServerID: serverID, RequestID: rawID, Detail: g.errorDetail(server, code)}
+		if streamed {
+			// The status line is already sent, so the failure can only be
+			// the stream's final message.
+			recordSpanError(span, gatewayErr)
+			rpcCode, ok := transportErrorCode(code)
+			if !ok {
+				rpcCode = -32603
+			}
+			payload, _ := jsonrpcErrorPayload(rpcCode, gatewayErr)
+			writeSSEMessage(w, payload)
+			return
+		}
+		if payload, ok := g.jsonrpcError(gatewayErr); ok {
+			recordSpanError(span, gatewayErr)
+			if g.wantsEnvelope(r, serverID) {
+				g.writeJSON(spanCtx, w, http.StatusOK, GatewayResponse{ServerID: serverID, Payload: payload})
+				return
+			}
+			g.writeRawJSON(spanCtx, w, http.StatusOK, payload)
+			return
+		}
+		writeSpanError(span, w, status, gatewayErr)
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	server.log().Log(spanCtx, "info", "gateway_request_ok", map[string]any{"server_id": serverID, "request_id": requestID})
+	if streamed {
+		writeSSEMessage(w, responsePayload)
+		return
+	}
+	g.setServerTiming(w, timing, time.Since(start))
+	setStaleHeaders(w, timing)
+	if isInitializeRequest(body) {
+		if sessionID := server.ensureSessionID(); sessionID != "" {
+			w.Header().Set("MCP-Session-Id", sessionID)
+		}
+	}
+	if g.wantsEnvelope(r, serverID) {
+		g.writeJSON(spanCtx, w, http.StatusOK, GatewayResponse{ServerID: serverID, Payload: responsePayload})
+		return
+	}
+	g.writeRawJSON(spanCtx, w, http.StatusOK, responsePayload)
+}
+
+func (g *Gateway) missingSession(r *http.Request, body []byte) bool {
+	// Streamable HTTP clients carry the session from initialize on every
+	// later request.
+	return g.cfg.StreamableHTTP && r.Header.Get("MCP-Session-Id") == "" && !isInitializeRequest(body)
+}
+
+func (g *Gateway) handleSessionDelete(w http.ResponseWriter, r *http.Request, serverID string) {
+	server, ok := g.server(serverID)
+	if !ok {
+		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: serverID})
+		return
+	}
+	sessionID := r.Header.Get("MCP-Session-Id")
+	if sessionID == "" {
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "session_required", Message: "missing MCP-Session-Id header", ServerID: serverID})
+		return
+	}
+	if !server.endSession(r.Context(), sessionID) {
+		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "session_not_found", Message: errUnknownSession.Error(), ServerID: serverID})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) wantsEnvelope(r *http.Request, serverID string) bool {
+	// The query parameter overrides the server default either way.
+	if raw := r.URL.Query().Get("envelope"); raw != "" {
+		envelope, err := strconv.ParseBool(raw)
+		return err == nil && envelope
+	}
+	server, ok := g.server(serverID)
+	return ok && server.config().ResponseEnvelope
+}
+
+func (g *Gateway) handleBatch(w http.ResponseWriter, r *http.Request, serverID string, body []byte, wrap bool) {
+	ctx := r.Context()
+	start := time.Now()
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(body, &elements); err != nil || len(elements) == 0 {
+		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("status", "invalid")))
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "invalid_request", Message: "batch must be a non-empty JSON array"})
+		return
+	}
+
+	spanCtx, span := g.tracer.Start(ctx, "mcp_gateway.batch",
+		trace.WithAttributes(
+			attribute.String("server_id", serverID),
+			attribute.Int("batch_size", len(elements)),
+		),
+	)
+	defer span.End()
+
+	// Oversized batches are refused before any element reaches the server.
+	if g.cfg.MaxBatchSize > 0 && len(elements) > g.cfg.MaxBatchSize {
+		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(g.serverIDAttr(serverID), attribute.String("status", "batch_too_large")))
+		writeSpanError(span, w, http.StatusRequestEntityTooLarge, GatewayError{
+			ErrorCode: "batch_too_large",
+			Message:   fmt.Sprintf("batch of %d requests exceeds max_batch_size %d", len(elements), g.cfg.MaxBatchSize),
+			ServerID:  serverID,
+		})
+		return
+	}
+
+	server, ok := g.server(serverID)
+	if !ok {
+		g.metrics.requests.Add(spanCtx, 1, metric.WithAttributes(attribute.String("status", "not_found")))
+		g.logger.Log(spanCtx, "warn", "gateway_server_not_found", map[string]any{"server_id": serverID})
+		writeSpanError(span, w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: serverID})
+		return
+	}
+
+	callCtx := context.WithValue(spanCtx, sessionIDKey{}, r.Header.Get("MCP-Session-Id"))
+	responses := g.callBatch(callCtx, server, elements)
+	g.metrics.latency.Record(spanCtx, time.Since(start).Milliseconds(), metric.WithAttributes(g.serverIDAttr(serverID)))
+	if ctx.Err() != nil {
+		server.log().Log(spanCtx, "warn", "gateway_client_disconnected", map[string]any{"server_id": serverID, "batch_size": len(elements)})
+		recordSpanError(span, GatewayError{ErrorCode: "client_disconnected", Message: ctx.Err().Error()})
+		return
+	}
+
+	span.SetStatus(codes.Ok, "")
+	server.log().Log(spanCtx, "info", "gateway_batch_ok", map[string]any{"server_id": serverID, "batch_size": len(elements), "responses": len(responses)})
+	// A batch of only notifications and responses has nothing to answer.
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	payload, err := json.Marshal(responses)
+	if err != nil {
+		writeSpanError(span, w, http.StatusInternalServerError, GatewayError{ErrorCode: "internal_error", Message: err.Error(), ServerID: serverID})
+		return
+	}
+	if wrap {
+		g.writeJSON(spanCtx, w, http.StatusOK, GatewayResponse{ServerID: serverID, Payload: payload})
+		return
+	}
+	g.writeRawJSON(spanCtx, w, http.StatusOK, payload)
+}
+
+func (g *Gateway) callBatch(ctx context.Context, server *ManagedServer, elements []json.RawMessage) []json.RawMessage {
+	results := make([]json.RawMessage, len(elements))
+	// Elements are dispatched batch_concurrency at a time so one large batch
+	// cannot flood the server's queue.
+	limit := g.cfg.BatchConcurrency
+	if limit <= 0 {
+		limit = len(elements)
+	}
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, element := range elements {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = g.callBatchElement(ctx, server, element)
+		}()
+	}
+	wg.Wait()
+
+	responses := make([]json.RawMessage, 0, len(results))
+	for _, result := range results {
+		if result != nil {
+			responses = append(responses, result)
+		}
+	}
+	return responses
+}
+
+func (g *Gateway) callBatchElement(ctx context.Context, server *ManagedServer, element json.RawMessage) json.RawMessage {
+	serverID := server.config().ServerID
+	method, hasID := parseMethodAndID(element)
+	if method == "" && !isResponse(element) {
+		g.metrics.requests.Add(ctx, 1, metric.WithAttributes(g.serverIDAttr(serverID), attribute.String("status", "invalid")))
+		payload, _ := jsonrpcErrorPayload(-32600, GatewayError{ErrorCode: "invalid_request", Message: "invalid request", ServerID: serverID, RequestID: rawRequestID(element)})
+		return payload
+	}
+
+	requestID := extractRequestID(element)
+	// A response to one of the server's own requests is relayed like a
+	// notification: nothing answers it.
+	call := method != "" && hasID
+	var response json.RawMessage
+	var err error
+	if call {
+		response, err = g.callWithFailover(ctx, server, element, requestID)
+	} else {
+		err = server.Send(ctx, element)
+	}
+	statusLabel := "success"
+	switch {
+	case err != nil:
+		statusLabel = "error"
+	case !call:
+		statusLabel = "accepted"
+	}
+	g.metrics.requests.Add(ctx, 1, metric.WithAttributes(g.serverIDAttr(serverID), attribute.String("status", statusLabel)))
+	if err == nil {
+		return response
+	}
+
+	server.log().Log(ctx, "error", "gateway_request_failed", map[string]any{"server_id": serverID, "error": err.Error(), "request_id": requestID})
+	if !call {
+		return nil
+	}
+	// Every call in a batch needs an answer, so failures that would be HTTP
+	// errors on their own become JSON-RPC errors here.
+	_, errorCode := classifyCallError(err)
+	code, ok := transportErrorCode(errorCode)
+	if !ok {
+		code = -32603
+	}
+	payload, _ := jsonrpcErrorPayload(code, GatewayError{ErrorCode: errorCode, Message: err.Error(), ServerID: serverID, RequestID: rawRequestID(element)})
+	return payload
+}
+
+func (g *Gateway) requestID(w http.ResponseWriter, r *http.Request, payload []byte) string {
+	// The JSON-RPC id wins; the header and trace context cover
+	// notifications and clients that correlate outside the body.
+	requestID := extractRequestID(payload)
+	if requestID == "" && g.cfg.RequestIDHeader != "" {
+		requestID = r.Header.Get(g.cfg.RequestIDHeader)
+	}
+	if requestID == "" && g.cfg.RequestIDFromTrace {
+		incoming := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(r.Header)))
+		if incoming.HasTraceID() {
+			requestID = incoming.TraceID().String()
+		}
+	}
+	if requestID != "" && g.cfg.RequestIDHeader != "" {
+		w.Header().Set(g.cfg.RequestIDHeader, requestID)
+	}
+	return requestID
+}
+
+func (g *Gateway) handleLandingPage(w http.ResponseWriter, r *http.Request) {
+	endpoints := []map[string]string{
+		{"method": "GET", "path": "/health", "description": "Gateway and server health"},
+		{"method": "GET", "path": "/servers", "description": "Server registry and status"},
+		{"method": "POST", "path": "/rpc", "description": "Wrapped JSON-RPC request with server_id and payload"},
+		{"method": "POST", "path": "/{server_id}/rpc", "description": "Direct JSON-RPC request"},
+		{"method": "GET", "path": "/{server_id}/rpc", "description": "Server-sent event stream"},
+	}
+
+	format := g.cfg.LandingPage
+	if format == "auto" {
+		format = "json"
+		if accept := r.Header.Get("Accept"); strings.Contains(accept, "text/html") && !strings.Contains(accept, "application/json") {
+			format = "html"
+		}
+	}
+
+	if format != "html" {
+		g.writeJSON(r.Context(), w, http.StatusOK, map[string]any{
+			"service":   serviceName,
+			"version":   serviceVersion,
+			"endpoints": endpoints,
+		})
+		return
+	}
+
+	var page strings.Builder
+	page.WriteString("<!DOCTYPE html>\n<html><head><title>")
+	page.WriteString(html.EscapeString(serviceName))
+	page.WriteString("</title></head><body>\n<h1>")
+	page.WriteString(html.EscapeString(serviceName))
+	page.WriteString("</h1>\n<p>Version ")
+	page.WriteString(html.EscapeString(serviceVersion))
+	page.WriteString("</p>\n<ul>\n")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(&page, "<li><code>%s %s</code> &mdash; %s</li>\n",
+			html.EscapeString(endpoint["method"]), html.EscapeString(endpoint["path"]), html.EscapeString(endpoint["description"]))
+	}
+	page.WriteString("</ul>\n</body></html>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(page.String()))
+}
+
+func (g *Gateway) handleRPCStream(ctx context.Context, w http.ResponseWriter, r *http.Request, serverID string) {
+	server, ok := g.server(serverID)
+	if !ok {
+		writeError(w, http.StatusNotFound, GatewayError{ErrorCode: "server_not_found", Message: "unknown server_id", ServerID: serverID})
+		return
+	}
+	sessionID := r.Header.Get("MCP-Session-Id")
+	if g.missingSession(r, nil) {
+		writeError(w, http.StatusBadRequest, GatewayError{ErrorCode: "session_required", Message: "missing MCP-Session-Id header", ServerID: serverID})
+		return
+	}
+	if err := server.checkSession(context.WithValue(ctx, sessionIDKey{}, sessionID), nil); err != nil {
+		status, code := classifyCallError(err)
+		writeError(w, status, GatewayError{ErrorCode: code, Message: err.Error(), ServerID: serverID})
+		return
+	}
+
+	if !g.trackStream() {
+		writeError(w, http.StatusServiceUnavailable, GatewayError{ErrorCode: "gateway_shutting_down", Message: errShuttingDown.Error(), ServerID: serverID})
+		return
+	}
+	defer g.streams.Done()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Streamable HTTP binds the stream to the session from initialize;
+	// otherwise the stream itself starts one.
+	if !g.cfg.StreamableHTTP {
+		sessionID = server.ensureSessionID()
+	}
+	if sessionID != "" {
+		w.Header().Set("MCP-Session-Id", sessionID)
+	}
+	subscriber := server.subscribe(sessionID)
+	defer server.unsubscribe(sessionID, subscriber)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, GatewayError{ErrorCode: "streaming_not_supported", Message: "response does not support streaming"})
+		return
+	}
+
+	// Initial comment to establish stream
+	_, _ = w.Write([]byte(": ok\n\n"))
+	flusher.Flush()
+
+	ticker := time.NewTicker(25 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-subscriber.closed:
+			return
+		case message := <-subscriber.messages:
+			writeSSEMessage(w, message.payload)
+			if message.written != nil {
+				close(message.written)
+			}
+		case <-g.draining.Done():
+			// Streams never end on their own, so they would hold up
+			// listener shutdown until the drain ran out.
+			_, _ = w.Write([]byte("event: shutdown\ndata: {}\n\n"))
+			flusher.Flush()
+			return
+		case <-ticker.C:
+			_, _ = w.Write([]byte(": keep-alive\n\n"))
+			flusher.Flush()
+		}
+	}
+}
+
+func (g *Gateway) writeJSON(ctx context.Context, w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		g.logger.Log(ctx, "error", "gateway_write_failed", map[string]any{"error": err.Error()})
+	}
+}
+
+func writeSSEMessage(w http.ResponseWriter, message json.RawMessage) {
+	var event bytes.Buffer
+	event.WriteString("event: message\n")
+	for _, line := range bytes.Split(bytes.TrimSpace(message), []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(line)
+		event.WriteByte('\n')
+	}
+	event.WriteByte('\n')
+	_, _ = w.Write(event.Bytes())
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func setStaleHeaders(w http.ResponseWriter, timing *callTiming) {
+	if timing.stale <= 0 {
+		return
+	}
+	w.Header().Set("Age", strconv.Itoa(int(timing.stale.Seconds())))
+	w.Header().Set("MCP-Gateway-Stale", "true")
+}
+
+func (g *Gateway) setServerTiming(w http.ResponseWriter, timing *callTiming, total time.Duration) {
+	if !g.cfg.ServerTiming {
+		return
+	}
+	w.Header().Set("Server-Timing", fmt.Sprintf("queue;dur=%.3f, server;dur=%.3f, total;dur=%.3f",
+		float64(timing.queue)/float64(time.Millisecond),
+		float64(timing.server)/float64(time.Millisecond),
+		float64(total)/float64(time.Millisecond)))
+}
+
+func (g *Gateway) writeRawJSON(ctx context.Context, w http.ResponseWriter, status int, payload json.RawMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	if g.cfg.CompactResponses {
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, payload); err == nil {
+			payload = compacted.Bytes()
+		}
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(payload); err != nil {
+		g.logger.Log(ctx, "error", "gateway_write_failed", map[string]any{"error": err.Error()})
+	}
+}
+
+func (e *eventStream) send(message json.RawMessage) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Calls detached from the request may outlive the handler; once it is
+	// done with the stream their messages are dropped.
+	if e.done {
+		return
+	}
+	if !e.started {
+		e.w.Header().Set("Content-Type", "text/event-stream")
+		e.w.Header().Set("Cache-Control", "no-cache")
+		e.w.WriteHeader(http.StatusOK)
+		e.started = true
+	}
+	writeSSEMessage(e.w, message)
+}
+
+func (e *eventStream) finish() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.done = true
+	return e.started
+}
+
+func (g *Gateway) collectServerStatuses() []map[string]any {
+	servers := g.serverList()
+	statuses := make([]map[string]any, 0, len(servers))
+	for _, server := range servers {
+		statuses = append(statuses, server.Status())
+	}
+	return statuses
+}
+
+func (g *Gateway) shutdown(ctx context.Context, listeners []*http.Server) {
+	start := time.Now()
+	g.beginDrain()
+	drainCtx, cancel := context.WithTimeout(ctx, time.Duration(g.cfg.ShutdownDrainMS)*time.Millisecond)
+	defer cancel()
+	if err := g.drainStreams(drainCtx); err != nil {
+		g.logger.Log(ctx, "warn", "gateway_stream_drain_failed", map[string]any{"error": err.Error()})
+	}
+	// Shutdown stops accepting at once and returns when every request in
+	// flight has been answered.
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener *http.Server) {
+			defer wg.Done()
+			if err := listener.Shutdown(drainCtx); err != nil {
+				g.logger.Log(ctx, "warn", "gateway_shutdown_failed", map[string]any{"addr": listener.Addr, "error": err.Error()})
+			}
+		}(listener)
+	}
+	wg.Wait()
+
+	// Calls still running after the drain are cancelled, and exited servers
+	// are no longer restarted.
+	g.beginShutdown()
+	for _, server := range g.serverList() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Stop(ctx); err != nil {
+				g.logger.Log(ctx, "warn", "mcp_server_stop_failed", map[string]any{"server_id": server.config().ServerID, "error": err.Error()})
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Flushed last so the spans and metrics of the drained calls go out.
+	if err := errors.Join(g.shutdownTrace(ctx), g.shutdownMet(ctx)); err != nil {
+		g.logger.Log(ctx, "warn", "gateway_telemetry_flush_failed", map[string]any{"error": err.Error()})
+	}
+	g.logger.Log(ctx, "info", "gateway_stopped", map[string]any{"duration_ms": time.Since(start).Milliseconds()})
+}
+
+func (g *Gateway) beginDrain() {
+	// Holding streamsMu orders this against trackStream, so no stream is
+	// added once drainStreams may be waiting.
+	g.streamsMu.Lock()
+	defer g.streamsMu.Unlock()
+	g.startDraining()
+}
+
+func (g *Gateway) beginShutdown() {
+	// Ending the lifetime also starts the drain, so it is ordered the same way.
+	g.streamsMu.Lock()
+	defer g.streamsMu.Unlock()
+	g.endLifetime(errShuttingDown)
+}
+
+func (l *loadShedder) enter(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight++
+	if !l.active && l.inFlight > l.high {
+		l.active = true
+		l.logger.Log(ctx, "warn", "gateway_shedding_started", map[string]any{"in_flight": l.inFlight, "high_water": l.high, "protected_priority": l.protected})
+	}
+}
+
+func (l *loadShedder) leave(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if l.active && l.inFlight <= l.low {
+		l.active = false
+		l.logger.Log(ctx, "info", "gateway_shedding_stopped", map[string]any{"in_flight": l.inFlight, "low_water": l.low})
+	}
+}
+
+func (m *memoryGuard) watch(ctx context.Context) {
+	ticker := time.NewTicker(memorySampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.observe(ctx, processRSS())
+		}
+	}
+}
+
+func (m *memoryGuard) observe(ctx context.Context, rss uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rss = rss
+	switch {
+	case !m.pressured && rss > m.high:
+		m.pressured = true
+		m.logger.Log(ctx, "warn", "gateway_memory_pressure_started", map[string]any{"rss_bytes": rss, "high_watermark_bytes": m.high})
+	case m.pressured && rss <= m.high:
+		m.pressured = false
+		m.logger.Log(ctx, "info", "gateway_memory_pressure_stopped", map[string]any{"rss_bytes": rss, "high_watermark_bytes": m.high})
+	}
+}
+
+func (m *memoryGuard) isPressured() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pressured
+}
+
+func (m *memoryGuard) state() map[string]any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return map[string]any{"pressured": m.pressured, "rss_bytes": m.rss, "high_watermark_bytes": m.high}
+}
+
+func processRSS() uint64 {
+	// VmRSS is what the OOM killer goes by; without procfs, the memory the
+	// Go runtime holds from the OS is the closest stand-in.
+	if data, err := os.ReadFile("/proc/self/status"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if value, ok := strings.CutPrefix(line, "VmRSS:"); ok {
+				if kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64); err == nil {
+					return kb << 10
+				}
+			}
+		}
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Sys
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	// Without an explicit burst, a second's worth of requests may arrive at once.
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *loadShedder) rejects(priority int) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Only servers at the highest configured priority keep being served.
+	return l.active && priority < l.protected
+}
+
+func (l *loadShedder) protect(servers []ServerConfig) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.protected = 0
+	for i, server := range servers {
+		if i == 0 || server.Priority > l.protected {
+			l.protected = server.Priority
+		}
+	}
+}
+
+func (l *loadShedder) isActive() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+func (l *loadShedder) state() map[string]any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]any{"active": l.active, "in_flight": l.inFlight, "high_water": l.high, "low_water": l.low}
+}
+
+func (g *Gateway) trackStream() bool {
+	g.streamsMu.Lock()
+	defer g.streamsMu.Unlock()
+	if g.draining.Err() != nil {
+		return false
+	}
+	g.streams.Add(1)
+	return true
+}
+
+func (g *Gateway) drainStreams(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		g.streams.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *Gateway) startAutostartServers(ctx context.Context) error {
+	servers := g.serverList()
+	slices.SortFunc(servers, func(a, b *ManagedServer) int { return strings.Compare(a.config().ServerID, b.config().ServerID) })
+	requiredErrs := g.startServers(ctx, servers)
+	if g.cfg.StartupSelftest {
+		requiredErrs = append(requiredErrs, g.runSelftest(ctx)...)
+	}
+	return errors.Join(requiredErrs...)
+}
+
+func (g *Gateway) startServers(ctx context.Context, servers []*ManagedServer) []error {
+	limit := g.cfg.MaxConcurrentStarts
+	if limit <= 0 {
+		limit = len(servers)
+	}
+	slots := make(chan struct{}, max(limit, 1))
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		if !server.config().Autostart {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Delayed servers wait outside the start slots so they don't
+			// hold up the others.
+			if !server.waitStartupDelay(ctx) {
+				return
+			}
+			// Dependencies are waited for before taking a start slot, which
+			// they may need themselves.
+			if err := g.waitForDependencies(ctx, server); err != nil {
+				if errors.Is(err, errDependencyWait) {
+					errs[i] = fmt.Errorf("required server %s failed to start: %w", server.config().ServerID, err)
+				}
+				return
+			}
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if err := server.Start(ctx); err != nil {
+				// Closed by a later reload; nothing failed.
+				if errors.Is(err, errServerStopped) {
+					return
+				}
+				server.log().Log(ctx, "error", "gateway_server_start_failed", map[string]any{"server_id": server.config().ServerID, "error": err.Error(), "required": server.config().Required})
+				if server.config().Required {
+					errs[i] = fmt.Errorf("required server %s failed to start: %w", server.config().ServerID, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var requiredErrs []error
+	for _, err := range errs {
+		if err != nil {
+			requiredErrs = append(requiredErrs, err)
+		}
+	}
+	return requiredErrs
+}
+
+func (g *Gateway) waitForDependencies(ctx context.Context, server *ManagedServer) error {
+	if len(server.config().DependsOn) == 0 {
+		return nil
+	}
+	start := time.Now()
+	timeout := server.settings.Load().dependencyTimeout
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+	for _, dependencyID := range server.config().DependsOn {
+		for {
+			if dependency, ok := g.server(dependencyID); ok && dependency.currentStatus() == "ready" {
+				break
+			}
+			select {
+			case <-ticker.C:
+				continue
+			case <-deadline.C:
+				// A required server fails like any other required start; the
+				// rest start anyway and may work in a degraded way.
+				action, level := "start_anyway", "warn"
+				if server.config().Required {
+					action, level = "fail", "error"
+				}
+				server.log().Log(ctx, level, "mcp_server_dependency_timeout", map[string]any{"server_id": server.config().ServerID, "dependency": dependencyID, "timeout_ms": timeout.Milliseconds(), "action": action})
+				if server.config().Required {
+					return fmt.Errorf("%w: %s after %v", errDependencyWait, dependencyID, timeout)
+				}
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-server.lifetime.Done():
+				return context.Cause(server.lifetime)
+			}
+		}
+	}
+	server.log().Log(ctx, "info", "mcp_server_dependencies_ready", map[string]any{"server_id": server.config().ServerID, "depends_on": server.config().DependsOn, "waited_ms": time.Since(start).Milliseconds()})
+	return nil
+}
+
+func (s *ManagedServer) waitStartupDelay(ctx context.Context) bool {
+	if s.config().StartupDelayMS <= 0 {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(s.config().StartupDelayMS) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+	case <-s.lifetime.Done():
+	}
+	s.log().Log(ctx, "info", "mcp_server_start_cancelled", map[string]any{"server_id": s.config().ServerID, "reason": "startup_delay interrupted"})
+	return false
+}
+
+func (g *Gateway) runSelftest(ctx context.Context) []error {
+	timeout := time.Duration(g.cfg.SelftestTimeoutMS) * time.Millisecond
+	results := make(map[string]string)
+	level := "info"
+	var requiredErrs []error
+	for _, server := range g.serverList() {
+		if !server.config().Autostart || server.Status()["status"] != "ready" {
+			continue
+		}
+		if err := server.selftest(ctx, timeout); err != nil {
+			results[server.config().ServerID] = err.Error()
+			level = "warn"
+			if server.config().Required {
+				requiredErrs = append(requiredErrs, fmt.Errorf("required server %s failed self-test: %w", server.config().ServerID, err))
+			}
+			continue
+		}
+		results[server.config().ServerID] = "ok"
+	}
+	g.logger.Log(ctx, level, "gateway_selftest", map[string]any{"results": results})
+	return requiredErrs
+}
+
+func (s *ManagedServer) Start(ctx context.Context) error {
+	s.mu.Lock()
+
+	// A reload can close a server while an earlier one is still starting it
+	// in the background; Close ends the lifetime before it looks for a
+	// process, so checking under the lock never leaves one running.
+	if s.lifetime.Err() != nil {
+		s.mu.Unlock()
+		return context.Cause(s.lifetime)
+	}
+	if s.status == "ready" {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.status == "starting" {
+		startDone := s.startDone
+		s.mu.Unlock()
+		return s.waitForStart(ctx, startDone)
+	}
+
+	cmd := exec.Command(s.config().Command, s.config().Args...)
+	if s.config().WorkingDir != "" {
+		cmd.Dir = s.config().WorkingDir
+	}
+	cmd.Env = os.Environ()
+	if s.config().EnvFile != "" {
+		// Read on every start so a restart picks up rotated secrets.
+		fileEnv, err := readEnvFile(s.config().EnvFile)
+		if err != nil {
+			s.setStatusLocked(ctx, "error", "env_file_failed")
+			s.lastError = fmt.Sprintf("start: %v", err)
+			s.mu.Unlock()
+			return err
+		}
+		cmd.Env = append(cmd.Env, fileEnv...)
+	}
+	for key, value := range s.config().Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	s.setStatusLocked(ctx, "starting", "spawn")
+	s.cmd = cmd
+	s.lastActivity = time.Now()
+	var stdoutSource io.Reader = stdout
+	if s.metrics != nil {
+		attrs := metric.WithAttributes(attribute.String("server_id", s.config().ServerID))
+		stdin = &countingWriter{WriteCloser: stdin, add: func(n int) { s.metrics.stdinBytes.Add(s.lifetime, int64(n), attrs) }}
+		stdoutSource = &countingReader{reader: stdout, add: func(n int) { s.metrics.stdoutBytes.Add(s.lifetime, int64(n), attrs) }}
+	}
+	s.stdin = stdin
+	s.stdout = bufio.NewReader(&lineLimitReader{reader: stdoutSource, max: s.maxLineBytes})
+	s.stdoutReplay = nil
+	s.decoder = json.NewDecoder(s.stdout)
+	s.pending = newPendingCalls()
+	s.stderr = stderr
+	s.stderrTail = nil
+	s.probeAttempts = 0
+
+	if err := cmd.Start(); err != nil {
+		s.setStatusLocked(ctx, "error", "spawn_failed")
+		s.lastError = fmt.Sprintf("start: %v", err)
+		s.mu.Unlock()
+		return err
+	}
+
+	startDone := make(chan struct{})
+	s.startDone = startDone
+	defer close(startDone)
+
+	// Background goroutines outlive the request that triggered a lazy start,
+	// so they are bound to the gateway lifetime instead.
+	go s.readStderr(s.lifetime)
+	go s.waitForExit(s.lifetime)
+	if s.config().StdioIdleRecycleMS > 0 {
+		go s.recycleWhenIdle(s.lifetime, cmd)
+	}
+	// A persistent reader also drains messages nobody is waiting for; an
+	// on-demand one is started by the first call or open stream.
+	if s.config().ReaderMode != "on-demand" || len(s.subscribers) > 0 {
+		s.pending.reading = true
+		go s.readLoop(s.lifetime, s.pending)
+	}
+	s.mu.Unlock()
+
+	s.log().Log(ctx, "info", "mcp_server_started", map[string]any{"server_id": s.config().ServerID, "pid": cmd.Process.Pid})
+	s.applyScheduling(ctx, cmd.Process.Pid)
+
+	if s.config().ReadinessProbe || s.config().ReadinessTCP != "" || s.config().ReadinessHTTP != "" {
+		if err := s.probeReadiness(ctx); err != nil {
+			s.failProcess(ctx, cmd, "probe_failed", err)
+			s.log().Log(ctx, "error", "mcp_server_probe_failed", map[string]any{"server_id": s.config().ServerID, "error": err.Error()})
+			return err
+		}
+	}
+	if s.config().StartupHandshake {
+		if err := s.handshake(ctx); err != nil {
+			s.failProcess(ctx, cmd, "handshake_failed", err)
+			s.log().Log(ctx, "error", "mcp_server_handshake_failed", map[string]any{"server_id": s.config().ServerID, "error": err.Error()})
+			return err
+		}
+	}
+	// Clients waiting on startDone are held back until the warmup finishes.
+	s.warmup(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd != cmd || s.status != "starting" {
+		return fmt.Errorf("server %s exited during startup", s.config().ServerID)
+	}
+	s.setStatusLocked(ctx, "ready", "startup_complete")
+	s.lastError = ""
+	if len(s.config().PostStartHook) > 0 {
+		// Registration with outside systems must not hold up traffic.
+		go s.runHook(context.WithoutCancel(ctx), "post_start_hook", s.config().PostStartHook, cmd.Process.Pid)
+	}
+
+	return nil
+}
+
+func (s *ManagedServer) warmup(ctx context.Context) {
+	if len(s.config().Warmup) == 0 {
+		return
+	}
+	start := time.Now()
+	failed := 0
+	for i, raw := range s.config().Warmup {
+		if err := s.warmupOnce(ctx, raw, fmt.Sprintf("gateway-warmup-%d", i+1)); err != nil {
+			failed++
+			s.log().Log(ctx, "warn", "mcp_server_warmup_failed", map[string]any{"server_id": s.config().ServerID, "error": err.Error()})
+		}
+	}
+	s.log().Log(ctx, "info", "mcp_server_warmup_complete", map[string]any{
+		"server_id":   s.config().ServerID,
+		"requests":    len(s.config().Warmup),
+		"failed":      failed,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
+func (s *ManagedServer) warmupOnce(ctx context.Context, raw json.RawMessage, requestID string) error {
+	// Params stay raw so configured numbers are sent exactly as written.
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &request); err != nil {
+		return err
+	}
+	id, err := json.Marshal(requestID)
+	if err != nil {
+		return err
+	}
+	request["jsonrpc"] = json.RawMessage(`"2.0"`)
+	request["id"] = id
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	response, err := s.call(ctx, payload, requestID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", request["method"], err)
+	}
+	if !isSuccessResponse(response) {
+		return fmt.Errorf("%s returned error: %s", request["method"], string(response))
+	}
+	return nil
+}
+
+func (s *ManagedServer) applyScheduling(ctx context.Context, pid int) {
+	if s.config().Nice == nil && s.config().IOPrio == "" {
+		return
+	}
+	// Applied right after spawn; threads or children the server creates
+	// from then on inherit the settings, and setNice covers the threads it
+	// already has.
+	fields := map[string]any{"server_id": s.config().ServerID, "pid": pid}
+	var errs []error
+	if s.config().Nice != nil {
+		if err := setNice(pid, *s.config().Nice); err != nil {
+			errs = append(errs, fmt.Errorf("nice: %w", err))
+		} else {
+			fields["nice"] = *s.config().Nice
+		}
+	}
+	if s.config().IOPrio != "" {
+		class, level, _ := parseIOPrio(s.config().IOPrio)
+		if err := setIOPriority(pid, class, level); err != nil {
+			errs = append(errs, fmt.Errorf("ioprio: %w", err))
+		} else {
+			fields["ioprio"] = s.config().IOPrio
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		fields["error"] = err.Error()
+		s.log().Log(ctx, "warn", "mcp_server_scheduling_failed", fields)
+		return
+	}
+	s.log().Log(ctx, "info", "mcp_server_scheduling_applied", fields)
+}
+
+func (s *ManagedServer) setStatusLocked(ctx context.Context, status, reason string) {
+	if s.status == status {
+		return
+	}
+	from := s.status
+	s.settleRestartsLocked()
+	s.status = status
+	if status == "ready" {
+		s.readySince = time.Now()
+	}
+	s.log().Log(ctx, "info", "mcp_server_transition", map[string]any{
+		"server_id": s.config().ServerID,
+		"from":      from,
+		"to":        status,
+		"reason":    reason,
+	})
+}
+
+func (s *ManagedServer) settleRestartsLocked() {
+	// Once the server has stayed ready for restart_reset_ms an old crash
+	// stops counting against it, and the restart backoff starts over.
+	restartReset := s.settings.Load().restartReset
+	if restartReset <= 0 || s.status != "ready" || s.restartCount == 0 || time.Since(s.readySince) < restartReset {
+		return
+	}
+	s.restartCount = 0
+}
+
+func (s *ManagedServer) Close(ctx context.Context) {
+	s.runPreStopHook(ctx)
+	s.endLifetime(errServerStopped)
+	s.mu.Lock()
+	cmd := s.cmd
+	if cmd != nil {
+		s.exitStatus = "stopped"
+	}
+	s.mu.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+	s.log().Log(ctx, "info", "mcp_server_stopped", map[string]any{"server_id": s.config().ServerID})
+}
+
+func (s *ManagedServer) Stop(ctx context.Context) error {
+	s.runPreStopHook(ctx)
+	s.mu.Lock()
+	cmd := s.cmd
+	if cmd == nil || cmd.Process == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	// Unlike Close, the server can be started again; the exit status keeps
+	// waitForExit from applying the restart policy.
+	s.exitStatus = "stopped"
+	s.exitReason = "stop_requested"
+	s.mu.Unlock()
+
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	forced := !s.waitExited(ctx, pid, stopGracePeriod)
+	if forced {
+		_ = cmd.Process.Kill()
+		if !s.waitExited(ctx, pid, stopGracePeriod) {
+			return fmt.Errorf("server %s did not exit after SIGKILL", s.config().ServerID)
+		}
+	}
+	s.log().Log(ctx, "info", "mcp_server_stopped", map[string]any{"server_id": s.config().ServerID, "pid": pid, "forced": forced})
+	return nil
+}
+
+func (s *ManagedServer) Restart(ctx context.Context) error {
+	if err := s.Stop(ctx); err != nil {
+		return err
+	}
+	return s.Start(ctx)
+}
+
+func (s *ManagedServer) waitExited(ctx context.Context, pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.pid() == pid {
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-time.After(drainPollInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ManagedServer) runPreStopHook(ctx context.Context) {
+	if len(s.config().PreStopHook) == 0 {
+		return
+	}
+	s.mu.Lock()
+	pid := 0
+	if s.cmd != nil && s.cmd.Process != nil && s.status == "ready" {
+		pid = s.cmd.Process.Pid
+	}
+	s.mu.Unlock()
+	if pid != 0 {
+		s.runHook(ctx, "pre_stop_hook", s.config().PreStopHook, pid)
+	}
+}
+
+func (s *ManagedServer) runHook(ctx context.Context, hook string, argv []string, pid int) {
+	hookCtx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(hookCtx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(),
+		"MCP_SERVER_ID="+s.config().ServerID,
+		fmt.Sprintf("MCP_SERVER_PID=%d", pid),
+	)
+	output, err := cmd.CombinedOutput()
+	fields := map[string]any{"server_id": s.config().ServerID, "hook": hook, "pid": pid, "output": strings.TrimSpace(string(output))}
+	if err != nil {
+		fields["error"] = err.Error()
+		s.log().Log(ctx, "warn", "mcp_server_hook_failed", fields)
+		return
+	}
+	s.log().Log(ctx, "info", "mcp_server_hook_ok", fields)
+}
+
+func (s *ManagedServer) failProcess(ctx context.Context, cmd *exec.Cmd, reason string, err error) {
+	s.mu.Lock()
+	current := cmd != nil && s.cmd == cmd
+	if current {
+		s.setStatusLocked(ctx, "error", reason)
+		s.lastError = fmt.Sprintf("%s: %v", reason, err)
+		s.exitStatus = "error"
+	}
+	s.mu.Unlock()
+	if current {
+		_ = cmd.Process.Kill()
+	}
+}
+
+func (s *ManagedServer) selftest(ctx context.Context, timeout time.Duration) error {
+	method := s.config().SelftestMethod
+	if method == "" {
+		method = "ping"
+	}
+	payload, err := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": "gateway-selftest", "method": method})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	cmd := s.cmd
+	s.mu.Unlock()
+
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	response, err := s.Call(callCtx, payload, "gateway-selftest")
+	if err == nil && !isSuccessResponse(response) {
+		err = fmt.Errorf("%s returned error: %s", method, string(response))
+	}
+	if err != nil {
+		s.failProcess(ctx, cmd, "selftest_failed", err)
+		return err
+	}
+	return nil
+}
+
+func (s *ManagedServer) waitForStart(ctx context.Context, startDone chan struct{}) error {
+	select {
+	case <-startDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if status := s.currentStatus(); status != "ready" {
+		return fmt.Errorf("server %s failed to start (status %s)", s.config().ServerID, status)
+	}
+	return nil
+}
+
+func (s *ManagedServer) probeReadiness(ctx context.Context) error {
+	settings := s.settings.Load()
+	expires := time.Now().Add(settings.startupTimeout)
+	deadline := time.NewTimer(settings.startupTimeout)
+	defer deadline.Stop()
+	probeCtx, cancel := context.WithDeadline(ctx, expires)
+	defer cancel()
+
+	interval := settings.probeInterval
+	for attempt := 1; ; attempt++ {
+		s.mu.Lock()
+		s.probeAttempts = attempt
+		s.mu.Unlock()
+
+		err := s.probeNetwork(probeCtx)
+		if err == nil && s.config().ReadinessProbe {
+			_, err = s.probeOnce(ctx, fmt.Sprintf("gateway-probe-%d", attempt), "ping", nil, expires)
+		}
+		if err == nil {
+			s.log().Log(ctx, "info", "mcp_server_probe_ok", map[string]any{"server_id": s.config().ServerID, "attempt": attempt})
+			return nil
+		}
+		s.log().Log(ctx, "warn", "mcp_server_probe_attempt_failed", map[string]any{"server_id": s.config().ServerID, "attempt": attempt, "error": err.Error()})
+		if errors.Is(err, errProbeDeadline) || errors.Is(err, io.EOF) {
+			return fmt.Errorf("readiness probe failed after %d attempts: %w", attempt, err)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-deadline.C:
+			return fmt.Errorf("readiness probe failed after %d attempts: %w", attempt, errProbeDeadline)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		interval *= 2
+		if interval > settings.probeMaxInterval {
+			interval = settings.probeMaxInterval
+		}
+	}
+}
+
+func (s *ManagedServer) probeNetwork(ctx context.Context) error {
+	if s.config().ReadinessTCP != "" {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", s.config().ReadinessTCP)
+		if err != nil {
+			return fmt.Errorf("tcp probe: %w", err)
+		}
+		_ = conn.Close()
+	}
+	if s.config().ReadinessHTTP != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config().ReadinessHTTP, nil)
+		if err != nil {
+			return fmt.Errorf("http probe: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("http probe: %w", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("http probe: status %d", resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+func (s *ManagedServer) probeOnce(ctx context.Context, probeID, method string, params any, deadline time.Time) (json.RawMessage, error) {
+	request := map[string]any{"jsonrpc": "2.0", "id": probeID, "method": method}
+	if params != nil {
+		request["params"] = params
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// The deadline ends the exchange itself, so giving up on a probe has
+	// withdrawn its id by the time probeOnce returns, and a late reply is
+	// dropped as unmatched instead of reaching a later call.
+	probeCtx, cancel := context.WithDeadlineCause(ctx, deadline, errProbeDeadline)
+	defer cancel()
+	raw, err := s.exchange(probeCtx, rawRequestID(payload), func(stdin io.Writer, id json.RawMessage) error {
+		line, err := spliceID(payload, id)
+		if err != nil {
+			return err
+		}
+		return writeAll(stdin, append(line, '\n'))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var message struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &message); err == nil && len(message.Error) > 0 && string(message.Error) != "null" {
+		return nil, fmt.Errorf("%s returned error: %s", method, string(message.Error))
+	}
+	return raw, nil
+}
+
+func (s *ManagedServer) handshake(ctx context.Context) error {
+	deadline := time.Now().Add(s.settings.Load().startupTimeout)
+	params := map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": serviceName, "version": buildVersion()},
+	}
+	response, err := s.probeOnce(ctx, "gateway-handshake", "initialize", params, deadline)
+	if err != nil {
+		return fmt.Errorf("initialize handshake: %w", err)
+	}
+	// Kept like a client's handshake, so cache_initialize replays it and
+	// /capabilities reports it.
+	s.mu.Lock()
+	s.initializeResult = append(json.RawMessage{}, response...)
+	s.mu.Unlock()
+	notification, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "method": "notifications/initialized"})
+	return s.deliver(ctx, serverRequest{payload: notification})
+}
+
+func (s *ManagedServer) Status() map[string]any {
+	s.mu.Lock()
+	pid := 0
+	if s.cmd != nil && s.cmd.Process != nil {
+		pid = s.cmd.Process.Pid
+	}
+	s.settleRestartsLocked()
+
+	status := map[string]any{
+		"server_id":         s.config().ServerID,
+		"status":            s.status,
+		"pid":               pid,
+		"restart_count":     s.restartCount,
+		"restart_total":     s.restartTotal,
+		"last_exit_code":    s.lastExitCode,
+		"last_exit_at":      formatTime(s.lastExitAt),
+		"probe_attempts":    s.probeAttempts,
+		"last_error":        s.lastError,
+		"paused":            s.paused,
+		"session_id":        s.sessionID,
+		"autostart":         s.config().Autostart,
+		"restart_policy":    s.config().RestartPolicy,
+		"command":           s.config().Command,
+		"working_directory": s.config().WorkingDir,
+	}
+	replacement, draining := s.replacement, s.draining
+	s.mu.Unlock()
+
+	// The other process is locked on its own; holding both would order the
+	// locks differently depending on which side is asked.
+	if replacement != nil {
+		status["replacement_pid"] = replacement.pid()
+	}
+	if draining != nil {
+		status["draining_pid"] = draining.pid()
+	}
+	return status
+}
+
+func (s *ManagedServer) pid() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == nil || s.cmd.Process == nil {
+		return 0
+	}
+	return s.cmd.Process.Pid
+}
+
+func (s *ManagedServer) drain(ctx context.Context, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		idle := s.activeCalls == 0
+		s.mu.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-time.After(drainPollInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (s *ManagedServer) Call(ctx context.Context, payload []byte, requestID string) (json.RawMessage, error) {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	replay, claim, err := s.claimIdempotent(ctx, key, payload, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if replay != nil {
+		return replaceResponseID(replay, rawRequestID(payload))
+	}
+	// Later calls with the key wait on the claim, so it is released however
+	// this call ends; only a response from the server is kept.
+	var answered json.RawMessage
+	defer func() { s.finishIdempotent(claim, answered) }()
+
+	if err := s.admit(ctx, payload); err != nil {
+		return s.staleOnOutage(ctx, payload, err)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("timeout_ms", s.timeoutFor(payload).Milliseconds()))
+	response, err := s.route(ctx, payload, requestID)
+	if err != nil {
+		response, err = s.staleOnOutage(ctx, payload, err)
+	} else {
+		answered = response
+	}
+	s.record(ctx, payload, response, err)
+	return response, err
+}
+
+// claimIdempotent replays the response to an earlier call with the same
+// key, or claims the key for this call when there is none. A call finding
+// the key in flight waits for it; if that call fails, which is not
+// remembered, the waiter goes on to make its own.
+func (s *ManagedServer) claimIdempotent(ctx context.Context, key string, payload []byte, requestID string) (json.RawMessage, *idempotentCall, error) {
+	window := s.settings.Load().idempotencyWindow
+	if key == "" || window <= 0 {
+		return nil, nil, nil
+	}
+	// A retry carries the same request under a new id, so the id is left
+	// out of the comparison.
+	fingerprint := string(payload)
+	if withoutID, err := spliceID(payload, nil); err == nil {
+		fingerprint = string(withoutID)
+	}
+	for {
+		s.idempotencyMu.Lock()
+		entry := s.idempotent[key]
+		if entry == nil || entry.expired(window) {
+			entry = &idempotentCall{key: key, fingerprint: fingerprint, done: make(chan struct{})}
+			s.addIdempotent(entry, window)
+			s.idempotencyMu.Unlock()
+			return nil, entry, nil
+		}
+		s.idempotencyMu.Unlock()
+		if entry.fingerprint != fingerprint {
+			return nil, nil, fmt.Errorf("%w: server %s (key %q)", errIdempotencyReuse, s.config().ServerID, key)
+		}
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if entry.response != nil {
+			s.log().Log(ctx, "info", "mcp_idempotent_replay", map[string]any{"server_id": s.config().ServerID, "request_id": requestID, "age_ms": time.Since(entry.answeredAt).Milliseconds()})
+			return entry.response, nil, nil
+		}
+	}
+}
+
+// addIdempotent stores a claimed key; the caller holds idempotencyMu.
+func (s *ManagedServer) addIdempotent(entry *idempotentCall, window time.Duration) {
+	if s.idempotent == nil {
+		s.idempotent = make(map[string]*idempotentCall)
+	}
+	if _, ok := s.idempotent[entry.key]; ok {
+		s.idempotentOrder = slices.DeleteFunc(s.idempotentOrder, func(key string) bool { return key == entry.key })
+	}
+	// Keys are stored in the order they were claimed, so expired ones are
+	// at the front and the oldest key is the first evicted once the cache is
+	// full. An evicted call still in flight answers those waiting on it.
+	limit := defaultInt(s.config().IdempotencyMaxKeys, defaultIdempotencyMaxKeys)
+	for len(s.idempotentOrder) > 0 {
+		oldest := s.idempotentOrder[0]
+		if len(s.idempotentOrder) < limit && !s.idempotent[oldest].expired(window) {
+			break
+		}
+		delete(s.idempotent, oldest)
+		s.idempotentOrder = s.idempotentOrder[1:]
+	}
+	s.idempotent[entry.key] = entry
+	s.idempotentOrder = append(s.idempotentOrder, entry.key)
+}
+
+// finishIdempotent keeps a claimed call's response for the window, or
+// forgets the key when there is none, and wakes the calls waiting on it.
+func (s *ManagedServer) finishIdempotent(entry *idempotentCall, response json.RawMessage) {
+	if entry == nil {
+		return
+	}
+	s.idempotencyMu.Lock()
+	if response != nil {
+		entry.response = append(json.RawMessage{}, response...)
+		entry.answeredAt = time.Now()
+	} else if s.idempotent[entry.key] == entry {
+		delete(s.idempotent, entry.key)
+		s.idempotentOrder = slices.DeleteFunc(s.idempotentOrder, func(key string) bool { return key == entry.key })
+	}
+	s.idempotencyMu.Unlock()
+	close(entry.done)
+}
+
+func (s *ManagedServer) staleOnOutage(ctx context.Context, payload []byte, callErr error) (json.RawMessage, error) {
+	// As with failover, a server that is still ready failed this call on its
+	// own, and that answer is passed on as is.
+	settings := s.settings.Load()
+	if settings.maxStaleOnOutage <= 0 || ctx.Err() != nil || s.currentStatus() == "ready" {
+		return nil, callErr
+	}
+	method, key, ok := readKey(payload)
+	if !ok || method == "ping" {
+		return nil, callErr
+	}
+	s.cacheMu.Lock()
+	entry := s.cache[key]
+	s.cacheMu.Unlock()
+	if entry == nil {
+		return nil, callErr
+	}
+	age := time.Since(entry.fetchedAt)
+	if age >= settings.cacheTTL+settings.maxStaleOnOutage {
+		return nil, callErr
+	}
+	s.log().Log(ctx, "warn", "mcp_cache_served_on_outage", map[string]any{"server_id": s.config().ServerID, "method": method, "age_ms": age.Milliseconds(), "error": callErr.Error()})
+	if timing, ok := ctx.Value(callTimingKey{}).(*callTiming); ok {
+		timing.stale = age
+	}
+	return replaceResponseID(entry.response, rawRequestID(payload))
+}
+
+func (s *ManagedServer) route(ctx context.Context, payload []byte, requestID string) (json.RawMessage, error) {
+	if isInitializeRequest(payload) {
+		return s.callInitialize(ctx, payload, requestID)
+	}
+	if method, key, ok := readKey(payload); ok {
+		var response json.RawMessage
+		var err error
+		// Caching ping would defeat its use as a liveness check.
+		if s.settings.Load().cacheTTL > 0 && method != "ping" {
+			response, err = s.callCached(ctx, key, payload, requestID)
+		} else {
+			response, err = s.callRead(ctx, key, payload, requestID)
+		}
+		if err == nil && method == "tools/list" {
+			s.rememberTools(payload, response)
+		}
+		return response, err
+	}
+	return s.call(ctx, payload, requestID)
+}
+
+func (s *ManagedServer) CallSpilled(ctx context.Context, body *spilledBody, requestID string) (json.RawMessage, error) {
+	if err := s.admit(ctx, body.head); err != nil {
+		return nil, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("timeout_ms", s.timeoutFor(body.head).Milliseconds()))
+	response, err := s.dispatch(ctx, serverRequest{payload: body.head, source: body.file, requestID: requestID})
+	// Spilled params are never loaded into memory, so only the envelope is recorded.
+	s.record(ctx, body.head, response, err)
+	return response, err
+}
+
+func (s *ManagedServer) record(ctx context.Context, request, response json.RawMessage, callErr error) {
+	if s.recorder == nil {
+		return
+	}
+	if err := s.recorder.Record(s.config().ServerID, request, response, callErr); err != nil {
+		s.log().Log(ctx, "warn", "gateway_record_failed", map[string]any{"server_id": s.config().ServerID, "error": err.Error()})
+	}
+}
+
+func (s *ManagedServer) callRead(ctx context.Context, key string, payload []byte, requestID string) (json.RawMessage, error) {
+	if s.config().CoalesceReads {
+		return s.callCoalesced(ctx, key, payload, requestID)
+	}
+	return s.call(ctx, payload, requestID)
+}
+
+func (s *ManagedServer) callCached(ctx context.Context, key string, payload []byte, requestID string) (json.RawMessage, error) {
+	var cached json.RawMessage
+	settings := s.settings.Load()
+	s.cacheMu.Lock()
+	if entry := s.cache[key]; entry != nil {
+		age := time.Since(entry.fetchedAt)
+		switch {
+		case age < settings.cacheTTL:
+			cached = entry.response
+		case settings.cfg.StaleWhileRevalidate && age < settings.cacheTTL+settings.maxStale:
+			cached = entry.response
+			if !entry.refreshing {
+				entry.refreshing = true
+				// The refresh outlives the request, so it must not share the
+				// request's context values, such as its call timing; like any
+				// call it reaches the server under an id of the gateway's.
+				go s.refreshCached(s.lifetime, key, payload, requestID)
+			}
+		}
+	}
+	s.cacheMu.Unlock()
+	if cached != nil {
+		return replaceResponseID(cached, rawRequestID(payload))
+	}
+
+	response, err := s.callRead(ctx, key, payload, requestID)
+	if err == nil {
+		s.cacheMu.Lock()
+		s.storeCachedLocked(key, response)
+		s.cacheMu.Unlock()
+	}
+	return response, err
+}
+
+func (s *ManagedServer) refreshCached(ctx context.Context, key string, payload []byte, requestID string) {
+	response, err := s.callRead(ctx, key, payload, requestID)
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if entry := s.cache[key]; entry != nil {
+		entry.refreshing = false
+	}
+	if err != nil {
+		s.log().Log(ctx, "warn", "mcp_cache_refresh_failed", map[string]any{"server_id": s.config().ServerID, "error": err.Error()})
+		return
+	}
+	s.storeCachedLocked(key, response)
+}
+
+func (s *ManagedServer) storeCachedLocked(key string, response json.RawMessage) {
+	if !isSuccessResponse(response) {
+		return
+	}
+	if s.cache == nil {
+		s.cache = make(map[string]*cachedResponse)
+	}
+	// Entries are kept in arrival order and the oldest is evicted first once
+	// the cache is full.
+	if _, ok := s.cache[key]; !ok {
+		for len(s.cacheOrder) >= defaultInt(s.config().CacheMaxEntries, defaultCacheMaxEntries) {
+			delete(s.cache, s.cacheOrder[0])
+			s.cacheOrder = s.cacheOrder[1:]
+		}
+		s.cacheOrder = append(s.cacheOrder, key)
+	}
+	s.cache[key] = &cachedResponse{response: append(json.RawMessage{}, response...), fetchedAt: time.Now()}
+}
+
+func (s *ManagedServer) callCoalesced(ctx context.Context, key string, payload []byte, requestID string) (json.RawMessage, error) {
+	s.coalesceMu.Lock()
+	flight, shared := s.inflight[key]
+	if !shared {
+		flight = &inflightCall{done: make(chan struct{})}
+		if s.inflight == nil {
+			s.inflight = make(map[string]*inflightCall)
+		}
+		s.inflight[key] = flight
+		// The shared round-trip must not die with whichever caller happened
+		// to arrive first; dispatch still bounds it by request_timeout_ms.
+		go func() {
+			flight.response, flight.err = s.call(context.WithoutCancel(ctx), payload, requestID)
+			s.coalesceMu.Lock()
+			delete(s.inflight, key)
+			s.coalesceMu.Unlock()
+			close(flight.done)
+		}()
+	}
+	s.coalesceMu.Unlock()
+
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if flight.err != nil {
+		return nil, flight.err
+	}
+	if !shared {
+		return flight.response, nil
+	}
+	return replaceResponseID(flight.response, rawRequestID(payload))
+}
+
+func (s *ManagedServer) callInitialize(ctx context.Context, payload []byte, requestID string) (json.RawMessage, error) {
+	if err := s.beginInitialize(ctx); err != nil {
+		return nil, err
+	}
+	response, err := s.callInitializeSerialized(ctx, payload, requestID)
+	s.finishInitialize(ctx, err == nil && isSuccessResponse(response))
+	return response, err
+}
+
+func (s *ManagedServer) callInitializeSerialized(ctx context.Context, payload []byte, requestID string) (json.RawMessage, error) {
+	select {
+	case s.initSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-s.initSem }()
+
+	if s.config().CacheInitialize {
+		s.mu.Lock()
+		cached := s.initializeResult
+		s.mu.Unlock()
+		if cached != nil {
+			return replaceResponseID(cached, rawRequestID(payload))
+		}
+	}
+
+	response, err := s.call(ctx, payload, requestID)
 	if err != nil {
+		return nil, err
+	}
+	// The handshake is kept for /capabilities even when it is not replayed.
+	if isSuccessResponse(response) {
+		s.mu.Lock()
+		s.initializeResult = append(json.RawMessage{}, response...)
+		s.mu.Unlock()
+	}
+	return response, nil
+}
+
+func (s *ManagedServer) rememberTools(payload []byte, response json.RawMessage) {
+	var request struct {
+		Params struct {
+			Cursor string `json:"cursor"`
+		} `json:"params"`
+	}
+	var reply struct {
+		Result struct {
+			Tools json.RawMessage `json:"tools"`
+		} `json:"result"`
+	}
+	// Only a first page is a usable listing on its own.
+	if json.Unmarshal(payload, &request) != nil || request.Params.Cursor != "" {
+		return
+	}
+	if json.Unmarshal(response, &reply) != nil || reply.Result.Tools == nil {
+		return
+	}
+	s.mu.Lock()
+	s.toolList = append(json.RawMessage{}, reply.Result.Tools...)
+	s.mu.Unlock()
+}
+
+func (s *ManagedServer) providesTool(name string) bool {
+	s.mu.Lock()
+	status := s.status
+	toolList := s.toolList
+	s.mu.Unlock()
+	if status != "ready" {
+		return false
+	}
+	var tools []struct {
+		Name string `json:"name"`
+	}
+	if json.Unmarshal(toolList, &tools) != nil {
+		return false
+	}
+	for _, tool := range tools {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ManagedServer) capabilities(includeTools bool) map[string]any {
+	s.mu.Lock()
+	status := s.status
+	initializeResult := s.initializeResult
+	toolList := s.toolList
+	s.mu.Unlock()
+	if status != "ready" {
+		return nil
+	}
+
+	document := map[string]any{}
+	var handshake struct {
+		Result struct {
+			ProtocolVersion string          `json:"protocolVersion"`
+			Capabilities    json.RawMessage `json:"capabilities"`
+			ServerInfo      json.RawMessage `json:"serverInfo"`
+		} `json:"result"`
+	}
+	if initializeResult != nil && json.Unmarshal(initializeResult, &handshake) == nil {
+		document["protocol_version"] = handshake.Result.ProtocolVersion
+		document["capabilities"] = handshake.Result.Capabilities
+		document["server_info"] = handshake.Result.ServerInfo
+	}
+	if includeTools && toolList != nil {
+		document["tools"] = toolList
+	}
+	return document
+}
+
+func (s *ManagedServer) checkSession(ctx context.Context, payload []byte) error {
+	clientSession, _ := ctx.Value(sessionIDKey{}).(string)
+	if !s.strictSessions || clientSession == "" || isInitializeRequest(payload) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Sessions end when the process exits, so a restart expires every
+	// session id issued before it and clients must initialize again.
+	if !s.sessionInitialized || clientSession != s.sessionID {
+		return fmt.Errorf("%w: server %s", errUnknownSession, s.config().ServerID)
+	}
+	return nil
+}
+
+func (s *ManagedServer) beginInitialize(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config().InitializeConflict == "reject" {
+		clientSession, _ := ctx.Value(sessionIDKey{}).(string)
+		if s.initInFlight {
+			return fmt.Errorf("%w: another initialize is in progress", errSessionConflict)
+		}
+		if s.sessionInitialized && clientSession != s.sessionID {
+			return fmt.Errorf("%w: server %s already has an active session", errSessionConflict, s.config().ServerID)
+		}
+	}
+	s.initInFlight = true
+	return nil
+}
+
+func (s *ManagedServer) finishInitialize(ctx context.Context, success bool) {
+	s.mu.Lock()
+	s.initInFlight = false
+	if !success {
+		s.mu.Unlock()
+		return
+	}
+	rotated := s.config().InitializeConflict == "rotate" && s.sessionInitialized
+	if rotated || s.sessionID == "" {
+		s.sessionID = randomSessionID()
+	}
+	s.sessionInitialized = true
+	s.mu.Unlock()
+
+	if rotated {
+		s.log().Log(ctx, "info", "mcp_session_rotated", map[string]any{"server_id": s.config().ServerID})
+	}
+}
+
+func (s *ManagedServer) endSession(ctx context.Context, sessionID string) bool {
+	s.mu.Lock()
+	if !s.sessionInitialized || sessionID != s.sessionID {
+		s.mu.Unlock()
+		return false
+	}
+	// The next initialize issues a fresh id and reaches the server again
+	// instead of replaying the ended session's handshake.
+	s.sessionID = ""
+	s.sessionInitialized = false
+	s.initializeResult = nil
+	s.toolList = nil
+	for subscriber := range s.subscribers[sessionID] {
+		close(subscriber.closed)
+	}
+	delete(s.subscribers, sessionID)
+	s.mu.Unlock()
+
+	s.log().Log(ctx, "info", "mcp_session_terminated", map[string]any{"server_id": s.config().ServerID})
+	if s.config().SessionEndMethod != "" {
+		notification, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "method": s.config().SessionEndMethod})
+		if err := s.Send(ctx, notification); err != nil {
+			s.log().Log(ctx, "warn", "mcp_session_end_notify_failed", map[string]any{"server_id": s.config().ServerID, "error": err.Error()})
+		}
+	}
+	return true
+}
+
+func (s *ManagedServer) subscribe(sessionID string) *streamSubscriber {
+	s.mu.Lock()
+	subscriber := &streamSubscriber{closed: make(chan struct{}), done: make(chan struct{}), messages: make(chan streamMessage, streamBufferMessages)}
+	if s.subscribers == nil {
+		s.subscribers = make(map[string]map[*streamSubscriber]struct{})
+	}
+	if s.subscribers[sessionID] == nil {
+		s.subscribers[sessionID] = make(map[*streamSubscriber]struct{})
+	}
+	s.subscribers[sessionID][subscriber] = struct{}{}
+	pending := s.pending
+	s.mu.Unlock()
+	// Server messages only reach streams through a reader, so an on-demand
+	// server keeps one running for as long as a stream is open.
+	if pending != nil && pending.startReading() {
+		go s.readLoop(s.lifetime, pending)
+	}
+	return subscriber
+}
+
+func (s *ManagedServer) broadcast(ctx context.Context, message json.RawMessage) {
+	if s.config().OrderedDelivery {
+		s.broadcastOrdered(ctx, message)
+		return
+	}
+	s.mu.Lock()
+	dropped := 0
+	for subscriber := range s.subscribers[s.sessionID] {
+		// A slow client must not hold up the reader, and with it every call.
+		select {
+		case subscriber.messages <- streamMessage{payload: message}:
+		default:
+			dropped++
+		}
+	}
+	s.mu.Unlock()
+	if dropped > 0 {
+		s.log().Log(ctx, "warn", "mcp_stream_message_dropped", map[string]any{"server_id": s.config().ServerID, "streams": dropped})
+	}
+}
+
+func (s *ManagedServer) broadcastOrdered(ctx context.Context, message json.RawMessage) {
+	s.mu.Lock()
+	subscribers := make([]*streamSubscriber, 0, len(s.subscribers[s.sessionID]))
+	for subscriber := range s.subscribers[s.sessionID] {
+		subscribers = append(subscribers, subscriber)
+	}
+	s.mu.Unlock()
+	// The reader is the session's single queue: it waits for every stream to
+	// write the message before reading on, so no response is handed to its
+	// call ahead of a message the server sent before it.
+	for _, subscriber := range subscribers {
+		written := make(chan struct{})
+		select {
+		case subscriber.messages <- streamMessage{payload: message, written: written}:
+		case <-subscriber.closed:
+			continue
+		case <-subscriber.done:
+			continue
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-written:
+		case <-subscriber.closed:
+		case <-subscriber.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *ManagedServer) unsubscribe(sessionID string, subscriber *streamSubscriber) {
+	close(subscriber.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers[sessionID], subscriber)
+	if len(s.subscribers[sessionID]) == 0 {
+		delete(s.subscribers, sessionID)
+	}
+}
+
+func (s *ManagedServer) call(ctx context.Context, payload []byte, requestID string) (json.RawMessage, error) {
+	return s.dispatch(ctx, serverRequest{payload: payload, requestID: requestID})
+}
+
+func (s *ManagedServer) dispatch(ctx context.Context, request serverRequest) (json.RawMessage, error) {
+	// Waiting calls pile up while a server stalls; past the cap they fail
+	// fast instead.
+	s.mu.Lock()
+	slots := s.settings.Load().pendingSlots
+	s.mu.Unlock()
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			return nil, fmt.Errorf("%w: server %s (max_pending_requests %d)", errServerBusy, s.config().ServerID, cap(slots))
+		}
+	}
+	if s.config().Transport == "http" {
+		start := time.Now()
+		callCtx, cancel := s.requestContext(s.lifetime, ctx, s.timeoutFor(request.payload))
+		defer cancel()
+		response, err := s.postHTTP(callCtx, request.body(), rawRequestID(request.payload))
+		if timing, ok := ctx.Value(callTimingKey{}).(*callTiming); ok {
+			timing.server = time.Since(start)
+		}
+		if err == nil && response == nil {
+			err = fmt.Errorf("server %s accepted a request without responding", s.config().ServerID)
+		}
+		return response, err
+	}
+
+	line := request.payload
+	if request.source == nil {
+		if len(line) == 0 {
+			return nil, errors.New("empty payload")
+		}
+		if line[len(line)-1] != '\n' {
+			line = append(append([]byte{}, line...), '\n')
+		}
+	}
+	// Only a request the server has seen is worth cancelling, and under the
+	// id it was sent with.
+	var sentID json.RawMessage
+	write := func(stdin io.Writer, id json.RawMessage) error {
+		sentID = id
+		if request.source != nil {
+			return copyLineWithID(stdin, request.source, id)
+		}
+		line, err := spliceID(line, id)
+		if err != nil {
+			return err
+		}
+		return writeAll(stdin, line)
+	}
+
+	callCtx, cancel := s.requestContext(s.lifetime, ctx, s.timeoutFor(request.payload))
+	defer cancel()
+	s.beginActivity()
+	defer s.endActivity()
+	response, err := s.exchange(callCtx, rawRequestID(request.payload), write)
+	if err != nil && sentID != nil && ctx.Err() != nil {
+		s.notifyCancelled(sentID, "client disconnected")
+	}
+	return response, err
+}
+
+func (s *ManagedServer) Send(ctx context.Context, payload []byte) error {
+	return s.send(ctx, serverRequest{payload: payload})
+}
+
+func (s *ManagedServer) SendSpilled(ctx context.Context, body *spilledBody) error {
+	return s.send(ctx, serverRequest{payload: body.head, source: body.file})
+}
+
+func (s *ManagedServer) send(ctx context.Context, request serverRequest) error {
+	if err := s.admit(ctx, request.payload); err != nil {
 		return err
 	}
+	err := s.deliver(ctx, request)
+	s.record(ctx, request.payload, nil, err)
+	return err
+}
 
-	s.status = "starting"
-	s.cmd = cmd
-	s.stdin = stdin
-	s.stdout = bufio.NewReader(stdout)
-	s.decoder = json.NewDecoder(s.stdout)
-	s.stderr = stderr
+func (s *ManagedServer) deliver(ctx context.Context, request serverRequest) error {
+	if s.config().Transport == "http" {
+		sendCtx, cancel := s.requestContext(s.lifetime, ctx, s.timeoutFor(request.payload))
+		defer cancel()
+		_, err := s.postHTTP(sendCtx, request.body(), nil)
+		return err
+	}
 
-	if err := cmd.Start(); err != nil {
-		s.status = "error"
+	s.mu.Lock()
+	stdin := s.stdin
+	s.mu.Unlock()
+
+	if stdin == nil {
+		return fmt.Errorf("server %s is not ready", s.config().ServerID)
+	}
+	s.beginActivity()
+	defer s.endActivity()
+	if err := s.acquireWrite(ctx); err != nil {
+		return err
+	}
+	defer s.releaseWrite()
+	if request.source != nil {
+		return s.checkStdin(ctx, stdin, copyLine(stdin, request.source))
+	}
+
+	payload := request.payload
+	line := append([]byte{}, payload...)
+	if len(line) == 0 {
+		return errors.New("empty payload")
+	}
+	if line[len(line)-1] != '\n' {
+		line = append(line, '\n')
+	}
+
+	return s.checkStdin(ctx, stdin, writeAll(stdin, line))
+}
+
+func (s *ManagedServer) checkStdin(ctx context.Context, stdin io.Writer, err error) error {
+	if !errors.Is(err, syscall.EPIPE) && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	// A child that closed its stdin but kept running never exits on its own,
+	// so every later write would fail; kill it and let the restart policy
+	// bring up a fresh process.
+	s.mu.Lock()
+	cmd := s.cmd
+	current := cmd != nil && s.stdin == stdin && s.exitReason == ""
+	if current {
+		s.exitReason = "stdin_closed"
+		s.lastError = fmt.Sprintf("stdin_closed: %v", err)
+	}
+	s.mu.Unlock()
+	if current {
+		s.log().Log(ctx, "warn", "mcp_server_stdin_closed", map[string]any{"server_id": s.config().ServerID, "pid": cmd.Process.Pid})
+		_ = cmd.Process.Kill()
+	}
+	return fmt.Errorf("%w: server %s: %v", errStdinClosed, s.config().ServerID, err)
+}
+
+func (s *ManagedServer) admit(ctx context.Context, payload []byte) error {
+	if s.shedder.rejects(s.config().Priority) {
+		return fmt.Errorf("%w: server %s (priority %d)", errOverloaded, s.config().ServerID, s.config().Priority)
+	}
+	s.mu.Lock()
+	rateLimiter := s.settings.Load().rateLimiter
+	s.mu.Unlock()
+	if !rateLimiter.allow() {
+		return fmt.Errorf("%w: server %s (rate_limit_rps %g)", errRateLimited, s.config().ServerID, s.config().RateLimitRPS)
+	}
+	if err := s.checkSession(ctx, payload); err != nil {
+		return err
+	}
+	if err := s.waitIfPaused(ctx); err != nil {
+		return err
+	}
+	return s.ensureRunning(ctx)
+}
+
+func (s *ManagedServer) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused {
+		return
+	}
+	s.paused = true
+	s.resumeCh = make(chan struct{})
+}
+
+func (s *ManagedServer) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return
+	}
+	s.paused = false
+	close(s.resumeCh)
+	s.resumeCh = nil
+}
+
+func (s *ManagedServer) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+func (s *ManagedServer) waitIfPaused(ctx context.Context) error {
+	s.mu.Lock()
+	paused := s.paused
+	resumeCh := s.resumeCh
+	s.mu.Unlock()
+
+	if !paused {
+		return nil
+	}
+	if s.config().PausePolicy != "queue" {
+		return errServerPaused
+	}
+
+	select {
+	case <-resumeCh:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", errServerPaused, ctx.Err())
+	}
+}
+
+func (s *ManagedServer) currentStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *ManagedServer) ensureRunning(ctx context.Context) error {
+	status := s.currentStatus()
+	if status == "ready" {
+		return nil
+	}
+
+	if !s.config().Autostart && status != "starting" {
+		return fmt.Errorf("%w: server %s has 1 instance (%s)", errNoHealthy, s.config().ServerID, status)
+	}
+	if s.maxStartWait <= 0 {
+		return s.Start(ctx)
+	}
+
+	// The start runs detached, so a caller that stops waiting leaves it
+	// going for the next one.
+	started := make(chan error, 1)
+	go func() { started <- s.Start(context.WithoutCancel(ctx)) }()
+	timer := time.NewTimer(s.maxStartWait)
+	defer timer.Stop()
+	select {
+	case err := <-started:
 		return err
+	case <-timer.C:
+		return fmt.Errorf("%w: server %s not ready within max_start_wait_ms", errServerStarting, s.config().ServerID)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *ManagedServer) observeLatency(ctx context.Context, latency time.Duration) {
+	if s.config().LatencySLOMS <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if len(s.latencies) < sloWindowSize {
+		s.latencies = append(s.latencies, latency)
+	} else {
+		s.latencies[s.latencyNext] = latency
+		s.latencyNext = (s.latencyNext + 1) % sloWindowSize
+	}
+	if len(s.latencies) < sloMinSamples || time.Since(s.lastSLOAlert) < sloAlertCooldown {
+		s.mu.Unlock()
+		return
+	}
+	window := slices.Clone(s.latencies)
+	slices.Sort(window)
+	p95 := window[(len(window)*95+99)/100-1]
+	slo := time.Duration(s.config().LatencySLOMS) * time.Millisecond
+	if p95 <= slo {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSLOAlert = time.Now()
+	s.mu.Unlock()
+
+	s.log().Log(ctx, "warn", "server_slo_breached", map[string]any{
+		"server_id":      s.config().ServerID,
+		"p95_ms":         p95.Milliseconds(),
+		"latency_slo_ms": s.config().LatencySLOMS,
+		"samples":        len(window),
+	})
+}
+
+func (s *ManagedServer) ensureSessionID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessionID == "" {
+		s.sessionID = randomSessionID()
 	}
+	return s.sessionID
+}
 
-	s.status = "ready"
-	go s.readStderr(ctx)
-	go s.waitForExit(ctx)
-	s.workerOnce.Do(func() {
-		go s.worker(ctx)
+func (s *ManagedServer) notifyCancelled(id json.RawMessage, reason string) {
+	notification, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"method":  "notifications/cancelled",
+		"params":  map[string]any{"requestId": id, "reason": reason},
 	})
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	stdin := s.stdin
+	s.mu.Unlock()
+	if stdin == nil || s.acquireWrite(s.lifetime) != nil {
+		return
+	}
+	defer s.releaseWrite()
+	_ = writeAll(stdin, append(notification, '\n'))
+}
+
+func (s *ManagedServer) acquireWrite(ctx context.Context) error {
+	// Calls write concurrently, so whole lines are written one at a time.
+	select {
+	case s.writeSem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (s *ManagedServer) releaseWrite() {
+	<-s.writeSem
+}
+
+func (s *ManagedServer) timeoutFor(payload []byte) time.Duration {
+	if len(s.config().MethodTimeoutsMS) == 0 {
+		return s.requestTimeout
+	}
+	method, _ := parseMethodAndID(payload)
+	if timeoutMS, ok := s.config().MethodTimeoutsMS[method]; ok {
+		return time.Duration(timeoutMS) * time.Millisecond
+	}
+	return s.requestTimeout
+}
+
+func (s *ManagedServer) requestContext(lifetime, ctx context.Context, timeout time.Duration) (context.Context, func()) {
+	reqCtx, cancelReq := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(lifetime, func() { cancelReq(context.Cause(lifetime)) })
+	callCtx, cancel := context.WithTimeoutCause(reqCtx, timeout, errRequestTimeout)
+	return callCtx, func() {
+		cancel()
+		stop()
+		cancelReq(nil)
+	}
+}
+
+func (s *ManagedServer) postHTTP(ctx context.Context, payload io.Reader, requestID json.RawMessage) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config().BaseURL, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	s.mu.Lock()
+	upstreamSession := s.upstreamSession
+	s.mu.Unlock()
+	if upstreamSession != "" {
+		req.Header.Set("Mcp-Session-Id", upstreamSession)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if sessionID := resp.Header.Get("Mcp-Session-Id"); sessionID != "" {
+		s.mu.Lock()
+		s.upstreamSession = sessionID
+		s.mu.Unlock()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("server %s returned HTTP %d", s.config().ServerID, resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		return nil, nil
+	}
+
+	body := &lineLimitReader{reader: resp.Body, max: s.maxLineBytes}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		var forward func(json.RawMessage)
+		if stream, ok := ctx.Value(eventStreamKey{}).(*eventStream); ok {
+			forward = stream.send
+		}
+		return readSSEResponse(body, requestID, forward)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if !isJSONMessage(data) {
+		return nil, fmt.Errorf("server %s returned a non-JSON body", s.config().ServerID)
+	}
+	return data, nil
+}
+
+func (s *ManagedServer) exchange(ctx context.Context, id json.RawMessage, write func(io.Writer, json.RawMessage) error) (json.RawMessage, error) {
+	s.mu.Lock()
+	stdin := s.stdin
+	pending := s.pending
+	s.mu.Unlock()
+
+	if stdin == nil || pending == nil {
+		return nil, fmt.Errorf("server %s is not ready", s.config().ServerID)
+	}
+
+	// The id is registered before the request is written so the reader can
+	// never see the response first.
+	start := time.Now()
+	call, key, startReader, err := pending.register()
+	if err != nil {
+		return nil, err
+	}
+	defer pending.remove(key)
+	if startReader {
+		go s.readLoop(s.lifetime, pending)
+	}
+	if err := s.acquireWrite(ctx); err != nil {
+		return nil, err
+	}
+	sent := time.Now()
+	err = write(stdin, json.RawMessage(key))
+	s.releaseWrite()
+	if err != nil {
+		return nil, s.checkStdin(ctx, stdin, err)
+	}
+
+	var firstByteTimer <-chan time.Time
+	if s.firstByteTimeout > 0 {
+		timer := time.NewTimer(s.firstByteTimeout)
+		defer timer.Stop()
+		firstByteTimer = timer.C
+	}
+
+	for {
+		select {
+		case resp := <-call.response:
+			if timing, ok := ctx.Value(callTimingKey{}).(*callTiming); ok {
+				timing.queue = sent.Sub(start)
+				timing.server = time.Since(sent)
+			}
+			if resp.err != nil {
+				return nil, resp.err
+			}
+			// The caller's id is put back in place of the gateway's, leaving
+			// the rest of the response as the server wrote it.
+			return spliceID(resp.payload, id)
+		case <-firstByteTimer:
+			// Output is shared by every call in flight, so any output since
+			// the write counts as the server having started on this one.
+			if pending.outputSince(sent) {
+				firstByteTimer = nil
+				continue
+			}
+			return nil, errFirstByteTimeout
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
 
-	s.logger.Log(ctx, "info", "mcp_server_started", map[string]any{"server_id": s.cfg.ServerID, "pid": cmd.Process.Pid})
+func (s *ManagedServer) readLoop(ctx context.Context, pending *pendingCalls) {
+	for {
+		s.mu.Lock()
+		decoder := s.decoder
+		stdout := s.stdout
+		replaying := s.stdoutReplay != nil && s.stdoutReplay.Len() > 0
+		s.mu.Unlock()
+		if decoder != nil && stdout != nil && !replaying && !hasBufferedMessage(decoder) {
+			_, _ = stdout.Peek(1)
+		}
+		pending.markOutput()
 
-	return nil
+		raw, err := s.readMessage(ctx, pending)
+		if err != nil {
+			pending.fail(err)
+			return
+		}
+		// Notifications and requests from the server have no caller to go
+		// to, so they are relayed to the session's event streams instead.
+		if id, ok := responseID(raw); ok {
+			if !pending.resolve(pendingKey(id), raw) {
+				s.log().Log(ctx, "warn", "mcp_server_unmatched_response", map[string]any{"server_id": s.config().ServerID, "id": id})
+			}
+		} else if method, _ := parseMethodAndID(raw); method != "" {
+			s.broadcast(ctx, raw)
+		}
+		if pending.stopIfIdle(s.releaseDecoder) {
+			return
+		}
+	}
 }
 
-func (s *ManagedServer) Status() map[string]any {
+func (s *ManagedServer) releaseDecoder() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	pid := 0
-	if s.cmd != nil && s.cmd.Process != nil {
-		pid = s.cmd.Process.Pid
-	}
-
-	return map[string]any{
-		"server_id":         s.cfg.ServerID,
-		"status":            s.status,
-		"pid":               pid,
-		"restart_count":     s.restartCount,
-		"last_exit_code":    s.lastExitCode,
-		"last_exit_at":      formatTime(s.lastExitAt),
-		"session_id":        s.sessionID,
-		"autostart":         s.cfg.Autostart,
-		"restart_policy":    s.cfg.RestartPolicy,
-		"command":           s.cfg.Command,
-		"working_directory": s.cfg.WorkingDir,
+	// A decoder's buffer grows to the largest response it has read. On-demand
+	// servers drop it, along with their reader, once no call or stream is
+	// waiting and pay for a fresh one on the next, unless the server already
+	// sent more.
+	if s.config().ReaderMode != "on-demand" || len(s.subscribers) > 0 || s.decoder == nil || hasBufferedMessage(s.decoder) || (s.stdoutReplay != nil && s.stdoutReplay.Len() > 0) {
+		return false
 	}
+	s.stdoutReplay = nil
+	s.decoder = json.NewDecoder(s.stdout)
+	return true
 }
 
-func (s *ManagedServer) Call(ctx context.Context, payload []byte, requestID string) (json.RawMessage, error) {
-	if err := s.ensureRunning(ctx); err != nil {
-		return nil, err
-	}
-
-	respCh := make(chan serverResponse, 1)
-	request := serverRequest{ctx: ctx, payload: payload, requestID: requestID, response: respCh}
+func (s *ManagedServer) readMessage(ctx context.Context, pending *pendingCalls) (json.RawMessage, error) {
+	for {
+		s.mu.Lock()
+		decoder := s.decoder
+		stdout := s.stdout
+		current := s.pending == pending
+		s.mu.Unlock()
+		if decoder == nil || !current {
+			return nil, fmt.Errorf("server %s is not ready", s.config().ServerID)
+		}
 
-	select {
-	case s.requests <- request:
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == nil && isJSONMessage(raw) {
+			return raw, nil
+		}
+		if errors.Is(err, errLineTooLong) {
+			s.killOversizedOutput(ctx)
+			return nil, err
+		}
+		var syntaxErr *json.SyntaxError
+		if err != nil && !errors.As(err, &syntaxErr) {
+			return nil, err
+		}
 
-	select {
-	case resp := <-respCh:
-		return resp.payload, resp.err
-	case <-ctx.Done():
-		return nil, ctx.Err()
+		reason := "unexpected non-message value"
+		if err != nil {
+			reason = err.Error()
+		}
+		if s.metrics != nil {
+			s.metrics.decodeErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("server_id", s.config().ServerID)))
+		}
+		s.log().Log(ctx, "warn", "mcp_server_decode_error", map[string]any{"server_id": s.config().ServerID, "error": reason})
+		s.resyncDecoder(decoder, stdout)
 	}
 }
 
-func (s *ManagedServer) Send(ctx context.Context, payload []byte) error {
-	if err := s.ensureRunning(ctx); err != nil {
-		return err
+func (s *ManagedServer) killOversizedOutput(ctx context.Context) {
+	s.mu.Lock()
+	cmd := s.cmd
+	s.lastError = errLineTooLong.Error()
+	s.mu.Unlock()
+	s.log().Log(ctx, "error", "mcp_server_line_too_long", map[string]any{"server_id": s.config().ServerID, "max_line_bytes": s.maxLineBytes})
+	// The stream cannot be resynchronized without buffering the oversized
+	// line, so the process is killed and its restart policy applies.
+	if cmd != nil && cmd.Process != nil {
+		_ = cmd.Process.Kill()
 	}
+}
 
+func (s *ManagedServer) resyncDecoder(decoder *json.Decoder, stdout *bufio.Reader) {
+	// A json.Decoder cannot continue past a syntax error, so drop the rest of
+	// the offending line and resume decoding at the next one. Whatever the
+	// old decoder had already read is replayed ahead of stdout rather than
+	// wrapping it, so repeated resyncs never stack readers.
+	unread, _ := io.ReadAll(decoder.Buffered())
 	s.mu.Lock()
-	stdin := s.stdin
+	if s.decoder != decoder {
+		s.mu.Unlock()
+		return
+	}
+	if s.stdoutReplay != nil {
+		replay, _ := io.ReadAll(s.stdoutReplay)
+		unread = append(unread, replay...)
+	}
 	s.mu.Unlock()
 
-	if stdin == nil {
-		return fmt.Errorf("server %s is not ready", s.cfg.ServerID)
+	if _, rest, found := bytes.Cut(unread, []byte("\n")); found {
+		unread = rest
+	} else {
+		unread = nil
+		for stdout != nil {
+			if _, err := stdout.ReadSlice('\n'); !errors.Is(err, bufio.ErrBufferFull) {
+				break
+			}
+		}
 	}
 
-	line := append([]byte{}, payload...)
-	if len(line) == 0 {
-		return errors.New("empty payload")
-	}
-	if line[len(line)-1] != '\n' {
-		line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.decoder == decoder {
+		s.stdoutReplay = bytes.NewReader(unread)
+		s.decoder = json.NewDecoder(io.MultiReader(s.stdoutReplay, stdout))
 	}
-
-	return writeAll(stdin, line)
 }
 
-func (s *ManagedServer) ensureRunning(ctx context.Context) error {
-	s.mu.Lock()
-	status := s.status
-	s.mu.Unlock()
+func isJSONMessage(raw json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(raw)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
 
-	if status == "ready" {
-		return nil
+func readSSEResponse(body io.Reader, requestID json.RawMessage, forward func(json.RawMessage)) (json.RawMessage, error) {
+	reader := bufio.NewReader(body)
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimPrefix(value, []byte(" ")))
+		} else if len(line) == 0 && data.Len() > 0 {
+			// Upstreams may interleave requests and notifications before the
+			// response, so only a message carrying our id ends the stream.
+			if id := rawRequestID(data.Bytes()); id != nil && bytes.Equal(id, requestID) {
+				return append(json.RawMessage{}, data.Bytes()...), nil
+			}
+			// The rest is relayed when the client is streaming too.
+			if forward != nil && isJSONMessage(data.Bytes()) {
+				forward(append(json.RawMessage{}, data.Bytes()...))
+			}
+			data.Reset()
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("event stream ended without a response")
+			}
+			return nil, err
+		}
 	}
+}
 
-	if !s.cfg.Autostart {
-		return fmt.Errorf("server %s is not running", s.cfg.ServerID)
+func hasBufferedMessage(decoder *json.Decoder) bool {
+	buffered, err := io.ReadAll(decoder.Buffered())
+	if err != nil {
+		return false
 	}
+	return len(bytes.TrimSpace(buffered)) > 0
+}
 
-	return s.Start(ctx)
+func newPendingCalls() *pendingCalls {
+	return &pendingCalls{waiters: make(map[string]*pendingCall)}
 }
 
-func (s *ManagedServer) ensureSessionID() string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.sessionID == "" {
-		s.sessionID = randomSessionID()
+func (p *pendingCalls) register() (*pendingCall, string, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return nil, "", false, p.err
 	}
-	return s.sessionID
+	// Clients pick their own ids and may reuse one the server still owes a
+	// late answer for, so every call goes out under an id of the gateway's.
+	p.lastID++
+	key := strconv.FormatUint(p.lastID, 10)
+	call := &pendingCall{response: make(chan serverResponse, 1)}
+	p.waiters[key] = call
+	startReader := !p.reading
+	p.reading = true
+	return call, key, startReader, nil
 }
 
-func (s *ManagedServer) worker(ctx context.Context) {
-	for req := range s.requests {
-		callCtx, cancel := context.WithTimeout(req.ctx, s.requestTimeout)
-		payload, err := s.sendAndReceive(callCtx, req.payload, req.requestID)
-		cancel()
+func (p *pendingCalls) remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiters, key)
+}
 
-		req.response <- serverResponse{payload: payload, err: err}
+func (p *pendingCalls) resolve(key string, raw json.RawMessage) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	call, ok := p.waiters[key]
+	if !ok {
+		return false
 	}
+	delete(p.waiters, key)
+	call.response <- serverResponse{payload: raw}
+	return true
 }
 
-func (s *ManagedServer) sendAndReceive(ctx context.Context, payload []byte, requestID string) (json.RawMessage, error) {
-	s.mu.Lock()
-	stdin := s.stdin
-	decoder := s.decoder
-	s.mu.Unlock()
-
-	if stdin == nil || decoder == nil {
-		return nil, fmt.Errorf("server %s is not ready", s.cfg.ServerID)
+func (p *pendingCalls) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+	p.reading = false
+	for key, call := range p.waiters {
+		delete(p.waiters, key)
+		call.response <- serverResponse{err: err}
 	}
+}
 
-	line := append([]byte{}, payload...)
-	if len(line) == 0 {
-		return nil, errors.New("empty payload")
-	}
-	if line[len(line)-1] != '\n' {
-		line = append(line, '\n')
+func (p *pendingCalls) stopIfIdle(release func() bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Holding the lock keeps a call from registering between the check and
+	// the reader stopping, which would leave it without a reader.
+	if len(p.waiters) > 0 || !release() {
+		return false
 	}
+	p.reading = false
+	return true
+}
 
-	if err := writeAll(stdin, line); err != nil {
-		return nil, err
+func (p *pendingCalls) startReading() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil || p.reading {
+		return false
 	}
-	respCh := make(chan serverResponse, 1)
-	go func() {
-		var raw json.RawMessage
-		err := decoder.Decode(&raw)
-		respCh <- serverResponse{payload: raw, err: err}
-	}()
+	p.reading = true
+	return true
+}
 
-	select {
-	case resp := <-respCh:
-		return resp.payload, resp.err
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
+func (p *pendingCalls) markOutput() {
+	p.mu.Lock()
+	p.outputAt = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *pendingCalls) outputSince(t time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.outputAt.Before(t)
 }
 
 func (s *ManagedServer) readStderr(ctx context.Context) {
@@ -857,13 +5202,55 @@ func (s *ManagedServer) readStderr(ctx context.Context) {
 		return
 	}
 
+	// Logging happens off the read loop so a chatty server cannot stall on
+	// the shared logger; lines beyond the buffer are dropped and counted.
+	lines := make(chan string, s.stderrBuffer)
+	var dropped atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for line := range lines {
+			s.log().Log(ctx, "warn", "mcp_server_stderr", map[string]any{"server_id": s.config().ServerID, "line": line})
+			if n := dropped.Swap(0); n > 0 {
+				s.log().Log(ctx, "warn", "mcp_server_stderr_dropped", map[string]any{"server_id": s.config().ServerID, "dropped": n})
+			}
+		}
+	}()
+
 	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
-		line := scanner.Text()
-		s.logger.Log(ctx, "warn", "mcp_server_stderr", map[string]any{"server_id": s.cfg.ServerID, "line": line})
+		s.rememberStderr(scanner.Text())
+		select {
+		case lines <- scanner.Text():
+		default:
+			dropped.Add(1)
+			if s.metrics != nil {
+				s.metrics.stderrDrops.Add(ctx, 1, metric.WithAttributes(attribute.String("server_id", s.config().ServerID)))
+			}
+		}
+	}
+	close(lines)
+	<-done
+	if n := dropped.Swap(0); n > 0 {
+		s.log().Log(ctx, "warn", "mcp_server_stderr_dropped", map[string]any{"server_id": s.config().ServerID, "dropped": n})
 	}
 }
 
+func (s *ManagedServer) rememberStderr(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stderrTail) == stderrTailLines {
+		s.stderrTail = append(s.stderrTail[:0], s.stderrTail[1:]...)
+	}
+	s.stderrTail = append(s.stderrTail, line)
+}
+
+func (s *ManagedServer) recentStderr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.stderrTail, "\n")
+}
+
 func (s *ManagedServer) waitForExit(ctx context.Context) {
 	s.mu.Lock()
 	cmd := s.cmd
@@ -883,29 +5270,237 @@ func (s *ManagedServer) waitForExit(ctx context.Context) {
 	}
 
 	s.mu.Lock()
-	s.status = "stopped"
+	exitStatus := s.exitStatus
+	s.exitStatus = ""
+	recycled := s.recycling
+	s.recycling = false
+	reason := s.exitReason
+	s.exitReason = ""
+	if reason == "" {
+		reason = fmt.Sprintf("exited with code %d", code)
+	}
+	// Exits the gateway caused itself already recorded why.
+	if exitStatus == "" && !recycled && err != nil && s.lastError == "" {
+		s.lastError = fmt.Sprintf("exit: %v", err)
+	}
+	if exitStatus != "" {
+		s.setStatusLocked(ctx, exitStatus, reason)
+	} else {
+		s.setStatusLocked(ctx, "stopped", reason)
+	}
 	s.lastExitCode = code
 	s.lastExitAt = time.Now()
 	s.cmd = nil
 	s.stdin = nil
 	s.stdout = nil
+	s.stdoutReplay = nil
 	s.decoder = nil
+	s.pending = nil
 	s.stderr = nil
+	s.initializeResult = nil
+	s.toolList = nil
+	s.sessionInitialized = false
+	s.mu.Unlock()
+	// The cache outlives the process only to cover for it while it is down.
+	if s.settings.Load().maxStaleOnOutage <= 0 {
+		s.cacheMu.Lock()
+		s.cache = nil
+		s.cacheOrder = nil
+		s.cacheMu.Unlock()
+	}
+
+	s.log().Log(ctx, "warn", "mcp_server_exited", map[string]any{"server_id": s.config().ServerID, "exit_code": code, "reason": reason})
+
+	if exitStatus != "" || ctx.Err() != nil {
+		return
+	}
+	// Idle recycles are planned, so they skip the restart policy and backoff.
+	if recycled {
+		_ = s.Start(ctx)
+		return
+	}
+
+	if !shouldRestart(s.config().RestartPolicy, code) {
+		s.log().Log(ctx, "info", "mcp_server_restart_skipped", map[string]any{"server_id": s.config().ServerID, "exit_code": code, "restart_policy": s.config().RestartPolicy})
+		return
+	}
+
+	s.mu.Lock()
+	s.restartCount++
+	s.restartTotal++
+	restarts := s.restartCount
+	s.mu.Unlock()
+	if s.metrics != nil {
+		s.metrics.restarts.Add(ctx, 1, metric.WithAttributes(attribute.String("server_id", s.config().ServerID)))
+	}
+	time.Sleep(s.restartDelay(restarts))
+	_ = s.Start(ctx)
+}
+
+func (s *ManagedServer) utilization() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Without max_pending_requests there is no limit to divide by, so the
+	// gauge only tells a busy server from an idle one.
+	limit := 1
+	if slots := s.settings.Load().pendingSlots; slots != nil {
+		limit = cap(slots)
+	}
+	// Notifications written alongside calls do not take a slot, so they must
+	// not push the ratio past 1.
+	return min(float64(s.activeCalls)/float64(limit), 1)
+}
+
+func (s *ManagedServer) beginActivity() {
+	s.mu.Lock()
+	s.activeCalls++
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *ManagedServer) endActivity() {
+	s.mu.Lock()
+	s.activeCalls--
+	s.lastActivity = time.Now()
 	s.mu.Unlock()
+}
 
-	s.logger.Log(ctx, "warn", "mcp_server_exited", map[string]any{"server_id": s.cfg.ServerID, "exit_code": code})
+func (s *ManagedServer) recycleWhenIdle(ctx context.Context, cmd *exec.Cmd) {
+	idleLimit := time.Duration(s.config().StdioIdleRecycleMS) * time.Millisecond
+	timer := time.NewTimer(idleLimit)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
 
-	shouldRestart := s.cfg.RestartPolicy == "always" || (s.cfg.RestartPolicy == "on-failure" && code != 0)
-	if shouldRestart {
 		s.mu.Lock()
-		s.restartCount++
+		if s.cmd != cmd {
+			s.mu.Unlock()
+			return
+		}
+		idle := time.Since(s.lastActivity)
+		if s.status != "ready" || s.activeCalls > 0 || idle < idleLimit {
+			s.mu.Unlock()
+			timer.Reset(max(idleLimit-idle, s.settings.Load().probeInterval))
+			continue
+		}
+		// Checking and killing under one lock means a call that already
+		// began is never cut off; waitForExit starts the replacement.
+		s.recycling = true
+		_ = cmd.Process.Kill()
 		s.mu.Unlock()
-		if s.metrics != nil {
-			s.metrics.restarts.Add(ctx, 1, metric.WithAttributes(attribute.String("server_id", s.cfg.ServerID)))
+
+		s.log().Log(ctx, "info", "mcp_server_recycled", map[string]any{"server_id": s.config().ServerID, "idle_ms": idle.Milliseconds()})
+		return
+	}
+}
+
+func (s *ManagedServer) expired() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config().MaxLifetimeMS <= 0 || s.config().Transport == "http" || s.status != "ready" || s.replacement != nil {
+		return 0, false
+	}
+	age := time.Since(s.readySince)
+	return age, age >= time.Duration(s.config().MaxLifetimeMS)*time.Millisecond
+}
+
+// beginReplacement records next as the process taking over from s.
+func (s *ManagedServer) beginReplacement(next *ManagedServer) *ManagedServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replacement = next
+	return next
+}
+
+// reconcileReplacement reports whether a pending replacement of s already
+// runs cfg; one that does not is dropped and returned for the caller to stop.
+func (s *ManagedServer) reconcileReplacement(cfg ServerConfig) (*ManagedServer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.replacement
+	if pending == nil {
+		return nil, false
+	}
+	if reflect.DeepEqual(*pending.config(), cfg) {
+		return nil, true
+	}
+	s.replacement = nil
+	return pending, false
+}
+
+func (s *ManagedServer) recycle(ctx context.Context) {
+	pid := s.pid()
+	s.drain(ctx, replaceDrainTimeout)
+	s.mu.Lock()
+	cmd := s.cmd
+	if cmd == nil || cmd.Process.Pid != pid {
+		s.mu.Unlock()
+		return
+	}
+	// As with idle recycles, waitForExit starts the new process without
+	// applying the restart policy or backoff.
+	s.recycling = true
+	_ = cmd.Process.Kill()
+	s.mu.Unlock()
+
+	for {
+		if s.pid() != pid && s.currentStatus() != "starting" {
+			return
 		}
-		time.Sleep(s.restartBackoff)
-		_ = s.Start(ctx)
+		select {
+		case <-time.After(drainPollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *ManagedServer) restartDelay(restarts int) time.Duration {
+	settings := s.settings.Load()
+	delay := settings.restartBackoff
+	if settings.restartBackoffMax <= delay {
+		return delay
 	}
+	for i := 1; i < restarts && delay < settings.restartBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > settings.restartBackoffMax {
+		delay = settings.restartBackoffMax
+	}
+	// Equal jitter keeps servers that crash together from restarting in lockstep.
+	return delay/2 + mathrand.N(delay/2+1)
+}
+
+func shouldRestart(policy string, exitCode int) bool {
+	switch policy {
+	case "always":
+		return true
+	case "on-failure":
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+func overrideMS(override *int, fallback int) time.Duration {
+	if override != nil {
+		return time.Duration(*override) * time.Millisecond
+	}
+	return time.Duration(fallback) * time.Millisecond
+}
+
+func checkServerLimit(maxServers, count int) error {
+	if maxServers < 0 {
+		return errors.New("max_servers must be >= 0")
+	}
+	if maxServers > 0 && count > maxServers {
+		return fmt.Errorf("%d servers configured, exceeds max_servers %d", count, maxServers)
+	}
+	return nil
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -928,14 +5523,86 @@ func loadConfig(path string) (*Config, error) {
 	if cfg.RequestTimeoutMS < 0 {
 		return nil, errors.New("request_timeout_ms must be >= 0")
 	}
-	if cfg.RestartBackoffMS < 0 {
-		return nil, errors.New("restart_backoff_ms must be >= 0")
+	if cfg.RestartBackoffMS < 0 || cfg.RestartBackoffMaxMS < 0 || cfg.RestartResetMS < 0 {
+		return nil, errors.New("restart_backoff_ms, restart_backoff_max_ms, and restart_reset_ms must be >= 0")
+	}
+	if cfg.DependencyTimeoutMS < 0 {
+		return nil, errors.New("dependency_timeout_ms must be >= 0")
+	}
+	if cfg.FirstByteTimeoutMS < 0 {
+		return nil, errors.New("first_byte_timeout_ms must be >= 0")
+	}
+	if cfg.RecentRequestsSize < 0 {
+		return nil, errors.New("recent_requests_size must be >= 0")
+	}
+	if cfg.SelftestTimeoutMS < 0 {
+		return nil, errors.New("selftest_timeout_ms must be >= 0")
+	}
+	if cfg.MaxTotalConcurrent < 0 {
+		return nil, errors.New("max_total_concurrent_requests must be >= 0")
+	}
+	if cfg.MaxConcurrentStarts < 0 {
+		return nil, errors.New("max_concurrent_starts must be >= 0")
+	}
+	if cfg.BindRetryAttempts < 0 || cfg.BindRetryDelayMS < 0 {
+		return nil, errors.New("bind_retry_attempts and bind_retry_delay_ms must be >= 0")
+	}
+	if cfg.MaxStartWaitMS < 0 {
+		return nil, errors.New("max_start_wait_ms must be >= 0")
+	}
+	if cfg.ShutdownDrainMS < 0 || cfg.ShutdownTimeoutMS < 0 {
+		return nil, errors.New("shutdown_drain_ms and shutdown_timeout_ms must be >= 0")
+	}
+	if cfg.ShedHighWater < 0 || cfg.ShedLowWater < 0 || (cfg.ShedHighWater > 0 && cfg.ShedLowWater >= cfg.ShedHighWater) {
+		return nil, errors.New("shed_high_water and shed_low_water must be >= 0, with shed_low_water below shed_high_water")
+	}
+	if cfg.MemoryHighWatermark < 0 {
+		return nil, errors.New("memory_high_watermark_bytes must be >= 0")
+	}
+	if cfg.MetricExportIntervalMS < 0 {
+		return nil, errors.New("metric_export_interval_ms must be >= 0")
+	}
+	if cfg.MaxLineBytes < 0 {
+		return nil, errors.New("max_line_bytes must be >= 0")
+	}
+	// A pointer, because net/http reads an explicit 0 as its own 1 MiB
+	// default rather than as no headers at all.
+	if cfg.MaxHeaderBytes != nil && *cfg.MaxHeaderBytes <= 0 {
+		return nil, errors.New("max_header_bytes must be > 0")
+	}
+	if cfg.MaxBatchSize < 0 || cfg.BatchConcurrency < 0 {
+		return nil, errors.New("max_batch_size and batch_concurrency must be >= 0")
+	}
+	if cfg.StderrBufferLines < 0 {
+		return nil, errors.New("stderr_buffer_lines must be >= 0")
+	}
+	if cfg.SpillThresholdBytes < 0 {
+		return nil, errors.New("spill_threshold_bytes must be >= 0")
+	}
+	if _, err := newTLSConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkServerLimit(cfg.MaxServers, len(cfg.Servers)); err != nil {
+		return nil, err
 	}
 	if cfg.AuthToken == "" {
 		return nil, errors.New("auth_token is required")
 	}
-	if len(cfg.AllowedClients) == 0 {
-		return nil, errors.New("allowed_clients is required")
+	if cfg.TraceSampleRatio != nil && (*cfg.TraceSampleRatio < 0 || *cfg.TraceSampleRatio > 1) {
+		return nil, errors.New("trace_sample_ratio must be between 0 and 1")
+	}
+	switch cfg.ToolRoutingTieBreak {
+	case "", "priority":
+	default:
+		return nil, fmt.Errorf("invalid tool_routing_tie_break %q (expected priority or empty)", cfg.ToolRoutingTieBreak)
+	}
+	switch cfg.LandingPage {
+	case "auto", "json", "html", "off":
+	default:
+		return nil, fmt.Errorf("invalid landing_page %q (expected auto, json, html, or off)", cfg.LandingPage)
+	}
+	if len(cfg.AllowedClients) == 0 && cfg.AllowedClientsFile == "" {
+		return nil, errors.New("allowed_clients or allowed_clients_file is required")
 	}
 	if len(cfg.Servers) == 0 {
 		return nil, errors.New("servers is required")
@@ -945,15 +5612,188 @@ func loadConfig(path string) (*Config, error) {
 		if server.ServerID == "" {
 			return nil, errors.New("server_id is required")
 		}
-		if server.Command == "" {
-			return nil, fmt.Errorf("command is required for server_id %s", server.ServerID)
+		// The id is a path segment in /{server_id}/rpc and /servers/{server_id}.
+		if strings.Contains(server.ServerID, "/") {
+			return nil, fmt.Errorf("invalid server_id %q (must not contain /)", server.ServerID)
+		}
+		switch server.Transport {
+		case "", "stdio":
+			if server.Command == "" {
+				return nil, fmt.Errorf("command is required for server_id %s", server.ServerID)
+			}
+		case "http":
+			parsed, err := url.Parse(server.BaseURL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("invalid base_url %q for server_id %s (expected an http or https URL)", server.BaseURL, server.ServerID)
+			}
+		default:
+			return nil, fmt.Errorf("invalid transport %q for server_id %s (expected stdio or http)", server.Transport, server.ServerID)
+		}
+		if server.StartupTimeoutMS < 0 || server.ProbeIntervalMS < 0 || server.ProbeMaxInterval < 0 {
+			return nil, fmt.Errorf("startup_timeout_ms, probe_interval_ms, and probe_max_interval_ms must be >= 0 for server_id %s", server.ServerID)
+		}
+		if server.LatencySLOMS < 0 {
+			return nil, fmt.Errorf("latency_slo_ms must be >= 0 for server_id %s", server.ServerID)
+		}
+		for method, timeoutMS := range server.MethodTimeoutsMS {
+			if timeoutMS <= 0 {
+				return nil, fmt.Errorf("method_timeouts_ms[%q] must be > 0 for server_id %s", method, server.ServerID)
+			}
+		}
+		if server.Nice != nil && (*server.Nice < -20 || *server.Nice > 19) {
+			return nil, fmt.Errorf("nice must be between -20 and 19 for server_id %s", server.ServerID)
+		}
+		if server.IOPrio != "" {
+			if _, _, err := parseIOPrio(server.IOPrio); err != nil {
+				return nil, fmt.Errorf("%w for server_id %s", err, server.ServerID)
+			}
+		}
+		if server.MaxPendingRequests < 0 {
+			return nil, fmt.Errorf("max_pending_requests must be >= 0 for server_id %s", server.ServerID)
+		}
+		if server.RateLimitRPS < 0 || server.RateLimitBurst < 0 {
+			return nil, fmt.Errorf("rate_limit_rps and rate_limit_burst must be >= 0 for server_id %s", server.ServerID)
+		}
+		if server.StartupDelayMS < 0 {
+			return nil, fmt.Errorf("startup_delay_ms must be >= 0 for server_id %s", server.ServerID)
+		}
+		if server.DependencyTimeoutMS != nil && *server.DependencyTimeoutMS < 0 {
+			return nil, fmt.Errorf("dependency_timeout_ms must be >= 0 for server_id %s", server.ServerID)
+		}
+		for key := range server.LogFields {
+			switch key {
+			case "timestamp", "service", "level", "message", "event", "trace_id", "span_id", "server_id":
+				return nil, fmt.Errorf("log_fields key %q is reserved for server_id %s", key, server.ServerID)
+			}
+		}
+		if (len(server.PostStartHook) > 0 && server.PostStartHook[0] == "") || (len(server.PreStopHook) > 0 && server.PreStopHook[0] == "") {
+			return nil, fmt.Errorf("post_start_hook and pre_stop_hook must start with a command for server_id %s", server.ServerID)
+		}
+		for i, raw := range server.Warmup {
+			var request struct {
+				Method string `json:"method"`
+			}
+			if err := json.Unmarshal(raw, &request); err != nil || request.Method == "" {
+				return nil, fmt.Errorf("warmup[%d] must be a JSON-RPC request object with a method for server_id %s", i, server.ServerID)
+			}
+		}
+		if server.StdioIdleRecycleMS < 0 {
+			return nil, fmt.Errorf("stdio_idle_recycle_ms must be >= 0 for server_id %s", server.ServerID)
+		}
+		if server.MaxLifetimeMS < 0 {
+			return nil, fmt.Errorf("max_lifetime_ms must be >= 0 for server_id %s", server.ServerID)
+		}
+		if server.CacheTTLMS < 0 || server.CacheMaxEntries < 0 || server.MaxStaleMS < 0 || server.MaxStaleOnOutageMS < 0 {
+			return nil, fmt.Errorf("cache_ttl_ms, cache_max_entries, max_stale_ms, and max_stale_on_outage_ms must be >= 0 for server_id %s", server.ServerID)
+		}
+		// Only cached reads can be served on an outage.
+		if server.MaxStaleOnOutageMS > 0 && server.CacheTTLMS == 0 {
+			return nil, fmt.Errorf("max_stale_on_outage_ms requires cache_ttl_ms for server_id %s", server.ServerID)
+		}
+		// Without the replay, a client's initialize would reach a server the
+		// gateway has already initialized.
+		if server.StartupHandshake && !server.CacheInitialize {
+			return nil, fmt.Errorf("startup_handshake requires cache_initialize for server_id %s", server.ServerID)
+		}
+		if server.IdempotencyWindowMS < 0 || server.IdempotencyMaxKeys < 0 {
+			return nil, fmt.Errorf("idempotency_window_ms and idempotency_max_keys must be >= 0 for server_id %s", server.ServerID)
+		}
+		if (server.RestartBackoffMS != nil && *server.RestartBackoffMS < 0) || (server.RestartBackoffMaxMS != nil && *server.RestartBackoffMaxMS < 0) || (server.RestartResetMS != nil && *server.RestartResetMS < 0) {
+			return nil, fmt.Errorf("restart_backoff_ms, restart_backoff_max_ms, and restart_reset_ms must be >= 0 for server_id %s", server.ServerID)
+		}
+		if server.ReadinessTCP != "" {
+			if _, _, err := net.SplitHostPort(server.ReadinessTCP); err != nil {
+				return nil, fmt.Errorf("invalid readiness_tcp %q for server_id %s: %w", server.ReadinessTCP, server.ServerID, err)
+			}
+		}
+		if server.ReadinessHTTP != "" {
+			parsed, err := url.Parse(server.ReadinessHTTP)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("invalid readiness_http %q for server_id %s (expected an http or https URL)", server.ReadinessHTTP, server.ServerID)
+			}
 		}
 	}
 
 	for idx, server := range cfg.Servers {
+		if server.Transport == "" {
+			cfg.Servers[idx].Transport = "stdio"
+		}
 		if server.RestartPolicy == "" {
 			cfg.Servers[idx].RestartPolicy = "on-failure"
 		}
+		switch cfg.Servers[idx].RestartPolicy {
+		case "always", "on-failure", "never":
+		default:
+			return nil, fmt.Errorf("invalid restart_policy %q for server_id %s (expected always, on-failure, or never)", server.RestartPolicy, server.ServerID)
+		}
+		if server.RestartMode == "" {
+			cfg.Servers[idx].RestartMode = "stop_start"
+		}
+		switch cfg.Servers[idx].RestartMode {
+		case "stop_start", "graceful_replace":
+		default:
+			return nil, fmt.Errorf("invalid restart_mode %q for server_id %s (expected stop_start or graceful_replace)", server.RestartMode, server.ServerID)
+		}
+		if server.PausePolicy == "" {
+			cfg.Servers[idx].PausePolicy = "reject"
+		}
+		switch cfg.Servers[idx].PausePolicy {
+		case "reject", "queue":
+		default:
+			return nil, fmt.Errorf("invalid pause_policy %q for server_id %s (expected reject or queue)", server.PausePolicy, server.ServerID)
+		}
+		if server.ReaderMode == "" {
+			cfg.Servers[idx].ReaderMode = "on-demand"
+			if server.Autostart {
+				cfg.Servers[idx].ReaderMode = "persistent"
+			}
+		}
+		switch cfg.Servers[idx].ReaderMode {
+		case "persistent", "on-demand":
+		default:
+			return nil, fmt.Errorf("invalid reader_mode %q for server_id %s (expected persistent or on-demand)", server.ReaderMode, server.ServerID)
+		}
+		if server.InitializeConflict == "" {
+			cfg.Servers[idx].InitializeConflict = "shared"
+		}
+		switch cfg.Servers[idx].InitializeConflict {
+		case "shared", "reject", "rotate":
+		default:
+			return nil, fmt.Errorf("invalid initialize_conflict %q for server_id %s (expected shared, reject, or rotate)", server.InitializeConflict, server.ServerID)
+		}
+	}
+
+	backupFor := make(map[string]string)
+	for _, server := range cfg.Servers {
+		if server.BackupFor != "" {
+			backupFor[server.ServerID] = server.BackupFor
+		}
+	}
+	covered := make(map[string]bool)
+	for _, server := range cfg.Servers {
+		primary := server.BackupFor
+		if primary == "" {
+			continue
+		}
+		if primary == server.ServerID || !slices.ContainsFunc(cfg.Servers, func(s ServerConfig) bool { return s.ServerID == primary }) {
+			return nil, fmt.Errorf("backup_for %q for server_id %s must name another server", primary, server.ServerID)
+		}
+		// Failover goes one hop, so a backup cannot itself be failed over.
+		if backupFor[primary] != "" {
+			return nil, fmt.Errorf("backup_for %q for server_id %s names a server that is itself a backup", primary, server.ServerID)
+		}
+		if covered[primary] {
+			return nil, fmt.Errorf("server_id %s has more than one backup", primary)
+		}
+		covered[primary] = true
+	}
+	if err := checkDependencies(cfg.Servers); err != nil {
+		return nil, err
+	}
+	// Shedding serves only the highest priority, so with every server at the
+	// same priority it would report itself active and reject nothing.
+	if cfg.ShedHighWater > 0 && !slices.ContainsFunc(cfg.Servers, func(s ServerConfig) bool { return s.Priority != cfg.Servers[0].Priority }) {
+		return nil, errors.New("shed_high_water requires servers with differing priority")
 	}
 
 	return &cfg, nil
@@ -966,15 +5806,71 @@ func applyConfigDefaults(cfg Config) Config {
 	if cfg.BindPort == 0 {
 		cfg.BindPort = defaultPort
 	}
+	if cfg.BindRetryDelayMS == 0 {
+		cfg.BindRetryDelayMS = defaultBindRetryDelayMS
+	}
 	if cfg.RequestTimeoutMS == 0 {
 		cfg.RequestTimeoutMS = defaultRequestTimeoutMS
 	}
 	if cfg.RestartBackoffMS == 0 {
 		cfg.RestartBackoffMS = defaultRestartBackoffMS
 	}
+	if cfg.DependencyTimeoutMS == 0 {
+		cfg.DependencyTimeoutMS = defaultDependencyTimeout
+	}
+	if cfg.ShutdownDrainMS == 0 {
+		cfg.ShutdownDrainMS = defaultShutdownDrainMS
+	}
+	if cfg.ShutdownTimeoutMS == 0 {
+		cfg.ShutdownTimeoutMS = defaultShutdownTimeoutMS
+	}
+	if cfg.LandingPage == "" {
+		cfg.LandingPage = "auto"
+	}
+	if cfg.RecentRequestsSize == 0 {
+		cfg.RecentRequestsSize = defaultRecentRequestsSize
+	}
+	if cfg.SelftestTimeoutMS == 0 {
+		cfg.SelftestTimeoutMS = defaultSelftestTimeoutMS
+	}
+	if cfg.MaxLineBytes == 0 {
+		cfg.MaxLineBytes = defaultMaxLineBytes
+	}
+	if cfg.MaxHeaderBytes == nil {
+		maxHeaderBytes := defaultMaxHeaderBytes
+		cfg.MaxHeaderBytes = &maxHeaderBytes
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = defaultMaxBatchSize
+	}
+	if cfg.RequestIDHeader == "" {
+		cfg.RequestIDHeader = defaultRequestIDHeader
+	}
+	if cfg.TLSMinVersion == "" {
+		cfg.TLSMinVersion = defaultTLSMinVersion
+	}
+	if cfg.ShedHighWater > 0 && cfg.ShedLowWater == 0 {
+		cfg.ShedLowWater = cfg.ShedHighWater / 2
+	}
+	if cfg.StderrBufferLines == 0 {
+		cfg.StderrBufferLines = defaultStderrBufferLines
+	}
+	if cfg.BatchConcurrency == 0 {
+		cfg.BatchConcurrency = defaultBatchConcurrency
+	}
+	if len(cfg.AdminAllowedClients) == 0 {
+		cfg.AdminAllowedClients = []string{"localhost"}
+	}
 	return cfg
 }
 
+func defaultInt(value, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
 func expandPath(path string) (string, error) {
 	if strings.HasPrefix(path, "~") {
 		home, err := os.UserHomeDir()
@@ -986,6 +5882,41 @@ func expandPath(path string) (string, error) {
 	return path, nil
 }
 
+func loadClientAllowlist(cfg Config) ([]net.IP, []*net.IPNet, error) {
+	entries := slices.Clone(cfg.AllowedClients)
+	if cfg.AllowedClientsFile != "" {
+		fileEntries, err := readAllowlistFile(cfg.AllowedClientsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return parseAllowlist(entries)
+}
+
+func readAllowlistFile(path string) ([]string, error) {
+	expanded, err := expandPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_clients_file: %w", err)
+	}
+	data, err := os.ReadFile(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_clients_file: %w", err)
+	}
+	var entries []string
+	for number, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := parseAllowlist([]string{line}); err != nil {
+			return nil, fmt.Errorf("allowed_clients_file %s:%d: %w", path, number+1, err)
+		}
+		entries = append(entries, line)
+	}
+	return entries, nil
+}
+
 func parseAllowlist(entries []string) ([]net.IP, []*net.IPNet, error) {
 	var ips []net.IP
 	var cidrs []*net.IPNet
@@ -1021,22 +5952,171 @@ func parseAllowlist(entries []string) ([]net.IP, []*net.IPNet, error) {
 }
 
 func extractRequestID(payload json.RawMessage) string {
-	var data map[string]any
-	if err := json.Unmarshal(payload, &data); err != nil {
-		return ""
+	id := rawRequestID(payload)
+	var text string
+	if bytes.HasPrefix(id, []byte(`"`)) && json.Unmarshal(id, &text) == nil {
+		return text
 	}
-	if id, ok := data["id"]; ok {
-		return fmt.Sprintf("%v", id)
-	}
-	return ""
+	// Numbers keep their literal text so large ids are not rounded.
+	return string(id)
+}
+
+func writeAllow(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func writeError(w http.ResponseWriter, status int, gatewayErr GatewayError) {
 	w.Header().Set("Content-Type", "application/json")
+	// Only refusals that may clear up invite a retry: the transient ones, and
+	// no_healthy_instances, since an instance may be restarted or come back.
+	switch gatewayErr.ErrorCode {
+	case "gateway_busy", "server_busy", "memory_pressure", "gateway_overloaded", "server_rate_limited", "server_starting", "no_healthy_instances":
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	}
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(GatewayResponse{Error: &gatewayErr})
 }
 
+func classifyCallError(err error) (int, string) {
+	switch {
+	case errors.Is(err, errServerPaused):
+		return http.StatusServiceUnavailable, "server_paused"
+	case errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable, "gateway_shutting_down"
+	case errors.Is(err, errUnknownSession):
+		return http.StatusNotFound, "session_not_found"
+	case errors.Is(err, errNoHealthy):
+		return http.StatusServiceUnavailable, "no_healthy_instances"
+	case errors.Is(err, errServerStarting):
+		return http.StatusServiceUnavailable, "server_starting"
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests, "server_rate_limited"
+	case errors.Is(err, errServerBusy):
+		return http.StatusServiceUnavailable, "server_busy"
+	case errors.Is(err, errOverloaded):
+		return http.StatusServiceUnavailable, "gateway_overloaded"
+	case errors.Is(err, errSessionConflict):
+		return http.StatusConflict, "session_conflict"
+	case errors.Is(err, errIdempotencyReuse):
+		return http.StatusUnprocessableEntity, "idempotency_key_reused"
+	case errors.Is(err, errFirstByteTimeout):
+		return http.StatusGatewayTimeout, "first_byte_timeout"
+	case errors.Is(err, errRequestTimeout):
+		return http.StatusGatewayTimeout, "request_timeout"
+	default:
+		return http.StatusBadGateway, "server_error"
+	}
+}
+
+func (g *Gateway) errorDetail(server *ManagedServer, errorCode string) string {
+	// Only failures that point at a dead or crashing process carry stderr;
+	// it can hold anything the server printed, hence the opt-in.
+	if !g.cfg.DebugErrors || (errorCode != "server_error" && errorCode != "no_healthy_instances") {
+		return ""
+	}
+	return server.recentStderr()
+}
+
+func transportErrorCode(errorCode string) (int, bool) {
+	switch errorCode {
+	case "request_timeout", "first_byte_timeout":
+		return -32001, true
+	case "server_error":
+		return -32002, true
+	case "no_healthy_instances", "server_starting", "server_rate_limited", "server_busy", "gateway_overloaded", "server_paused", "gateway_shutting_down":
+		return -32003, true
+	default:
+		return 0, false
+	}
+}
+
+func (g *Gateway) jsonrpcError(gatewayErr GatewayError) (json.RawMessage, bool) {
+	if !g.cfg.JSONRPCErrors || gatewayErr.RequestID == nil {
+		return nil, false
+	}
+	// Session errors stay HTTP errors: MCP clients rely on the 404 to
+	// re-initialize.
+	code, ok := transportErrorCode(gatewayErr.ErrorCode)
+	if !ok {
+		return nil, false
+	}
+	return jsonrpcErrorPayload(code, gatewayErr)
+}
+
+func jsonrpcErrorPayload(code int, gatewayErr GatewayError) (json.RawMessage, bool) {
+	data := map[string]any{"error_code": gatewayErr.ErrorCode, "server_id": gatewayErr.ServerID}
+	if gatewayErr.Detail != "" {
+		data["detail"] = gatewayErr.Detail
+	}
+	payload, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      gatewayErr.RequestID,
+		"error": map[string]any{
+			"code":    code,
+			"message": gatewayErr.Message,
+			"data":    data,
+		},
+	})
+	return payload, err == nil
+}
+
+func recordSpanError(span trace.Span, gatewayErr GatewayError) {
+	span.SetAttributes(attribute.String("error_code", gatewayErr.ErrorCode))
+	span.RecordError(errors.New(gatewayErr.Message))
+	span.SetStatus(codes.Error, gatewayErr.Message)
+}
+
+func writeSpanError(span trace.Span, w http.ResponseWriter, status int, gatewayErr GatewayError) {
+	recordSpanError(span, gatewayErr)
+	writeError(w, status, gatewayErr)
+}
+
+func readEnvFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("env_file: %w", err)
+	}
+	var env []string
+	for number, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("env_file %s:%d: expected KEY=VALUE", path, number+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
+
+func listenFailure(addr string, err error) map[string]any {
+	fields := map[string]any{"addr": addr, "error": err.Error()}
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		fields["cause"] = "address already in use"
+		fields["hint"] = "another process is listening on " + addr + "; stop it or change bind_port (or admin_bind)"
+	case errors.Is(err, syscall.EACCES):
+		fields["cause"] = "permission denied"
+		fields["hint"] = "ports below 1024 need elevated privileges; use a higher bind_port or grant CAP_NET_BIND_SERVICE"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		fields["cause"] = "address not available"
+		fields["hint"] = "the bind host is not assigned to any local interface; check bind_host (or admin_bind)"
+	case errors.As(err, &dnsErr):
+		fields["cause"] = "host lookup failed"
+		fields["hint"] = "the bind host does not resolve; use an IP address or a resolvable name"
+	}
+	return fields
+}
+
 func writeAll(writer io.Writer, data []byte) error {
 	for len(data) > 0 {
 		written, err := writer.Write(data)
@@ -1048,6 +6128,173 @@ func writeAll(writer io.Writer, data []byte) error {
 	return nil
 }
 
+func (r serverRequest) body() io.Reader {
+	if r.source != nil {
+		return r.source
+	}
+	return bytes.NewReader(r.payload)
+}
+
+func copyLine(writer io.Writer, source io.Reader) error {
+	tail := &lastByteWriter{writer: writer}
+	n, err := io.Copy(tail, source)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("empty payload")
+	}
+	if tail.last != '\n' {
+		return writeAll(writer, []byte{'\n'})
+	}
+	return nil
+}
+
+func spliceID(message []byte, id json.RawMessage) ([]byte, error) {
+	start, end, err := messageIDSpan(bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat(message[:start], id, message[end:]), nil
+}
+
+func copyLineWithID(writer io.Writer, source io.ReadSeeker, id json.RawMessage) error {
+	start, end, err := messageIDSpan(source)
+	if err != nil {
+		return err
+	}
+	// The body is copied around its id, so a spilled one is still streamed
+	// from disk rather than decoded.
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(writer, source, start); err != nil {
+		return err
+	}
+	if err := writeAll(writer, id); err != nil {
+		return err
+	}
+	if _, err := source.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	return copyLine(writer, source)
+}
+
+func messageIDSpan(message io.Reader) (int64, int64, error) {
+	decoder := json.NewDecoder(message)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return 0, 0, errors.New("request is not a JSON object")
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return 0, 0, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return 0, 0, err
+		}
+		if key == "id" {
+			end := decoder.InputOffset()
+			return end - int64(len(value)), end, nil
+		}
+	}
+	return 0, 0, errors.New("request has no id")
+}
+
+type lastByteWriter struct {
+	writer io.Writer
+	last   byte
+}
+
+func (l *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := l.writer.Write(p)
+	if n > 0 {
+		l.last = p[n-1]
+	}
+	return n, err
+}
+
+func readRequestBody(body io.Reader, threshold int) ([]byte, *spilledBody, error) {
+	if threshold <= 0 {
+		data, err := io.ReadAll(body)
+		return data, nil, err
+	}
+	buf := make([]byte, threshold+1)
+	n, err := io.ReadFull(body, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return buf[:n], nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.CreateTemp("", "host-mcp-gateway-body-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	spilled := &spilledBody{file: file}
+	if err := writeAll(file, buf); err != nil {
+		spilled.Close()
+		return nil, nil, err
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		spilled.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spilled.Close()
+		return nil, nil, err
+	}
+	// Only the envelope fields are kept in memory; params stay on disk.
+	spilled.head, err = skimMessage(file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spilled.Close()
+		return nil, nil, err
+	}
+	return nil, spilled, nil
+}
+
+func skimMessage(reader io.Reader) ([]byte, error) {
+	// Only a bounded prefix is read, so the envelope has to come before any
+	// large params; the rest of the body is streamed as is.
+	decoder := json.NewDecoder(io.LimitReader(reader, spillHeadBytes))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("body is not a JSON object")
+	}
+	head := map[string]json.RawMessage{}
+	for (head["id"] == nil || head["method"] == nil) && decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		name := key.(string)
+		if name == "result" || name == "error" {
+			// Only a response has these, and it is written on as is, so
+			// the large part need not fit the prefix; an empty one stands in.
+			head[name] = json.RawMessage("{}")
+			return json.Marshal(head)
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("no id and method within the first %d bytes: %w", spillHeadBytes, err)
+		}
+		if name == "jsonrpc" || name == "id" || name == "method" {
+			head[name] = value
+		}
+	}
+	if head["id"] == nil || head["method"] == nil {
+		// A notification has no id, which is only known once the object ends.
+		if token, err := decoder.Token(); err != nil || token != json.Delim('}') {
+			return nil, fmt.Errorf("no id and method within the first %d bytes", spillHeadBytes)
+		}
+	}
+	return json.Marshal(head)
+}
+
 func formatTime(value time.Time) string {
 	if value.IsZero() {
 		return ""
@@ -1055,24 +6302,138 @@ func formatTime(value time.Time) string {
 	return value.UTC().Format(time.RFC3339Nano)
 }
 
+func parseIOPrio(value string) (int, int, error) {
+	name, rawLevel, hasLevel := strings.Cut(value, ":")
+	classes := map[string]int{"realtime": 1, "best-effort": 2, "idle": 3}
+	class, ok := classes[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid ioprio %q (expected realtime:N, best-effort:N, or idle)", value)
+	}
+	if name == "idle" {
+		if hasLevel {
+			return 0, 0, fmt.Errorf("invalid ioprio %q (idle takes no level)", value)
+		}
+		return class, 0, nil
+	}
+	level, err := strconv.Atoi(rawLevel)
+	if !hasLevel || err != nil || level < 0 || level > 7 {
+		return 0, 0, fmt.Errorf("invalid ioprio %q (level must be 0-7)", value)
+	}
+	return class, level, nil
+}
+
+func isBatch(payload []byte) bool {
+	trimmed := bytes.TrimLeft(payload, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
 func isNotification(payload []byte) bool {
 	method, hasID := parseMethodAndID(payload)
 	return method != "" && !hasID
 }
 
+// isResponse reports whether payload answers a request, as a client does
+// for the requests a server sends on its own.
+func isResponse(payload []byte) bool {
+	var data struct {
+		Method json.RawMessage `json:"method"`
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return false
+	}
+	return data.Method == nil && (data.Result != nil || data.Error != nil)
+}
+
+// isOneWay reports whether payload is written to the server without
+// waiting for an answer: a notification, or a client's response.
+func isOneWay(payload []byte) bool {
+	return isNotification(payload) || isResponse(payload)
+}
+
 func isInitializeRequest(payload []byte) bool {
 	method, _ := parseMethodAndID(payload)
 	return method == "initialize"
 }
 
+func rawRequestID(payload []byte) json.RawMessage {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil
+	}
+	return data["id"]
+}
+
+func responseID(raw json.RawMessage) (json.RawMessage, bool) {
+	var data struct {
+		Method json.RawMessage `json:"method"`
+		ID     json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &data); err != nil || data.Method != nil || data.ID == nil || string(data.ID) == "null" {
+		return nil, false
+	}
+	return data.ID, true
+}
+
+func pendingKey(id json.RawMessage) string {
+	// Servers may echo an id back with different spacing.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, id); err != nil {
+		return string(id)
+	}
+	return compact.String()
+}
+
+func replaceResponseID(payload json.RawMessage, id json.RawMessage) (json.RawMessage, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, err
+	}
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	data["id"] = id
+	return json.Marshal(data)
+}
+
+func isSuccessResponse(payload json.RawMessage) bool {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return false
+	}
+	_, hasResult := data["result"]
+	return hasResult
+}
+
+func readKey(payload []byte) (string, string, bool) {
+	var data struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(payload, &data); err != nil || !idempotentMethods[data.Method] {
+		return "", "", false
+	}
+	var params bytes.Buffer
+	if len(data.Params) > 0 {
+		if err := json.Compact(&params, data.Params); err != nil {
+			return "", "", false
+		}
+	}
+	return data.Method, data.Method + "\x00" + params.String(), true
+}
+
 func parseMethodAndID(payload []byte) (string, bool) {
-	var data map[string]any
+	// The id stays raw: decoding it as a number would round large integers.
+	var data struct {
+		Method any             `json:"method"`
+		ID     json.RawMessage `json:"id"`
+	}
 	if err := json.Unmarshal(payload, &data); err != nil {
 		return "", false
 	}
-	method, _ := data["method"].(string)
-	_, hasID := data["id"]
-	return method, hasID
+	method, _ := data.Method.(string)
+	return method, data.ID != nil
 }
 
 func randomSessionID() string {
@@ -1,19 +1,129 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	tracenoop "go.opentelemetry.io/otel/trace/noop"
 )
 
+// TestMain lets the test binary double as a fake MCP server for process tests.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv("GATEWAY_FAKE_SERVER"); mode != "" {
+		runFakeServer(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeServer answers newline-delimited JSON-RPC requests on stdin according to mode.
+func runFakeServer(mode string) {
+	scanner := bufio.NewScanner(os.Stdin)
+	pings := 0
+	for scanner.Scan() {
+		var message map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+		id, hasID := message["id"]
+		if !hasID || mode == "silent" {
+			continue
+		}
+		var method string
+		_ = json.Unmarshal(message["method"], &method)
+		if method == "ping" {
+			pings++
+		}
+
+		if mode == "close-stdin" {
+			// Keep running with stdin closed so only the write side fails.
+			_ = os.Stdin.Close()
+			defer time.Sleep(time.Hour)
+		}
+		if mode == "crash" && method == "tools/call" {
+			fmt.Fprintln(os.Stderr, "fatal: tool blew up")
+			// Give the gateway time to read stderr before the pipe closes.
+			time.Sleep(200 * time.Millisecond)
+			os.Exit(2)
+		}
+		if mode == "giant-line" {
+			_, _ = os.Stdout.Write(append([]byte(`{"jsonrpc":"2.0","result":"`), bytes.Repeat([]byte("x"), 1<<20)...))
+			continue
+		}
+
+		reply := map[string]any{"jsonrpc": "2.0", "id": id}
+		if mode == "flaky-probe" && method == "ping" && pings < 3 {
+			reply["error"] = map[string]any{"code": -32002, "message": "not ready"}
+		} else {
+			result := map[string]any{}
+			if marker := os.Getenv("GATEWAY_FAKE_MARKER"); marker != "" {
+				result["marker"] = marker
+			}
+			reply["result"] = result
+		}
+		data, _ := json.Marshal(reply)
+		_, _ = os.Stdout.Write(append(data, '\n'))
+	}
+}
+
+// fakeServerConfig returns a server config that runs the test binary as a fake MCP server.
+func fakeServerConfig(t *testing.T, serverID, mode string) ServerConfig {
+	t.Helper()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("resolve test executable: %v", err)
+	}
+	return ServerConfig{
+		ServerID:      serverID,
+		Command:       executable,
+		Env:           map[string]string{"GATEWAY_FAKE_SERVER": mode},
+		RestartPolicy: "never",
+	}
+}
+
+// killOnCleanup terminates a managed server's child process when the test ends.
+func killOnCleanup(t *testing.T, server *ManagedServer) {
+	t.Helper()
+	t.Cleanup(func() {
+		server.Close(context.Background())
+	})
+}
+
+// setLogger points a server's log output at logger.
+func setLogger(server *ManagedServer, logger *Logger) {
+	settings := *server.settings.Load()
+	settings.logger = logger
+	server.settings.Store(&settings)
+}
+
 // nopWriteCloser wraps a buffer with a no-op Close method.
 type nopWriteCloser struct {
 	*bytes.Buffer
@@ -24,6 +134,39 @@ func (n nopWriteCloser) Close() error {
 	return nil
 }
 
+// replyingStdin answers each request written to it on its paired stdout,
+// with a result chosen by method.
+type replyingStdin struct {
+	stdout *io.PipeWriter
+	result func(method string) string
+}
+
+// newReplyingStdio returns a server stdin that replies on the returned stdout.
+func newReplyingStdio(t *testing.T, result func(method string) string) (*replyingStdin, io.Reader) {
+	t.Helper()
+	reader, writer := io.Pipe()
+	t.Cleanup(func() { _ = writer.Close() })
+	return &replyingStdin{stdout: writer, result: result}, reader
+}
+
+// Write replies to every request line in p from its own goroutine.
+func (r *replyingStdin) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimSpace(p), []byte("\n")) {
+		method, hasID := parseMethodAndID(line)
+		if !hasID {
+			continue
+		}
+		response := fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":%s}`+"\n", rawRequestID(line), r.result(method))
+		go func() { _, _ = io.WriteString(r.stdout, response) }()
+	}
+	return len(p), nil
+}
+
+// Close satisfies io.WriteCloser.
+func (r *replyingStdin) Close() error {
+	return nil
+}
+
 // newTestGateway constructs a gateway with noop telemetry.
 func newTestGateway(t *testing.T, cfg Config) *Gateway {
 	t.Helper()
@@ -171,6 +314,188 @@ func TestGatewayAuthChecks(t *testing.T) {
 	}
 }
 
+// TestHealthSkipAuth serves GET /health without a token to allowed clients only, leaving other endpoints guarded.
+func TestHealthSkipAuth(t *testing.T) {
+	t.Parallel()
+
+	handler := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		HealthSkipAuth: true,
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	}).routes()
+	for _, tc := range []struct {
+		path   string
+		remote string
+		want   int
+	}{
+		{"/health", "127.0.0.1:1234", http.StatusOK},
+		{"/health", "10.0.0.1:1234", http.StatusForbidden},
+		{"/servers", "127.0.0.1:1234", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.RemoteAddr = tc.remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("GET %s from %s: expected %d, got %d", tc.path, tc.remote, tc.want, rec.Code)
+		}
+	}
+}
+
+// TestListenFailureExplainsBindErrors adds a cause and hint for common bind failures.
+func TestListenFailureExplainsBindErrors(t *testing.T) {
+	t.Parallel()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer taken.Close()
+
+	addr := taken.Addr().String()
+	err = (&http.Server{Addr: addr}).ListenAndServe()
+	fields := listenFailure(addr, err)
+	if fields["cause"] != "address already in use" || !strings.Contains(fields["hint"].(string), addr) {
+		t.Fatalf("unexpected fields for EADDRINUSE: %v", fields)
+	}
+
+	fields = listenFailure(addr, errors.New("boom"))
+	if _, ok := fields["cause"]; ok || fields["error"] != "boom" {
+		t.Fatalf("unexpected fields for unknown error: %v", fields)
+	}
+}
+
+// TestErrorResponsesPreserveRequestIDType echoes numeric, string, and null ids exactly as the client sent them.
+func TestErrorResponsesPreserveRequestIDType(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}})
+	handler := gateway.routes()
+
+	for _, tc := range []struct {
+		id      string
+		logText string
+	}{
+		{`7`, "7"},
+		{`12345678901234567890`, "12345678901234567890"},
+		{`"7"`, "7"},
+		{`null`, "null"},
+	} {
+		payload := `{"jsonrpc":"2.0","id":` + tc.id + `,"method":"tools/list"}`
+		if got := extractRequestID(json.RawMessage(payload)); got != tc.logText {
+			t.Fatalf("extractRequestID(%s) = %q, expected %q", tc.id, got, tc.logText)
+		}
+
+		for _, route := range []struct{ path, body string }{
+			{"/missing/rpc", payload},
+			{"/rpc", `{"server_id":"missing","payload":` + payload + `}`},
+		} {
+			req := httptest.NewRequest(http.MethodPost, route.path, strings.NewReader(route.body))
+			req.RemoteAddr = "127.0.0.1:1234"
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			var response struct {
+				Error struct {
+					RequestID json.RawMessage `json:"request_id"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if string(response.Error.RequestID) != tc.id {
+				t.Fatalf("%s: expected request_id %s, got %s", route.path, tc.id, response.Error.RequestID)
+			}
+		}
+	}
+}
+
+// TestHealthSummaryStates reports per-state counts and ranks degraded above starting above ok.
+func TestHealthSummaryStates(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "a", Command: "/bin/echo"}, {ServerID: "b", Command: "/bin/echo"}},
+	})
+	setStatuses := func(a, b string) {
+		for id, status := range map[string]string{"a": a, "b": b} {
+			server := gateway.servers[id]
+			server.mu.Lock()
+			server.status = status
+			server.mu.Unlock()
+		}
+	}
+
+	for _, tc := range []struct {
+		a, b string
+		want string
+	}{
+		{"ready", "ready", "ok"},
+		{"ready", "starting", "starting"},
+		{"starting", "error", "degraded"},
+		{"ready", "stopped", "degraded"},
+	} {
+		setStatuses(tc.a, tc.b)
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+
+		var health struct {
+			Status string         `json:"status"`
+			Counts map[string]int `json:"counts"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+			t.Fatalf("decode health: %v", err)
+		}
+		if health.Status != tc.want {
+			t.Fatalf("%s/%s: expected %s, got %s", tc.a, tc.b, tc.want, health.Status)
+		}
+		if health.Counts[tc.a] < 1 || health.Counts[tc.b] < 1 || len(health.Counts) != 4 {
+			t.Fatalf("%s/%s: unexpected counts %v", tc.a, tc.b, health.Counts)
+		}
+	}
+}
+
+// TestListenerRejectsOversizedHeaders answers 431 once headers exceed max_header_bytes.
+func TestListenerRejectsOversizedHeaders(t *testing.T) {
+	t.Parallel()
+
+	maxHeaderBytes := 1024
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		MaxHeaderBytes: &maxHeaderBytes,
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	listener := httptest.NewUnstartedServer(nil)
+	listener.Config = gateway.newListener("", gateway.routes())
+	listener.Start()
+	defer listener.Close()
+
+	for size, want := range map[int]int{64: http.StatusOK, 64 << 10: http.StatusRequestHeaderFieldsTooLarge} {
+		req, err := http.NewRequest(http.MethodGet, listener.URL+"/health", nil)
+		if err != nil {
+			t.Fatalf("build request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("X-Padding", strings.Repeat("x", size))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%d-byte header: expected %d, got %d", size, want, resp.StatusCode)
+		}
+	}
+}
+
 // TestGatewayRPCWrapperRoutes verifies routing through the /rpc wrapper.
 func TestGatewayRPCWrapperRoutes(t *testing.T) {
 	t.Parallel()
@@ -190,14 +515,9 @@ func TestGatewayRPCWrapperRoutes(t *testing.T) {
 	server.status = "ready"
 	server.stdin = nopWriteCloser{Buffer: &bytes.Buffer{}}
 	server.decoder = json.NewDecoder(bytes.NewReader(append(responsePayload, '\n')))
+	server.pending = newPendingCalls()
 	server.mu.Unlock()
 
-	ctx := context.Background()
-	go server.worker(ctx)
-	t.Cleanup(func() {
-		close(server.requests)
-	})
-
 	requestBody := []byte(`{"server_id":"unit","payload":{"jsonrpc":"2.0","id":1,"method":"ping"}}`)
 	req := httptest.NewRequest(http.MethodPost, "/rpc", bytes.NewReader(requestBody))
 	req.RemoteAddr = "127.0.0.1:1234"
@@ -221,3 +541,4962 @@ func TestGatewayRPCWrapperRoutes(t *testing.T) {
 		t.Fatalf("unexpected payload: %s", string(response.Payload))
 	}
 }
+
+// writeTestConfig marshals a config payload into a temp file and returns its path.
+func writeTestConfig(t *testing.T, payload map[string]any) string {
+	t.Helper()
+	cfgPath := filepath.Join(t.TempDir(), "gateway.json")
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	if err := os.WriteFile(cfgPath, data, 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return cfgPath
+}
+
+// TestLoadConfigRestartPolicyValidation accepts known policies and rejects unknown ones.
+func TestLoadConfigRestartPolicyValidation(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []string{"always", "on-failure", "never"} {
+		cfgPath := writeTestConfig(t, map[string]any{
+			"auth_token":      "secret",
+			"allowed_clients": []string{"127.0.0.1"},
+			"servers": []map[string]any{
+				{"server_id": "unit", "command": "/bin/echo", "restart_policy": policy},
+			},
+		})
+		cfg, err := loadConfig(cfgPath)
+		if err != nil {
+			t.Fatalf("loadConfig rejected policy %q: %v", policy, err)
+		}
+		if cfg.Servers[0].RestartPolicy != policy {
+			t.Fatalf("expected policy %q, got %q", policy, cfg.Servers[0].RestartPolicy)
+		}
+	}
+
+	cfgPath := writeTestConfig(t, map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers": []map[string]any{
+			{"server_id": "unit", "command": "/bin/echo", "restart_policy": "sometimes"},
+		},
+	})
+	if _, err := loadConfig(cfgPath); err == nil {
+		t.Fatal("expected restart_policy validation error")
+	}
+}
+
+// TestLoadConfigMaxHeaderBytes defaults an unset max_header_bytes and rejects an explicit 0 or negative value.
+func TestLoadConfigMaxHeaderBytes(t *testing.T) {
+	t.Parallel()
+
+	payload := map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers":         []map[string]any{{"server_id": "unit", "command": "/bin/echo"}},
+	}
+	cfg, err := loadConfig(writeTestConfig(t, payload))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.MaxHeaderBytes == nil || *cfg.MaxHeaderBytes != defaultMaxHeaderBytes {
+		t.Fatalf("expected default max_header_bytes %d, got %v", defaultMaxHeaderBytes, cfg.MaxHeaderBytes)
+	}
+
+	for _, value := range []int{0, -1} {
+		payload["max_header_bytes"] = value
+		if _, err := loadConfig(writeTestConfig(t, payload)); err == nil || !strings.Contains(err.Error(), "max_header_bytes") {
+			t.Fatalf("expected max_header_bytes %d to be rejected, got %v", value, err)
+		}
+	}
+}
+
+// TestLoadConfigMaxServers rejects configs with more servers than max_servers allows.
+func TestLoadConfigMaxServers(t *testing.T) {
+	t.Parallel()
+
+	servers := []map[string]any{
+		{"server_id": "one", "command": "/bin/echo"},
+		{"server_id": "two", "command": "/bin/echo"},
+	}
+	for _, tc := range []struct {
+		maxServers int
+		wantErr    bool
+	}{
+		{maxServers: 0, wantErr: false},
+		{maxServers: 2, wantErr: false},
+		{maxServers: 1, wantErr: true},
+		{maxServers: -1, wantErr: true},
+	} {
+		cfgPath := writeTestConfig(t, map[string]any{
+			"auth_token":      "secret",
+			"allowed_clients": []string{"127.0.0.1"},
+			"max_servers":     tc.maxServers,
+			"servers":         servers,
+		})
+		_, err := loadConfig(cfgPath)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("max_servers=%d: expected error %v, got %v", tc.maxServers, tc.wantErr, err)
+		}
+	}
+}
+
+// TestShouldRestart covers the restart decision for each policy and exit code.
+func TestShouldRestart(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		policy   string
+		exitCode int
+		want     bool
+	}{
+		{policy: "always", exitCode: 0, want: true},
+		{policy: "always", exitCode: 1, want: true},
+		{policy: "on-failure", exitCode: 0, want: false},
+		{policy: "on-failure", exitCode: 1, want: true},
+		{policy: "never", exitCode: 0, want: false},
+		{policy: "never", exitCode: 1, want: false},
+	}
+	for _, tc := range cases {
+		if got := shouldRestart(tc.policy, tc.exitCode); got != tc.want {
+			t.Fatalf("shouldRestart(%q, %d) = %v, want %v", tc.policy, tc.exitCode, got, tc.want)
+		}
+	}
+}
+
+// TestRestartDelayBackoff honors per-server overrides and grows with jitter up to the cap.
+func TestRestartDelayBackoff(t *testing.T) {
+	t.Parallel()
+
+	zero := 0
+	backoff := 100
+	backoffMax := 1000
+	gateway := newTestGateway(t, Config{
+		AuthToken:        "secret",
+		AllowedClients:   []string{"127.0.0.1"},
+		RestartBackoffMS: 500,
+		Servers: []ServerConfig{
+			{ServerID: "default", Command: "/bin/echo"},
+			{ServerID: "instant", Command: "/bin/echo", RestartBackoffMS: &zero},
+			{ServerID: "growing", Command: "/bin/echo", RestartBackoffMS: &backoff, RestartBackoffMaxMS: &backoffMax},
+		},
+	})
+
+	if delay := gateway.servers["default"].restartDelay(5); delay != 500*time.Millisecond {
+		t.Fatalf("expected fixed gateway backoff, got %v", delay)
+	}
+	if delay := gateway.servers["instant"].restartDelay(5); delay != 0 {
+		t.Fatalf("expected instant restart, got %v", delay)
+	}
+	growing := gateway.servers["growing"]
+	for _, tc := range []struct {
+		restarts int
+		min, max time.Duration
+	}{
+		{restarts: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{restarts: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{restarts: 10, min: 500 * time.Millisecond, max: time.Second},
+	} {
+		if delay := growing.restartDelay(tc.restarts); delay < tc.min || delay > tc.max {
+			t.Fatalf("restart %d: expected delay in [%v, %v], got %v", tc.restarts, tc.min, tc.max, delay)
+		}
+	}
+
+	cfgPath := writeTestConfig(t, map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers": []map[string]any{
+			{"server_id": "unit", "command": "/bin/echo", "restart_backoff_max_ms": -1},
+		},
+	})
+	if _, err := loadConfig(cfgPath); err == nil {
+		t.Fatal("expected negative restart_backoff_max_ms to be rejected")
+	}
+}
+
+// TestExportMonitorRateLimitsWarnings logs the first export failure and counts later ones as suppressed.
+func TestExportMonitorRateLimitsWarnings(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	exporter := monitoredSpanExporter{SpanExporter: failingSpanExporter{}, monitor: &exportMonitor{logger: NewLogger(logs)}}
+	for i := 0; i < 3; i++ {
+		if err := exporter.ExportSpans(context.Background(), nil); err == nil {
+			t.Fatal("expected the export error to be returned")
+		}
+	}
+	if count := strings.Count(logs.String(), `"event":"otel_export_failed"`); count != 1 {
+		t.Fatalf("expected one otel_export_failed warning, got %d: %s", count, logs.String())
+	}
+	if suppressed := exporter.monitor.suppressed; suppressed != 2 {
+		t.Fatalf("expected 2 suppressed failures, got %d", suppressed)
+	}
+}
+
+// failingSpanExporter rejects every batch, as an exporter does while the collector is unreachable.
+type failingSpanExporter struct{}
+
+func (failingSpanExporter) ExportSpans(context.Context, []sdktrace.ReadOnlySpan) error {
+	return errors.New("collector unavailable")
+}
+
+func (failingSpanExporter) Shutdown(context.Context) error { return nil }
+
+// TestUtilizationGauge reports in-flight requests over max_pending_requests for stdio servers, or busy versus idle without it.
+func TestUtilizationGauge(t *testing.T) {
+	t.Parallel()
+
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	cfg := Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers: []ServerConfig{
+			{ServerID: "busy", Command: "/bin/echo", MaxPendingRequests: 4},
+			{ServerID: "idle", Command: "/bin/echo", MaxPendingRequests: 4},
+			{ServerID: "unbounded", Command: "/bin/echo"},
+			{ServerID: "remote", Transport: "http", BaseURL: "http://127.0.0.1:1"},
+		},
+	}
+	gateway, err := NewGateway(cfg, NewLogger(ioDiscard{}), tracenoop.NewTracerProvider().Tracer("test"), meter, noopShutdown, noopShutdown)
+	if err != nil {
+		t.Fatalf("NewGateway failed: %v", err)
+	}
+	gateway.servers["busy"].beginActivity()
+	gateway.servers["busy"].beginActivity()
+	gateway.servers["unbounded"].beginActivity()
+	gateway.servers["unbounded"].beginActivity()
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, scope := range collected.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "brain.mcp.gateway.utilization" {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Gauge[float64]).DataPoints {
+				serverID, _ := point.Attributes.Value("server_id")
+				values[serverID.AsString()] = point.Value
+			}
+		}
+	}
+	want := map[string]float64{"busy": 0.5, "idle": 0, "unbounded": 1}
+	if !maps.Equal(values, want) {
+		t.Fatalf("expected utilization %v, got %v", want, values)
+	}
+}
+
+// TestObserveLatencySLOBreach warns once per cooldown when the rolling p95 exceeds latency_slo_ms.
+func TestObserveLatencySLOBreach(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", LatencySLOMS: 100}},
+	})
+	server := gateway.servers["unit"]
+	logs := &lockedBuffer{}
+	setLogger(server, NewLogger(logs))
+
+	for i := 0; i < sloMinSamples; i++ {
+		server.observeLatency(context.Background(), 10*time.Millisecond)
+	}
+	if strings.Contains(logs.String(), "server_slo_breached") {
+		t.Fatal("expected no breach while p95 is within the SLO")
+	}
+	for i := 0; i < sloMinSamples; i++ {
+		server.observeLatency(context.Background(), 500*time.Millisecond)
+	}
+	if count := strings.Count(logs.String(), `"event":"server_slo_breached"`); count != 1 {
+		t.Fatalf("expected exactly one breach log within the cooldown, got %d", count)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimSpace(logs.String())), &entry); err != nil {
+		t.Fatalf("decode log: %v", err)
+	}
+	if entry["p95_ms"] != float64(500) {
+		t.Fatalf("expected p95_ms 500, got %v", entry["p95_ms"])
+	}
+}
+
+// TestStartRetriesReadinessProbe keeps probing until the server answers ping successfully.
+func TestStartRetriesReadinessProbe(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "flaky-probe")
+	serverCfg.ReadinessProbe = true
+	serverCfg.ProbeIntervalMS = 10
+	serverCfg.StartupTimeoutMS = 5000
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	status := server.Status()
+	if status["status"] != "ready" {
+		t.Fatalf("expected ready, got %v", status["status"])
+	}
+	if status["probe_attempts"] != 3 {
+		t.Fatalf("expected 3 probe attempts, got %v", status["probe_attempts"])
+	}
+}
+
+// TestStartNetworkReadinessProbes waits on TCP and HTTP readiness before marking a server ready.
+func TestStartNetworkReadinessProbes(t *testing.T) {
+	t.Parallel()
+
+	var hits int
+	var hitsMu sync.Mutex
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitsMu.Lock()
+		defer hitsMu.Unlock()
+		hits++
+		if hits < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(httpServer.Close)
+
+	serverCfg := fakeServerConfig(t, "unit", "silent")
+	serverCfg.ReadinessTCP = httpServer.Listener.Addr().String()
+	serverCfg.ReadinessHTTP = httpServer.URL
+	serverCfg.ProbeIntervalMS = 10
+	serverCfg.StartupTimeoutMS = 5000
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	status := server.Status()
+	if status["status"] != "ready" || status["probe_attempts"] != 3 {
+		t.Fatalf("expected ready after 3 attempts, got %v after %v", status["status"], status["probe_attempts"])
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := closed.Addr().String()
+	_ = closed.Close()
+	failing := fakeServerConfig(t, "down", "silent")
+	failing.ReadinessTCP = addr
+	failing.ProbeIntervalMS = 10
+	failing.StartupTimeoutMS = 100
+	gateway = newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{failing}})
+	down := gateway.servers["down"]
+	killOnCleanup(t, down)
+	if err := down.Start(context.Background()); err == nil {
+		t.Fatal("expected tcp readiness probe to fail")
+	}
+	if status := down.Status()["status"]; status != "error" {
+		t.Fatalf("expected error status, got %v", status)
+	}
+}
+
+// TestReadMessageRejectsOversizedLine fails the call and kills a server that writes a line past max_line_bytes.
+func TestReadMessageRejectsOversizedLine(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		MaxLineBytes:   64 << 10,
+		Servers:        []ServerConfig{fakeServerConfig(t, "unit", "giant-line")},
+	})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	_, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`), "1")
+	if !errors.Is(err, errLineTooLong) {
+		t.Fatalf("expected line too long error, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Status()["status"] != "stopped" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status := server.Status()["status"]; status != "stopped" {
+		t.Fatalf("expected server to be killed, got %v", status)
+	}
+}
+
+// TestServerLastError records the last startup failure, serves it from the admin endpoint, and clears it on success.
+func TestServerLastError(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "silent")
+	serverCfg.ReadinessProbe = true
+	serverCfg.StartupTimeoutMS = 100
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, AdminEnabled: true, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+
+	if err := server.Start(context.Background()); err == nil {
+		t.Fatal("expected readiness probe error")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/servers/unit", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+	var status map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if lastError, _ := status["last_error"].(string); !strings.Contains(lastError, "probe_failed") {
+		t.Fatalf("expected probe failure in last_error, got %v", status["last_error"])
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Status()["pid"] != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	server.config().ReadinessProbe = false
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if lastError := server.Status()["last_error"]; lastError != "" {
+		t.Fatalf("expected last_error cleared after a successful start, got %v", lastError)
+	}
+}
+
+// TestServerEnvFile merges the env file into the child environment, re-reads it on restart, and lets inline env win.
+func TestServerEnvFile(t *testing.T) {
+	t.Parallel()
+
+	envFile := filepath.Join(t.TempDir(), "server.env")
+	writeEnv := func(contents string) {
+		if err := os.WriteFile(envFile, []byte(contents), 0o600); err != nil {
+			t.Fatalf("write env file: %v", err)
+		}
+	}
+	writeEnv("# secrets\nexport GATEWAY_FAKE_MARKER=\"from-file\"\n\nOTHER=1\n")
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.EnvFile = envFile
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+
+	marker := func() string {
+		t.Helper()
+		if err := server.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		response, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`), "1")
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		var reply struct {
+			Result struct {
+				Marker string `json:"marker"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(response, &reply); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		server.mu.Lock()
+		_ = server.cmd.Process.Kill()
+		server.mu.Unlock()
+		deadline := time.Now().Add(5 * time.Second)
+		for server.Status()["pid"] != 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return reply.Result.Marker
+	}
+
+	if got := marker(); got != "from-file" {
+		t.Fatalf("expected marker from env file, got %q", got)
+	}
+	writeEnv("GATEWAY_FAKE_MARKER=rotated\n")
+	if got := marker(); got != "rotated" {
+		t.Fatalf("expected rotated marker after restart, got %q", got)
+	}
+	server.config().Env["GATEWAY_FAKE_MARKER"] = "inline"
+	if got := marker(); got != "inline" {
+		t.Fatalf("expected inline env to win, got %q", got)
+	}
+
+	if err := os.Remove(envFile); err != nil {
+		t.Fatalf("remove env file: %v", err)
+	}
+	if err := server.Start(context.Background()); err == nil || !strings.Contains(err.Error(), envFile) {
+		t.Fatalf("expected missing env file error naming %s, got %v", envFile, err)
+	}
+}
+
+// TestServerIdleRecycle restarts an idle server outside its restart policy and logs the recycle.
+func TestServerIdleRecycle(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.StdioIdleRecycleMS = 100
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	setLogger(server, NewLogger(logs))
+	killOnCleanup(t, server)
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	firstPID := server.Status()["pid"]
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status := server.Status()
+		if status["status"] == "ready" && status["pid"] != 0 && status["pid"] != firstPID {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := server.Status()
+	if status["pid"] == firstPID || status["status"] != "ready" {
+		t.Fatalf("expected a recycled ready process, got %v", status)
+	}
+	if status["restart_count"] != 0 {
+		t.Fatalf("expected recycle to skip restart accounting, got %v", status["restart_count"])
+	}
+	if !strings.Contains(logs.String(), `"event":"mcp_server_recycled"`) {
+		t.Fatalf("expected mcp_server_recycled log, got %s", logs.String())
+	}
+	if _, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`), "1"); err != nil {
+		t.Fatalf("Call after recycle failed: %v", err)
+	}
+}
+
+// TestServerMaxLifetimeRecycle restarts servers past max_lifetime_ms one at a time, logging their age.
+func TestServerMaxLifetimeRecycle(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	var servers []ServerConfig
+	for _, id := range []string{"a", "b"} {
+		serverCfg := fakeServerConfig(t, id, "echo")
+		serverCfg.MaxLifetimeMS = 200
+		servers = append(servers, serverCfg)
+	}
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: servers})
+	gateway.logger = NewLogger(logs)
+	firstPIDs := make(map[string]int)
+	for id, server := range gateway.servers {
+		killOnCleanup(t, server)
+		if err := server.Start(context.Background()); err != nil {
+			t.Fatalf("Start %s failed: %v", id, err)
+		}
+		firstPIDs[id] = server.pid()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go gateway.recycleAged(ctx)
+
+	recycled := func() bool {
+		for id, server := range gateway.servers {
+			if server.pid() == firstPIDs[id] || server.currentStatus() != "ready" {
+				return false
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !recycled() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !recycled() {
+		t.Fatalf("expected both servers to be recycled, got %s", logs.String())
+	}
+
+	var events []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["event"] == "mcp_server_lifetime_recycle" {
+			events = append(events, entry)
+		}
+	}
+	if len(events) < 2 || events[0]["server_id"] == events[1]["server_id"] {
+		t.Fatalf("expected each server to be recycled in turn, got %v", events)
+	}
+	for _, event := range events {
+		if age, _ := event["age_ms"].(float64); age < 200 {
+			t.Fatalf("expected the logged age to reach max_lifetime_ms, got %v", event)
+		}
+	}
+}
+
+// TestServerWarmup runs the warmup requests before ready and only warns when one fails.
+func TestServerWarmup(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	serverCfg := fakeServerConfig(t, "unit", "flaky-probe")
+	serverCfg.Warmup = []json.RawMessage{json.RawMessage(`{"method":"ping"}`), json.RawMessage(`{"method":"tools/list"}`)}
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	setLogger(server, NewLogger(logs))
+	killOnCleanup(t, server)
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("expected a failed warmup request not to fail startup: %v", err)
+	}
+	if status := server.Status()["status"]; status != "ready" {
+		t.Fatalf("expected ready after warmup, got %v", status)
+	}
+	if count := strings.Count(logs.String(), `"event":"mcp_server_warmup_failed"`); count != 1 {
+		t.Fatalf("expected one warmup failure, got %d: %s", count, logs.String())
+	}
+	var complete map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if entry["event"] == "mcp_server_warmup_complete" {
+			complete = entry
+		}
+	}
+	if complete == nil || complete["requests"] != float64(2) || complete["failed"] != float64(1) {
+		t.Fatalf("expected mcp_server_warmup_complete with 2 requests and 1 failure, got %v", complete)
+	}
+}
+
+// TestServerLogFields tags every log line about a server with its log_fields.
+func TestServerLogFields(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", LogFields: map[string]any{"team": "search"}}},
+	})
+	gateway.logger = NewLogger(logs)
+	server := gateway.servers["unit"]
+	setLogger(server, gateway.logger.With(server.config().LogFields))
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = &lockedBuffer{}
+	server.decoder = json.NewDecoder(strings.NewReader(`{"jsonrpc":"2.0","id":1,"result":{}}` + "\n"))
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	gateway.routes().ServeHTTP(httptest.NewRecorder(), req)
+	gateway.logger.Log(context.Background(), "info", "gateway_unrelated", nil)
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		switch entry["event"] {
+		case "gateway_request_ok":
+			if entry["team"] != "search" {
+				t.Fatalf("expected team field on the request log, got %v", entry)
+			}
+		case "gateway_unrelated":
+			if _, ok := entry["team"]; ok {
+				t.Fatalf("expected gateway-wide logs to stay untagged, got %v", entry)
+			}
+		}
+	}
+	if !strings.Contains(logs.String(), `"event":"gateway_request_ok"`) {
+		t.Fatalf("expected a gateway_request_ok log, got %s", logs.String())
+	}
+}
+
+// TestServerStdinClosedRestarts kills and restarts a running child once writes to its stdin fail.
+func TestServerStdinClosedRestarts(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	noBackoff := 0
+	serverCfg := fakeServerConfig(t, "unit", "close-stdin")
+	serverCfg.RestartPolicy = "on-failure"
+	serverCfg.RestartBackoffMS = &noBackoff
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	setLogger(server, NewLogger(logs))
+	killOnCleanup(t, server)
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if _, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`), "1"); err != nil {
+		t.Fatalf("first Call failed: %v", err)
+	}
+	firstPID := server.Status()["pid"]
+	if _, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":2,"method":"ping"}`), "2"); !errors.Is(err, errStdinClosed) {
+		t.Fatalf("expected errStdinClosed, got %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status := server.Status()
+		if status["status"] == "ready" && status["pid"] != 0 && status["pid"] != firstPID {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := server.Status(); status["status"] != "ready" || status["pid"] == firstPID || status["restart_count"] != 1 {
+		t.Fatalf("expected a restarted ready process, got %v", status)
+	}
+	if !strings.Contains(logs.String(), `"reason":"stdin_closed"`) {
+		t.Fatalf("expected a stdin_closed restart reason, got %s", logs.String())
+	}
+}
+
+// TestRPCBatch answers every call in a batch in order, skipping notifications and flagging invalid elements.
+func TestRPCBatch(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, BatchConcurrency: 2, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	body := `[{"jsonrpc":"2.0","id":1,"method":"ping"},{"jsonrpc":"2.0","method":"notifications/initialized"},{"jsonrpc":"2.0","id":"b","method":"tools/list"},{"jsonrpc":"2.0","id":3}]`
+	req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var responses []struct {
+		ID     json.RawMessage `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("decode batch response %s: %v", rec.Body.String(), err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("expected 3 responses, got %s", rec.Body.String())
+	}
+	if string(responses[0].ID) != "1" || responses[0].Result == nil {
+		t.Fatalf("expected a result for id 1, got %s", rec.Body.String())
+	}
+	if string(responses[1].ID) != `"b"` || responses[1].Result == nil {
+		t.Fatalf("expected a result for id b, got %s", rec.Body.String())
+	}
+	if string(responses[2].ID) != "3" || responses[2].Error == nil || responses[2].Error.Code != -32600 {
+		t.Fatalf("expected -32600 for the element without a method, got %s", rec.Body.String())
+	}
+}
+
+// TestRPCBatchTooLarge rejects a batch over max_batch_size before any element is dispatched.
+func TestRPCBatchTooLarge(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		MaxBatchSize:   2,
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+
+	body := `[{"jsonrpc":"2.0","id":1,"method":"ping"},{"jsonrpc":"2.0","id":2,"method":"ping"},{"jsonrpc":"2.0","id":3,"method":"ping"}]`
+	req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "batch_too_large") {
+		t.Fatalf("expected 413 batch_too_large, got %d %s", rec.Code, rec.Body.String())
+	}
+	if status := gateway.servers["unit"].Status()["status"]; status != "stopped" {
+		t.Fatalf("expected the server to stay untouched, got %v", status)
+	}
+}
+
+// TestCapabilitiesEndpoint merges the remembered handshake and tool list of each ready server.
+func TestCapabilitiesEndpoint(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:            "secret",
+		AllowedClients:       []string{"127.0.0.1"},
+		CapabilitiesEndpoint: true,
+		Servers:              []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}, {ServerID: "idle", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	stdin, stdout := newReplyingStdio(t, func(method string) string {
+		if method == "initialize" {
+			return `{"protocolVersion":"2025-06-18","capabilities":{"tools":{}},"serverInfo":{"name":"unit"}}`
+		}
+		return `{"tools":[{"name":"search"}]}`
+	})
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.decoder = json.NewDecoder(stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+	serve(http.MethodPost, "/unit/rpc", `{"jsonrpc":"2.0","id":1,"method":"initialize"}`)
+	serve(http.MethodPost, "/unit/rpc", `{"jsonrpc":"2.0","id":2,"method":"tools/list"}`)
+
+	rec := serve(http.MethodGet, "/capabilities?tools=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	var document struct {
+		Servers map[string]struct {
+			ProtocolVersion string          `json:"protocol_version"`
+			Capabilities    json.RawMessage `json:"capabilities"`
+			Tools           []struct {
+				Name string `json:"name"`
+			} `json:"tools"`
+		} `json:"servers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &document); err != nil {
+		t.Fatalf("decode capabilities: %v", err)
+	}
+	if _, ok := document.Servers["idle"]; ok {
+		t.Fatalf("expected servers that are not ready to be left out, got %s", rec.Body.String())
+	}
+	unit, ok := document.Servers["unit"]
+	if !ok || unit.ProtocolVersion != "2025-06-18" || string(unit.Capabilities) != `{"tools":{}}` {
+		t.Fatalf("expected the unit handshake, got %s", rec.Body.String())
+	}
+	if len(unit.Tools) != 1 || unit.Tools[0].Name != "search" {
+		t.Fatalf("expected the unit tool list, got %s", rec.Body.String())
+	}
+}
+
+// TestRequestIDHeader falls back from the body id to the configured header and then the incoming trace id.
+func TestRequestIDHeader(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:          "secret",
+		AllowedClients:     []string{"127.0.0.1"},
+		RequestIDHeader:    "X-Correlation-Id",
+		RequestIDFromTrace: true,
+	})
+	cases := []struct {
+		name    string
+		body    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "body", body: `{"jsonrpc":"2.0","id":"abc","method":"ping"}`, headers: map[string]string{"X-Correlation-Id": "ignored"}, want: "abc"},
+		{name: "header", body: `{"jsonrpc":"2.0","method":"notifications/initialized"}`, headers: map[string]string{"X-Correlation-Id": "corr-1"}, want: "corr-1"},
+		{name: "trace", body: `{"jsonrpc":"2.0","method":"notifications/initialized"}`, headers: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, want: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "none", body: `{"jsonrpc":"2.0","method":"notifications/initialized"}`, want: ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/missing/rpc", strings.NewReader(tc.body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		for key, value := range tc.headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-Correlation-Id"); got != tc.want {
+			t.Fatalf("%s: expected X-Correlation-Id %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+// TestRestartCountResetsWhenStable clears the recent restart count after restart_reset_ms of readiness but keeps the total.
+func TestRestartCountResetsWhenStable(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		RestartResetMS: 1000,
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	server.mu.Lock()
+	server.status = "ready"
+	server.readySince = time.Now()
+	server.restartCount = 3
+	server.restartTotal = 3
+	server.mu.Unlock()
+
+	if status := server.Status(); status["restart_count"] != 3 {
+		t.Fatalf("expected restarts to count until the server is stable, got %v", status["restart_count"])
+	}
+	server.mu.Lock()
+	server.readySince = time.Now().Add(-2 * time.Second)
+	server.mu.Unlock()
+	status := server.Status()
+	if status["restart_count"] != 0 || status["restart_total"] != 3 {
+		t.Fatalf("expected restart_count 0 and restart_total 3, got %v and %v", status["restart_count"], status["restart_total"])
+	}
+}
+
+// TestStderrDropsWhenLoggingFallsBehind keeps reading stderr while the logger is blocked and accounts for every dropped line.
+func TestStderrDropsWhenLoggingFallsBehind(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:         "secret",
+		AllowedClients:    []string{"127.0.0.1"},
+		StderrBufferLines: 1,
+		Servers:           []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	logs := &gatedWriter{release: make(chan struct{})}
+	setLogger(server, NewLogger(logs))
+	const total = 100
+	server.stderr = io.NopCloser(strings.NewReader(strings.Repeat("noise\n", total)))
+
+	done := make(chan struct{})
+	go func() {
+		server.readStderr(context.Background())
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(logs.release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readStderr did not finish")
+	}
+
+	logged, dropped := 0, 0
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		switch entry["event"] {
+		case "mcp_server_stderr":
+			logged++
+		case "mcp_server_stderr_dropped":
+			dropped += int(entry["dropped"].(float64))
+		}
+	}
+	if dropped == 0 || logged+dropped != total {
+		t.Fatalf("expected %d lines split between logged and dropped, got %d logged and %d dropped", total, logged, dropped)
+	}
+}
+
+// gatedWriter blocks every write until release is closed.
+type gatedWriter struct {
+	release chan struct{}
+	lockedBuffer
+}
+
+// Write waits for release, then appends to the buffer.
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.lockedBuffer.Write(p)
+}
+
+// TestServerHooks runs post_start_hook once ready and pre_stop_hook on Stop with the server id and pid.
+func TestServerHooks(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.PostStartHook = []string{"/bin/sh", "-c", "echo started $MCP_SERVER_ID $MCP_SERVER_PID"}
+	serverCfg.PreStopHook = []string{"/bin/sh", "-c", "echo stopping $MCP_SERVER_ID; exit 3"}
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	setLogger(server, NewLogger(logs))
+	killOnCleanup(t, server)
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	want := fmt.Sprintf(`"output":"started unit %d"`, server.Status()["pid"])
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected post_start_hook output %s, got %s", want, logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.Close(context.Background())
+	if !strings.Contains(logs.String(), `"event":"mcp_server_hook_failed"`) || !strings.Contains(logs.String(), `"output":"stopping unit"`) {
+		t.Fatalf("expected a failed pre_stop_hook warning with its output, got %s", logs.String())
+	}
+}
+
+// TestLargeIntegerIDPreserved correlates and echoes an integer id beyond float64 precision exactly.
+func TestLargeIntegerIDPreserved(t *testing.T) {
+	t.Parallel()
+
+	const id = "10000000000000001"
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		JSONRPCErrors:  true,
+		Servers:        []ServerConfig{serverCfg, {ServerID: "down", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	for _, serverID := range []string{"unit", "down"} {
+		req := httptest.NewRequest(http.MethodPost, "/"+serverID+"/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":`+id+`,"method":"ping"}`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+
+		var response struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: decode response %s: %v", serverID, rec.Body.String(), err)
+		}
+		if string(response.ID) != id {
+			t.Fatalf("%s: expected id %s echoed exactly, got %s", serverID, id, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Request-Id"); got != id {
+			t.Fatalf("%s: expected X-Request-Id %s, got %q", serverID, id, got)
+		}
+	}
+}
+
+// TestLoadShedding rejects lower-priority servers past the high-water mark until load drops to the low-water mark.
+func TestLoadShedding(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		ShedHighWater:  2,
+		ShedLowWater:   1,
+		Servers:        []ServerConfig{{ServerID: "bulk", Command: "/bin/echo"}, {ServerID: "vital", Command: "/bin/echo", Priority: 10}},
+	})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"ping"}`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+	shedding := func() bool {
+		var health struct {
+			Shedding struct {
+				Active bool `json:"active"`
+			} `json:"shedding"`
+		}
+		if err := json.Unmarshal(serve(http.MethodGet, "/health").Body.Bytes(), &health); err != nil {
+			t.Fatalf("decode health: %v", err)
+		}
+		return health.Shedding.Active
+	}
+
+	ctx := context.Background()
+	gateway.shedder.enter(ctx)
+	gateway.shedder.enter(ctx)
+	if shedding() {
+		t.Fatal("expected no shedding at the high-water mark")
+	}
+	// The request itself pushes in-flight past the mark.
+	if rec := serve(http.MethodPost, "/bulk/rpc"); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "gateway_overloaded") {
+		t.Fatalf("expected 503 gateway_overloaded for the low-priority server, got %d %s", rec.Code, rec.Body.String())
+	}
+	if !shedding() {
+		t.Fatal("expected shedding to stay active above the low-water mark")
+	}
+	if rec := serve(http.MethodPost, "/vital/rpc"); strings.Contains(rec.Body.String(), "gateway_overloaded") {
+		t.Fatalf("expected the highest-priority server to be served, got %s", rec.Body.String())
+	}
+
+	gateway.shedder.leave(ctx)
+	if shedding() {
+		t.Fatal("expected shedding to stop at the low-water mark")
+	}
+	if rec := serve(http.MethodPost, "/bulk/rpc"); strings.Contains(rec.Body.String(), "gateway_overloaded") {
+		t.Fatalf("expected requests to be accepted again, got %s", rec.Body.String())
+	}
+}
+
+// TestLoadSheddingRequiresPriorities rejects shedding at load when every server has the same priority.
+func TestLoadSheddingRequiresPriorities(t *testing.T) {
+	t.Parallel()
+
+	cfgPath := writeTestConfig(t, map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"shed_high_water": 2,
+		"servers":         []map[string]any{{"server_id": "a", "command": "/bin/echo"}, {"server_id": "b", "command": "/bin/echo"}},
+	})
+	if _, err := loadConfig(cfgPath); err == nil || !strings.Contains(err.Error(), "priority") {
+		t.Fatalf("expected uniform priorities to be rejected with shed_high_water, got %v", err)
+	}
+}
+
+// TestServerScheduling applies nice and ioprio to the child and rejects out-of-range values at load.
+func TestServerScheduling(t *testing.T) {
+	t.Parallel()
+
+	for _, server := range []map[string]any{
+		{"server_id": "unit", "command": "/bin/echo", "nice": 20},
+		{"server_id": "unit", "command": "/bin/echo", "ioprio": "best-effort:8"},
+		{"server_id": "unit", "command": "/bin/echo", "ioprio": "idle:1"},
+	} {
+		cfgPath := writeTestConfig(t, map[string]any{
+			"auth_token":      "secret",
+			"allowed_clients": []string{"127.0.0.1"},
+			"servers":         []map[string]any{server},
+		})
+		if _, err := loadConfig(cfgPath); err == nil {
+			t.Fatalf("expected %v to be rejected", server)
+		}
+	}
+
+	if runtime.GOOS != "linux" {
+		t.Skip("reads the applied nice value from /proc")
+	}
+	logs := &lockedBuffer{}
+	nice := 7
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.Nice = &nice
+	serverCfg.IOPrio = "best-effort:6"
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	setLogger(server, NewLogger(logs))
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", server.Status()["pid"]))
+	if err != nil {
+		t.Fatalf("read stat: %v", err)
+	}
+	// Fields after the parenthesized command name start at field 3; nice is field 19.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if fields[16] != "7" {
+		t.Fatalf("expected nice 7, got %s", fields[16])
+	}
+	if !strings.Contains(logs.String(), `"event":"mcp_server_scheduling_applied"`) {
+		t.Fatalf("expected mcp_server_scheduling_applied, got %s", logs.String())
+	}
+}
+
+// TestSetNiceRenicesEveryThread renices threads a process started before setNice, not only its main thread.
+func TestSetNiceRenicesEveryThread(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("reads the applied nice value from /proc")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("resolve test executable: %v", err)
+	}
+	cmd := exec.Command(executable)
+	cmd.Env = append(os.Environ(), "GATEWAY_FAKE_SERVER=silent")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("stdin pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = stdin.Close()
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	// The Go runtime of the fake server starts worker threads of its own.
+	pattern := fmt.Sprintf("/proc/%d/task/*/stat", cmd.Process.Pid)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if stats, _ := filepath.Glob(pattern); len(stats) > 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the process to start more threads")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := setNice(cmd.Process.Pid, 9); err != nil {
+		t.Fatalf("setNice failed: %v", err)
+	}
+	stats, _ := filepath.Glob(pattern)
+	for _, path := range stats {
+		stat, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if fields[16] != "9" {
+			t.Fatalf("expected nice 9 for %s, got %s", path, fields[16])
+		}
+	}
+}
+
+// TestServerTransitionsLogged emits one mcp_server_transition per lifecycle status change.
+func TestServerTransitionsLogged(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{fakeServerConfig(t, "unit", "silent")}})
+	server := gateway.servers["unit"]
+	logs := &lockedBuffer{}
+	setLogger(server, NewLogger(logs))
+
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	server.mu.Lock()
+	cmd := server.cmd
+	server.mu.Unlock()
+	_ = cmd.Process.Kill()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Status()["status"] != "stopped" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var transitions []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if entry["event"] != "mcp_server_transition" {
+			continue
+		}
+		if entry["server_id"] != "unit" || entry["reason"] == "" {
+			t.Fatalf("incomplete transition entry: %v", entry)
+		}
+		transitions = append(transitions, fmt.Sprintf("%v->%v", entry["from"], entry["to"]))
+	}
+	want := []string{"stopped->starting", "starting->ready", "ready->stopped"}
+	if strings.Join(transitions, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected transitions %v, got %v", want, transitions)
+	}
+}
+
+// TestStartProbeDeadlineMarksError fails startup once the startup timeout elapses.
+func TestStartProbeDeadlineMarksError(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "silent")
+	serverCfg.ReadinessProbe = true
+	serverCfg.StartupTimeoutMS = 100
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+
+	if err := server.Start(context.Background()); err == nil {
+		t.Fatal("expected readiness probe error")
+	}
+	if status := server.Status()["status"]; status != "error" {
+		t.Fatalf("expected error status, got %v", status)
+	}
+
+	// A probe given up on has withdrawn its id by the time it returns.
+	gateway = newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}}})
+	server = gateway.servers["unit"]
+	stdoutReader, stdoutWriter := io.Pipe()
+	t.Cleanup(func() { _ = stdoutWriter.Close() })
+	server.mu.Lock()
+	server.stdin = &lockedBuffer{}
+	server.decoder = json.NewDecoder(stdoutReader)
+	server.pending = newPendingCalls()
+	pending := server.pending
+	server.mu.Unlock()
+	if _, err := server.probeOnce(context.Background(), "gateway-probe-1", "ping", nil, time.Now().Add(20*time.Millisecond)); !errors.Is(err, errProbeDeadline) {
+		t.Fatalf("expected the probe deadline, got %v", err)
+	}
+	pending.mu.Lock()
+	waiting := len(pending.waiters)
+	pending.mu.Unlock()
+	if waiting != 0 {
+		t.Fatalf("expected the probe's id to be withdrawn, got %d waiting", waiting)
+	}
+}
+
+// TestStartHandshake completes an initialize handshake before ready and fails the start when it times out.
+func TestStartHandshake(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.StartupHandshake = true
+	cfgPath := writeTestConfig(t, map[string]any{"auth_token": "secret", "allowed_clients": []string{"127.0.0.1"}, "servers": []ServerConfig{serverCfg}})
+	if _, err := loadConfig(cfgPath); err == nil || !strings.Contains(err.Error(), "cache_initialize") {
+		t.Fatalf("expected startup_handshake without cache_initialize to be rejected, got %v", err)
+	}
+	serverCfg.CacheInitialize = true
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	server.mu.Lock()
+	initializeResult := server.initializeResult
+	server.mu.Unlock()
+	if server.currentStatus() != "ready" || !strings.Contains(string(initializeResult), `"gateway-handshake"`) {
+		t.Fatalf("expected ready with the handshake kept, got %s %s", server.currentStatus(), initializeResult)
+	}
+
+	serverCfg = fakeServerConfig(t, "silent", "silent")
+	serverCfg.StartupHandshake = true
+	serverCfg.CacheInitialize = true
+	serverCfg.StartupTimeoutMS = 100
+	gateway = newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	silent := gateway.servers["silent"]
+	killOnCleanup(t, silent)
+	if err := silent.Start(context.Background()); err == nil {
+		t.Fatal("expected the unanswered handshake to fail the start")
+	}
+	if status := silent.Status(); status["status"] != "error" || !strings.Contains(fmt.Sprint(status["last_error"]), "handshake_failed") {
+		t.Fatalf("expected error status with handshake_failed, got %v %v", status["status"], status["last_error"])
+	}
+}
+
+// TestStartAutostartServersRequired fails only when a required autostart server cannot start.
+func TestStartAutostartServersRequired(t *testing.T) {
+	t.Parallel()
+
+	missing := ServerConfig{ServerID: "missing", Command: filepath.Join(t.TempDir(), "does-not-exist"), Autostart: true}
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{missing}})
+	if err := gateway.startAutostartServers(context.Background()); err != nil {
+		t.Fatalf("expected best-effort start for non-required server, got %v", err)
+	}
+
+	missing.Required = true
+	gateway = newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{missing}})
+	if err := gateway.startAutostartServers(context.Background()); err == nil {
+		t.Fatal("expected error for required server that failed to start")
+	}
+}
+
+// TestStartAutostartServersConcurrencyLimit never has more than max_concurrent_starts servers starting at once.
+func TestStartAutostartServersConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	active, peak := 0, 0
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer probe.Close()
+
+	var servers []ServerConfig
+	for _, id := range []string{"a", "b", "c", "d"} {
+		serverCfg := fakeServerConfig(t, id, "echo")
+		serverCfg.Autostart = true
+		serverCfg.ReadinessHTTP = probe.URL
+		servers = append(servers, serverCfg)
+	}
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, MaxConcurrentStarts: 2, Servers: servers})
+	for _, server := range gateway.servers {
+		killOnCleanup(t, server)
+	}
+
+	if err := gateway.startAutostartServers(context.Background()); err != nil {
+		t.Fatalf("startAutostartServers failed: %v", err)
+	}
+	for id, server := range gateway.servers {
+		if status := server.Status()["status"]; status != "ready" {
+			t.Fatalf("expected %s to be ready, got %v", id, status)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > 2 {
+		t.Fatalf("expected at most 2 concurrent starts, observed %d", peak)
+	}
+}
+
+// TestStartAutostartServersStartupDelay waits out startup_delay_ms and abandons the wait on shutdown.
+func TestStartAutostartServersStartupDelay(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.Autostart = true
+	serverCfg.StartupDelayMS = 150
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	killOnCleanup(t, gateway.servers["unit"])
+
+	start := time.Now()
+	if err := gateway.startAutostartServers(context.Background()); err != nil {
+		t.Fatalf("startAutostartServers failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("expected startup delay to be honored, started after %v", elapsed)
+	}
+	if status := gateway.servers["unit"].Status()["status"]; status != "ready" {
+		t.Fatalf("expected ready after the delay, got %v", status)
+	}
+
+	serverCfg.StartupDelayMS = 60000
+	gateway = newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	killOnCleanup(t, gateway.servers["unit"])
+	time.AfterFunc(50*time.Millisecond, gateway.beginShutdown)
+	start = time.Now()
+	if err := gateway.startAutostartServers(context.Background()); err != nil {
+		t.Fatalf("startAutostartServers failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected shutdown to cancel the delay, waited %v", elapsed)
+	}
+	if status := gateway.servers["unit"].Status()["status"]; status != "stopped" {
+		t.Fatalf("expected the delayed server to stay stopped, got %v", status)
+	}
+}
+
+// TestStartAutostartServersSelftest fails required servers that launch but never answer the self-test.
+func TestStartAutostartServersSelftest(t *testing.T) {
+	t.Parallel()
+
+	healthy := fakeServerConfig(t, "healthy", "echo")
+	healthy.Autostart = true
+	healthy.SelftestMethod = "tools/list"
+	silent := fakeServerConfig(t, "silent", "silent")
+	silent.Autostart = true
+	cfg := Config{
+		AuthToken:         "secret",
+		AllowedClients:    []string{"127.0.0.1"},
+		StartupSelftest:   true,
+		SelftestTimeoutMS: 100,
+		Servers:           []ServerConfig{healthy, silent},
+	}
+	gateway := newTestGateway(t, cfg)
+	for _, server := range gateway.servers {
+		killOnCleanup(t, server)
+	}
+	if err := gateway.startAutostartServers(context.Background()); err != nil {
+		t.Fatalf("expected best-effort self-test for non-required servers, got %v", err)
+	}
+	if status := gateway.servers["healthy"].Status()["status"]; status != "ready" {
+		t.Fatalf("expected healthy server ready, got %v", status)
+	}
+	if status := gateway.servers["silent"].Status()["status"]; status != "error" {
+		t.Fatalf("expected silent server marked error, got %v", status)
+	}
+
+	silent.Required = true
+	cfg.Servers = []ServerConfig{silent}
+	gateway = newTestGateway(t, cfg)
+	killOnCleanup(t, gateway.servers["silent"])
+	if err := gateway.startAutostartServers(context.Background()); err == nil {
+		t.Fatal("expected error for required server that failed self-test")
+	}
+}
+
+// TestRPCSpanStatusOnFailure marks failed requests as errored spans with the gateway error code.
+func TestRPCSpanStatusOnFailure(t *testing.T) {
+	t.Parallel()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	cfg := Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	}
+	gateway, err := NewGateway(cfg, NewLogger(ioDiscard{}), tracer, noop.NewMeterProvider().Meter("test"), noopShutdown, noopShutdown)
+	if err != nil {
+		t.Fatalf("NewGateway failed: %v", err)
+	}
+
+	requestBody := []byte(`{"server_id":"missing","payload":{"jsonrpc":"2.0","id":1,"method":"ping"}}`)
+	req := httptest.NewRequest(http.MethodPost, "/rpc", bytes.NewReader(requestBody))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Fatalf("expected error span status, got %v", spans[0].Status().Code)
+	}
+	found := false
+	for _, attr := range spans[0].Attributes() {
+		if attr == attribute.String("error_code", "server_not_found") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected error_code attribute, got %v", spans[0].Attributes())
+	}
+	if len(spans[0].Events()) == 0 {
+		t.Fatal("expected recorded error event")
+	}
+}
+
+// TestRPCNoHealthyInstances returns 503 with Retry-After when no instance of the server is running.
+func TestRPCNoHealthyInstances(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	gateway.servers["unit"].status = "error"
+
+	requestBody := []byte(`{"server_id":"unit","payload":{"jsonrpc":"2.0","id":1,"method":"ping"}}`)
+	req := httptest.NewRequest(http.MethodPost, "/rpc", bytes.NewReader(requestBody))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+	var resp GatewayResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Error == nil || resp.Error.ErrorCode != "no_healthy_instances" {
+		t.Fatalf("expected no_healthy_instances, got %+v", resp.Error)
+	}
+	if !strings.Contains(resp.Error.Message, "1 instance (error)") {
+		t.Fatalf("expected instance states in message, got %q", resp.Error.Message)
+	}
+}
+
+// TestJSONRPCErrorsTranslateTransportFailures returns call failures as JSON-RPC errors with the original id.
+func TestJSONRPCErrorsTranslateTransportFailures(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		JSONRPCErrors:  true,
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	payload := `{"jsonrpc":"2.0","id":"abc","method":"tools/list"}`
+
+	for _, route := range []struct{ path, body string }{
+		{"/unit/rpc", payload},
+		{"/rpc", `{"server_id":"unit","payload":` + payload + `}`},
+	} {
+		req := httptest.NewRequest(http.MethodPost, route.path, strings.NewReader(route.body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d %s", route.path, rec.Code, rec.Body.String())
+		}
+
+		body := rec.Body.Bytes()
+		if route.path == "/rpc" {
+			var envelope GatewayResponse
+			if err := json.Unmarshal(body, &envelope); err != nil {
+				t.Fatalf("decode envelope: %v", err)
+			}
+			body = envelope.Payload
+		}
+		var response struct {
+			ID    json.RawMessage `json:"id"`
+			Error struct {
+				Code int `json:"code"`
+				Data struct {
+					ErrorCode string `json:"error_code"`
+				} `json:"data"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if string(response.ID) != `"abc"` || response.Error.Code != -32003 || response.Error.Data.ErrorCode != "no_healthy_instances" {
+			t.Fatalf("%s: unexpected JSON-RPC error %s", route.path, body)
+		}
+	}
+}
+
+// TestWriteRawJSONCompaction minifies direct responses only when compact_responses is set.
+func TestWriteRawJSONCompaction(t *testing.T) {
+	t.Parallel()
+
+	pretty := json.RawMessage("{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 1,\n  \"result\": {}\n}")
+	for _, compact := range []bool{false, true} {
+		gateway := newTestGateway(t, Config{
+			AuthToken:        "secret",
+			AllowedClients:   []string{"127.0.0.1"},
+			CompactResponses: compact,
+			Servers:          []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+		})
+		rec := httptest.NewRecorder()
+		gateway.writeRawJSON(context.Background(), rec, http.StatusOK, pretty)
+
+		want := string(pretty)
+		if compact {
+			want = `{"jsonrpc":"2.0","id":1,"result":{}}`
+		}
+		if rec.Body.String() != want {
+			t.Fatalf("compact_responses=%v: expected %q, got %q", compact, want, rec.Body.String())
+		}
+	}
+}
+
+// TestMaxTotalConcurrentRequests rejects work beyond the gateway-wide limit with 503 gateway_busy.
+func TestMaxTotalConcurrentRequests(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:          "secret",
+		AllowedClients:     []string{"127.0.0.1"},
+		MaxTotalConcurrent: 1,
+		Servers:            []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	gateway.requestSlots <- struct{}{}
+
+	newRequest := func(method string) *http.Request {
+		req := httptest.NewRequest(method, "/unit/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"ping"}`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, newRequest(http.MethodPost))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "gateway_busy") {
+		t.Fatalf("expected 503 gateway_busy, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+
+	healthReq := httptest.NewRequest(http.MethodGet, "/health", nil)
+	healthReq.RemoteAddr = "127.0.0.1:1234"
+	healthReq.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, healthReq)
+	if rec.Code == http.StatusServiceUnavailable {
+		t.Fatal("expected GET requests to bypass the concurrency limit")
+	}
+
+	<-gateway.requestSlots
+	rec = httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, newRequest(http.MethodPost))
+	if strings.Contains(rec.Body.String(), "gateway_busy") {
+		t.Fatalf("expected request to proceed once a slot freed, got %s", rec.Body.String())
+	}
+	if len(gateway.requestSlots) != 0 {
+		t.Fatal("expected slot to be released after the request")
+	}
+}
+
+// TestServerTimingHeader reports queue, server, and total durations when server_timing is set.
+func TestServerTimingHeader(t *testing.T) {
+	t.Parallel()
+
+	for _, enabled := range []bool{false, true} {
+		gateway := newTestGateway(t, Config{
+			AuthToken:      "secret",
+			AllowedClients: []string{"127.0.0.1"},
+			ServerTiming:   enabled,
+			Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+		})
+		server := gateway.servers["unit"]
+		server.mu.Lock()
+		server.status = "ready"
+		server.stdin = &lockedBuffer{}
+		server.decoder = json.NewDecoder(strings.NewReader(`{"jsonrpc":"2.0","id":1,"result":{}}` + "\n"))
+		server.pending = newPendingCalls()
+		server.mu.Unlock()
+
+		req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body.String())
+		}
+
+		header := rec.Header().Get("Server-Timing")
+		if !enabled {
+			if header != "" {
+				t.Fatalf("expected no Server-Timing header, got %q", header)
+			}
+			continue
+		}
+		for _, metric := range []string{"queue;dur=", "server;dur=", "total;dur="} {
+			if !strings.Contains(header, metric) {
+				t.Fatalf("expected %s in Server-Timing header, got %q", metric, header)
+			}
+		}
+	}
+}
+
+// TestSpilledRequestBodyStreamsFromDisk forwards oversized bodies byte-for-byte and removes the temp file.
+func TestSpilledRequestBodyStreamsFromDisk(t *testing.T) {
+	spillDir := t.TempDir()
+	t.Setenv("TMPDIR", spillDir)
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:           "secret",
+		AllowedClients:      []string{"127.0.0.1"},
+		SpillThresholdBytes: 256,
+		Servers:             []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	stdin := &lockedBuffer{}
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.decoder = json.NewDecoder(strings.NewReader(`{"jsonrpc":"2.0","id":1,"result":{}}` + "\n"))
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	body := `{"jsonrpc":"2.0","params":{"id":"inner","blob":"` + strings.Repeat(`x\"}`, 4096) + `"},"id":7,"method":"tools/call"}`
+	head, err := skimMessage(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("skimMessage failed: %v", err)
+	}
+	if string(head) != `{"id":7,"jsonrpc":"2.0","method":"tools/call"}` {
+		t.Fatalf("unexpected envelope %s", head)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"id":7`) {
+		t.Fatalf("expected 200 for id 7, got %d %s", rec.Code, rec.Body.String())
+	}
+	// Only the id is swapped for the gateway's own; the rest is streamed as is.
+	if got, want := stdin.String(), strings.Replace(body, `"id":7`, `"id":1`, 1)+"\n"; got != want {
+		t.Fatalf("server received %d bytes, expected %d", len(got), len(want))
+	}
+	entries, err := os.ReadDir(spillDir)
+	if err != nil {
+		t.Fatalf("read spill dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected spill file to be removed, found %d entries", len(entries))
+	}
+}
+
+// TestSkimMessageBoundedPrefix reads a spilled body's envelope from its first spillHeadBytes only.
+func TestSkimMessageBoundedPrefix(t *testing.T) {
+	t.Parallel()
+
+	blob := strings.Repeat("x", spillHeadBytes)
+	head, err := skimMessage(strings.NewReader(`{"jsonrpc":"2.0","id":"a","method":"tools/call","params":{"blob":"` + blob + `"}}`))
+	if err != nil || string(head) != `{"id":"a","jsonrpc":"2.0","method":"tools/call"}` {
+		t.Fatalf("expected the envelope ahead of large params, got %s (%v)", head, err)
+	}
+	if head, err := skimMessage(strings.NewReader(`{"jsonrpc":"2.0","method":"notifications/progress"}`)); err != nil || string(head) != `{"jsonrpc":"2.0","method":"notifications/progress"}` {
+		t.Fatalf("expected a notification envelope, got %s (%v)", head, err)
+	}
+	if head, err := skimMessage(strings.NewReader(`{"jsonrpc":"2.0","id":"srv-1","result":{"blob":"` + blob + `"}}`)); err != nil || !isResponse(head) {
+		t.Fatalf("expected a response envelope ahead of a large result, got %s (%v)", head, err)
+	}
+	if _, err := skimMessage(strings.NewReader(`{"params":{"blob":"` + blob + `"},"id":"a","method":"tools/call"}`)); err == nil {
+		t.Fatal("expected an envelope past the prefix to be rejected")
+	}
+	if _, err := skimMessage(strings.NewReader(`["not","an","object"]`)); err == nil {
+		t.Fatal("expected a non-object body to be rejected")
+	}
+}
+
+// TestRecordDirWritesRedactedPairs appends one redacted request/response pair per call to the server's file.
+func TestRecordDirWritesRedactedPairs(t *testing.T) {
+	t.Parallel()
+
+	recordDir := filepath.Join(t.TempDir(), "recordings")
+	gateway := newTestGateway(t, Config{
+		AuthToken:        "secret",
+		AllowedClients:   []string{"127.0.0.1"},
+		RecordDir:        recordDir,
+		RecordRedactKeys: []string{"api_key"},
+		Servers:          []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = &lockedBuffer{}
+	server.decoder = json.NewDecoder(strings.NewReader(`{"jsonrpc":"2.0","id":1,"result":{"items":[{"api_key":"leak","n":12345678901234567890}]}}` + "\n"))
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	if _, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"arguments":{"api_key":"sk-123"}}}`), "1"); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if err := server.Send(context.Background(), []byte(`{"jsonrpc":"2.0","method":"notifications/initialized"}`)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(recordDir, "unit.jsonl"))
+	if err != nil {
+		t.Fatalf("read recording: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 recorded entries, got %d: %s", len(lines), data)
+	}
+	if strings.Contains(string(data), "sk-123") || strings.Contains(string(data), "leak") {
+		t.Fatalf("expected api_key values to be redacted: %s", data)
+	}
+	var call struct {
+		Request  map[string]any  `json:"request"`
+		Response json.RawMessage `json:"response"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &call); err != nil {
+		t.Fatalf("decode entry: %v", err)
+	}
+	if call.Request["method"] != "tools/call" || !strings.Contains(string(call.Response), "12345678901234567890") {
+		t.Fatalf("unexpected recorded pair: %s", lines[0])
+	}
+	if strings.Contains(lines[1], `"response"`) {
+		t.Fatalf("expected no response for a notification: %s", lines[1])
+	}
+}
+
+// TestShutdownClosesEventStreams sends a final shutdown event to open streams and refuses new ones.
+func TestShutdownClosesEventStreams(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	listener := httptest.NewServer(gateway.routes())
+	defer listener.Close()
+
+	openStream := func() *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, listener.URL+"/unit/rpc", nil)
+		if err != nil {
+			t.Fatalf("build request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("open stream: %v", err)
+		}
+		return resp
+	}
+
+	resp := openStream()
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if line, err := reader.ReadString('\n'); err != nil || line != ": ok\n" {
+		t.Fatalf("expected stream preamble, got %q (%v)", line, err)
+	}
+
+	gateway.beginShutdown()
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	if !strings.Contains(string(rest), "event: shutdown\n") {
+		t.Fatalf("expected shutdown event, got %q", rest)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gateway.drainStreams(ctx); err != nil {
+		t.Fatalf("expected streams to drain: %v", err)
+	}
+
+	late := openStream()
+	defer late.Body.Close()
+	if late.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for a stream opened during shutdown, got %d", late.StatusCode)
+	}
+}
+
+// TestLandingPageNegotiation serves JSON by default and HTML to browsers at the root path.
+func TestLandingPageNegotiation(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	handler := gateway.routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unmarshal landing page: %v", err)
+	}
+	if body["service"] != serviceName || body["version"] != serviceVersion {
+		t.Fatalf("unexpected landing page: %v", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Fatalf("expected html content type, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected landing page to require auth, got %d", rec.Code)
+	}
+}
+
+// TestServerStdinAdminEndpoint writes raw lines to the child only when admin is enabled.
+func TestServerStdinAdminEndpoint(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	}
+	gateway := newTestGateway(t, cfg)
+	req := httptest.NewRequest(http.MethodPost, "/servers/unit/stdin", bytes.NewReader([]byte("diagnose")))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 with admin disabled, got %d", rec.Code)
+	}
+
+	cfg.AdminEnabled = true
+	gateway = newTestGateway(t, cfg)
+	server := gateway.servers["unit"]
+	stdin := &bytes.Buffer{}
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = nopWriteCloser{Buffer: stdin}
+	server.mu.Unlock()
+
+	req = httptest.NewRequest(http.MethodPost, "/servers/unit/stdin", bytes.NewReader([]byte("diagnose")))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+	if stdin.String() != "diagnose\n" {
+		t.Fatalf("unexpected stdin contents %q", stdin.String())
+	}
+}
+
+// TestCallInitializeCached answers repeat initialize calls from the cached handshake.
+func TestCallInitializeCached(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", CacheInitialize: true}},
+	})
+	server := gateway.servers["unit"]
+
+	responsePayload := []byte(`{"jsonrpc":"2.0","id":1,"result":{"capabilities":{"tools":{}}}}`)
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = nopWriteCloser{Buffer: &bytes.Buffer{}}
+	server.decoder = json.NewDecoder(bytes.NewReader(append(responsePayload, '\n')))
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	first, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"initialize"}`), "1")
+	if err != nil {
+		t.Fatalf("first initialize failed: %v", err)
+	}
+	if !bytes.Equal(first, responsePayload) {
+		t.Fatalf("unexpected first response: %s", first)
+	}
+
+	second, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":"again","method":"initialize"}`), "again")
+	if err != nil {
+		t.Fatalf("cached initialize failed: %v", err)
+	}
+	var decoded map[string]json.RawMessage
+	if err := json.Unmarshal(second, &decoded); err != nil {
+		t.Fatalf("unmarshal cached response: %v", err)
+	}
+	if string(decoded["id"]) != `"again"` {
+		t.Fatalf("expected cached response to carry caller id, got %s", decoded["id"])
+	}
+	if string(decoded["result"]) != `{"capabilities":{"tools":{}}}` {
+		t.Fatalf("unexpected cached result: %s", decoded["result"])
+	}
+}
+
+// TestServerPauseResume rejects calls while paused and accepts them again after resume.
+func TestServerPauseResume(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		AdminEnabled:   true,
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	handler := gateway.routes()
+
+	adminRequest := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := adminRequest("/servers/unit/pause")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from pause, got %d", rec.Code)
+	}
+	var status map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("unmarshal status: %v", err)
+	}
+	if status["paused"] != true {
+		t.Fatalf("expected paused status, got %v", status["paused"])
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/unit/rpc", bytes.NewReader([]byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`)))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rpcRec := httptest.NewRecorder()
+	handler.ServeHTTP(rpcRec, req)
+	if rpcRec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while paused, got %d", rpcRec.Code)
+	}
+
+	if rec := adminRequest("/servers/unit/resume"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from resume, got %d", rec.Code)
+	}
+	if server.isPaused() {
+		t.Fatal("expected server to be resumed")
+	}
+}
+
+// TestServerLifecycleEndpoints starts, stops, and restarts a server through the admin API.
+func TestServerLifecycleEndpoints(t *testing.T) {
+	t.Parallel()
+
+	cfg := fakeServerConfig(t, "unit", "echo")
+	cfg.RestartPolicy = "always"
+	gateway := newTestGateway(t, Config{
+		AuthToken:        "secret",
+		AllowedClients:   []string{"127.0.0.1"},
+		AdminEnabled:     true,
+		RestartBackoffMS: 1,
+		Servers:          []ServerConfig{cfg},
+	})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	handler := gateway.routes()
+
+	adminRequest := func(path string) (int, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var status map[string]any
+		_ = json.Unmarshal(rec.Body.Bytes(), &status)
+		return rec.Code, status
+	}
+
+	code, status := adminRequest("/servers/unit/start")
+	if code != http.StatusOK || status["status"] != "ready" {
+		t.Fatalf("expected start to report ready, got %d %v", code, status)
+	}
+	firstPID := server.pid()
+
+	code, status = adminRequest("/servers/unit/restart")
+	if code != http.StatusOK || status["status"] != "ready" || server.pid() == firstPID {
+		t.Fatalf("expected restart to bring up a new process, got %d %v", code, status)
+	}
+
+	code, status = adminRequest("/servers/unit/stop")
+	if code != http.StatusOK || status["status"] != "stopped" {
+		t.Fatalf("expected stop to report stopped, got %d %v", code, status)
+	}
+	// The restart policy would have started it again by now.
+	time.Sleep(200 * time.Millisecond)
+	if got := server.currentStatus(); got != "stopped" {
+		t.Fatalf("expected the server to stay stopped, got %s", got)
+	}
+
+	if code, body := adminRequest("/servers/missing/stop"); code != http.StatusNotFound || body["error"].(map[string]any)["error_code"] != "server_not_found" {
+		t.Fatalf("expected 404 server_not_found for an unknown server, got %d %v", code, status)
+	}
+}
+
+// TestServerPauseQueuePolicy holds calls until the server is resumed.
+func TestServerPauseQueuePolicy(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", PausePolicy: "queue"}},
+	})
+	server := gateway.servers["unit"]
+	server.Pause()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.waitIfPaused(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected queued call to wait, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	server.Resume()
+	if err := <-done; err != nil {
+		t.Fatalf("expected queued call to proceed after resume, got %v", err)
+	}
+}
+
+// TestMethodTimeoutOverride applies the per-method timeout instead of request_timeout_ms and records it on the span.
+func TestMethodTimeoutOverride(t *testing.T) {
+	t.Parallel()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	cfg := Config{
+		AuthToken:        "secret",
+		AllowedClients:   []string{"127.0.0.1"},
+		RequestTimeoutMS: 30000,
+		Servers:          []ServerConfig{{ServerID: "unit", Command: "/bin/echo", MethodTimeoutsMS: map[string]int{"tools/list": 50}}},
+	}
+	gateway, err := NewGateway(cfg, NewLogger(ioDiscard{}), tracer, noop.NewMeterProvider().Meter("test"), noopShutdown, noopShutdown)
+	if err != nil {
+		t.Fatalf("NewGateway failed: %v", err)
+	}
+	server := gateway.servers["unit"]
+	if got := server.timeoutFor([]byte(`{"jsonrpc":"2.0","id":1,"method":"tools/call"}`)); got != 30*time.Second {
+		t.Fatalf("expected request_timeout_ms fallback for tools/call, got %v", got)
+	}
+
+	silentReader, silentWriter := io.Pipe()
+	t.Cleanup(func() { _ = silentWriter.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = &lockedBuffer{}
+	server.stdout = bufio.NewReader(silentReader)
+	server.decoder = json.NewDecoder(server.stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	gateway.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusGatewayTimeout || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected a prompt 504, got %d after %v", rec.Code, time.Since(start))
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if !slices.Contains(spans[0].Attributes(), attribute.Int64("timeout_ms", 50)) {
+		t.Fatalf("expected timeout_ms attribute, got %v", spans[0].Attributes())
+	}
+}
+
+// TestMaxPendingRequestsFailsFast rejects calls beyond max_pending_requests while the server is stalled.
+func TestMaxPendingRequestsFailsFast(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:        "secret",
+		AllowedClients:   []string{"127.0.0.1"},
+		RequestTimeoutMS: 30000,
+		Servers:          []ServerConfig{{ServerID: "unit", Command: "/bin/echo", MaxPendingRequests: 1}},
+	})
+	server := gateway.servers["unit"]
+	silentReader, silentWriter := io.Pipe()
+	t.Cleanup(func() { _ = silentWriter.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = &lockedBuffer{}
+	server.stdout = bufio.NewReader(silentReader)
+	server.decoder = json.NewDecoder(server.stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stalled := make(chan error, 1)
+	go func() {
+		_, err := server.Call(ctx, []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/call"}`), "1")
+		stalled <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.settings.Load().pendingSlots) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	_, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":2,"method":"tools/call"}`), "2")
+	if !errors.Is(err, errServerBusy) {
+		t.Fatalf("expected errServerBusy, got %v", err)
+	}
+	if status, code := classifyCallError(err); status != http.StatusServiceUnavailable || code != "server_busy" {
+		t.Fatalf("expected 503 server_busy, got %d %s", status, code)
+	}
+
+	cancel()
+	<-stalled
+	if len(server.settings.Load().pendingSlots) != 0 {
+		t.Fatal("expected the pending slot to be released")
+	}
+}
+
+// TestCallTimeouts reports which of the first-byte and overall timeouts tripped.
+func TestCallTimeouts(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:          "secret",
+		AllowedClients:     []string{"127.0.0.1"},
+		FirstByteTimeoutMS: 20,
+		Servers:            []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+
+	silentReader, silentWriter := io.Pipe()
+	t.Cleanup(func() { _ = silentWriter.Close() })
+	server.mu.Lock()
+	server.stdin = nopWriteCloser{Buffer: &bytes.Buffer{}}
+	server.stdout = bufio.NewReader(silentReader)
+	server.decoder = json.NewDecoder(server.stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	ctx, cancel := context.WithTimeoutCause(context.Background(), time.Second, errRequestTimeout)
+	defer cancel()
+	if _, err := server.call(ctx, []byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`), "1"); !errors.Is(err, errFirstByteTimeout) {
+		t.Fatalf("expected first byte timeout, got %v", err)
+	}
+
+	partialReader, partialWriter := io.Pipe()
+	t.Cleanup(func() { _ = partialWriter.Close() })
+	go func() {
+		_, _ = partialWriter.Write([]byte(`{"jsonrpc":`))
+	}()
+	server.mu.Lock()
+	server.stdout = bufio.NewReader(partialReader)
+	server.decoder = json.NewDecoder(server.stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	ctx, cancel = context.WithTimeoutCause(context.Background(), 100*time.Millisecond, errRequestTimeout)
+	defer cancel()
+	if _, err := server.call(ctx, []byte(`{"jsonrpc":"2.0","id":2,"method":"ping"}`), "2"); !errors.Is(err, errRequestTimeout) {
+		t.Fatalf("expected request timeout, got %v", err)
+	}
+}
+
+// TestConcurrentCallsMatchByID hands each concurrent call the response carrying its id, whatever order they arrive in.
+func TestConcurrentCallsMatchByID(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	setLogger(server, NewLogger(logs))
+	stdin := &lockedBuffer{}
+	stdoutReader, stdoutWriter := io.Pipe()
+	t.Cleanup(func() { _ = stdoutWriter.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.decoder = json.NewDecoder(stdoutReader)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	const calls = 10
+	errs := make(chan error, calls)
+	for id := range calls {
+		go func() {
+			payload, err := server.Call(context.Background(), []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"ping","params":{"n":%d}}`, id, id)), fmt.Sprint(id))
+			if err == nil && (!strings.Contains(string(payload), fmt.Sprintf(`"result":{"n":%d}`, id)) || !strings.Contains(string(payload), fmt.Sprintf(`"id":%d`, id))) {
+				err = fmt.Errorf("call %d got %s", id, payload)
+			}
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(stdin.String(), "\n") < calls && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if count := strings.Count(stdin.String(), "\n"); count != calls {
+		t.Fatalf("expected %d requests written concurrently, got %d", calls, count)
+	}
+
+	_, _ = io.WriteString(stdoutWriter, `{"jsonrpc":"2.0","id":99,"result":{}}`+"\n")
+	lines := strings.Split(strings.TrimSpace(stdin.String()), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		var request struct {
+			ID     json.RawMessage `json:"id"`
+			Params struct {
+				N int `json:"n"`
+			} `json:"params"`
+		}
+		_ = json.Unmarshal([]byte(lines[i]), &request)
+		_, _ = fmt.Fprintf(stdoutWriter, `{"jsonrpc":"2.0","id":%s,"result":{"n":%d}}`+"\n", request.ID, request.Params.N)
+	}
+	for range calls {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(logs.String(), `"event":"mcp_server_unmatched_response"`) {
+		t.Fatalf("expected the response without a caller to be logged, got %s", logs.String())
+	}
+}
+
+// TestReusedIDAfterTimeout keeps a late answer to a timed-out call from reaching the next call with the same id.
+func TestReusedIDAfterTimeout(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	stdin := &lockedBuffer{}
+	stdoutReader, stdoutWriter := io.Pipe()
+	t.Cleanup(func() { _ = stdoutWriter.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.decoder = json.NewDecoder(stdoutReader)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	request := []byte(`{"jsonrpc":"2.0","id":7,"method":"tools/call"}`)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := server.Call(ctx, request, "7"); err == nil {
+		t.Fatal("expected the first call to time out")
+	}
+
+	returned := make(chan serverResponse, 1)
+	go func() {
+		payload, err := server.Call(context.Background(), request, "7")
+		returned <- serverResponse{payload: payload, err: err}
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(stdin.String(), "\n") < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// The first call's request, its cancellation, and the second call's request.
+	lines := strings.Split(strings.TrimSpace(stdin.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected two requests and a cancellation, got %q", lines)
+	}
+	first, second := rawRequestID([]byte(lines[0])), rawRequestID([]byte(lines[2]))
+	if string(first) == string(second) {
+		t.Fatalf("expected the calls to reach the server under different ids, got %s twice", first)
+	}
+	_, _ = fmt.Fprintf(stdoutWriter, `{"jsonrpc":"2.0","id":%s,"result":{"call":"first"}}`+"\n", first)
+	_, _ = fmt.Fprintf(stdoutWriter, `{"jsonrpc":"2.0","id":%s,"result":{"call":"second"}}`+"\n", second)
+
+	select {
+	case resp := <-returned:
+		if resp.err != nil || !strings.Contains(string(resp.payload), `"call":"second"`) || !strings.Contains(string(resp.payload), `"id":7`) {
+			t.Fatalf("expected the second call's own answer under id 7, got %s (%v)", resp.payload, resp.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the second call to be answered")
+	}
+}
+
+// TestNewTraceSampler resolves the sampler from config first, then the OTEL environment.
+func TestNewTraceSampler(t *testing.T) {
+	t.Parallel()
+
+	env := func(values map[string]string) func(string) string {
+		return func(key string) string { return values[key] }
+	}
+
+	ratio := 0.25
+	sampler, err := newTraceSampler(&ratio, env(map[string]string{"OTEL_TRACES_SAMPLER": "always_off"}))
+	if err != nil {
+		t.Fatalf("newTraceSampler failed: %v", err)
+	}
+	if want := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0.25)).Description(); sampler.Description() != want {
+		t.Fatalf("expected config ratio to win, got %q", sampler.Description())
+	}
+
+	sampler, err = newTraceSampler(nil, env(nil))
+	if err != nil {
+		t.Fatalf("newTraceSampler failed: %v", err)
+	}
+	if want := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(1)).Description(); sampler.Description() != want {
+		t.Fatalf("expected parent-based ratio default, got %q", sampler.Description())
+	}
+
+	sampler, err = newTraceSampler(nil, env(map[string]string{"OTEL_TRACES_SAMPLER": "traceidratio", "OTEL_TRACES_SAMPLER_ARG": "0.1"}))
+	if err != nil {
+		t.Fatalf("newTraceSampler failed: %v", err)
+	}
+	if want := sdktrace.TraceIDRatioBased(0.1).Description(); sampler.Description() != want {
+		t.Fatalf("expected env ratio sampler, got %q", sampler.Description())
+	}
+
+	if _, err := newTraceSampler(nil, env(map[string]string{"OTEL_TRACES_SAMPLER": "traceidratio", "OTEL_TRACES_SAMPLER_ARG": "2"})); err == nil {
+		t.Fatal("expected invalid sampler arg error")
+	}
+	if _, err := newTraceSampler(nil, env(map[string]string{"OTEL_TRACES_SAMPLER": "sometimes"})); err == nil {
+		t.Fatal("expected unsupported sampler error")
+	}
+}
+
+// TestRecentRequestsRing records RPC summaries and serves the newest first.
+func TestRecentRequestsRing(t *testing.T) {
+	t.Parallel()
+
+	ring := newRequestRing(2)
+	ring.Add(requestSummary{RequestID: "1"})
+	ring.Add(requestSummary{RequestID: "2"})
+	ring.Add(requestSummary{RequestID: "3"})
+	recent := ring.Recent(0)
+	if len(recent) != 2 || recent[0].RequestID != "3" || recent[1].RequestID != "2" {
+		t.Fatalf("unexpected ring contents: %+v", recent)
+	}
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		AdminEnabled:   true,
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	handler := gateway.routes()
+
+	req := httptest.NewRequest(http.MethodPost, "/rpc", bytes.NewReader([]byte(`{"server_id":"missing","payload":{"jsonrpc":"2.0","id":7,"method":"tools/list","params":{"secret":"x"}}}`)))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/requests/recent?n=5", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if bytes.Contains(rec.Body.Bytes(), []byte("secret")) {
+		t.Fatalf("expected payload to be redacted, got %s", rec.Body.String())
+	}
+
+	var body struct {
+		Requests []requestSummary `json:"requests"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unmarshal recent requests: %v", err)
+	}
+	if len(body.Requests) != 1 {
+		t.Fatalf("expected 1 recent request, got %d", len(body.Requests))
+	}
+	entry := body.Requests[0]
+	if entry.ServerID != "missing" || entry.Method != "tools/list" || entry.RequestID != "7" || entry.Status != http.StatusNotFound {
+		t.Fatalf("unexpected summary: %+v", entry)
+	}
+}
+
+// TestInitializeConflictPolicies rejects or rotates sessions on a duplicate initialize.
+func TestInitializeConflictPolicies(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(policy string) *ManagedServer {
+		gateway := newTestGateway(t, Config{
+			AuthToken:      "secret",
+			AllowedClients: []string{"127.0.0.1"},
+			Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", InitializeConflict: policy}},
+		})
+		return gateway.servers["unit"]
+	}
+	withSession := func(sessionID string) context.Context {
+		return context.WithValue(context.Background(), sessionIDKey{}, sessionID)
+	}
+
+	server := newServer("reject")
+	if err := server.beginInitialize(withSession("")); err != nil {
+		t.Fatalf("first initialize rejected: %v", err)
+	}
+	if err := server.beginInitialize(withSession("")); !errors.Is(err, errSessionConflict) {
+		t.Fatalf("expected concurrent initialize conflict, got %v", err)
+	}
+	server.finishInitialize(context.Background(), true)
+	sessionID := server.ensureSessionID()
+	if err := server.beginInitialize(withSession("other")); !errors.Is(err, errSessionConflict) {
+		t.Fatalf("expected duplicate initialize conflict, got %v", err)
+	}
+	if err := server.beginInitialize(withSession(sessionID)); err != nil {
+		t.Fatalf("expected owning session to re-initialize, got %v", err)
+	}
+	server.finishInitialize(context.Background(), true)
+
+	server = newServer("rotate")
+	_ = server.beginInitialize(withSession(""))
+	server.finishInitialize(context.Background(), true)
+	first := server.ensureSessionID()
+	_ = server.beginInitialize(withSession(""))
+	server.finishInitialize(context.Background(), true)
+	if second := server.ensureSessionID(); second == first {
+		t.Fatal("expected session id to rotate on re-initialize")
+	}
+}
+
+// TestStrictSessionsRejectUnknownSessionIDs answers 404 session_not_found for unknown or expired session ids.
+func TestStrictSessionsRejectUnknownSessionIDs(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		StrictSessions: true,
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	server.finishInitialize(context.Background(), true)
+	sessionID := server.ensureSessionID()
+
+	send := func(sessionID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(`{"server_id":"unit","payload":{"jsonrpc":"2.0","method":"notifications/initialized"}}`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		if sessionID != "" {
+			req.Header.Set("MCP-Session-Id", sessionID)
+		}
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("stale"); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "session_not_found") {
+		t.Fatalf("expected 404 session_not_found, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = &lockedBuffer{}
+	server.mu.Unlock()
+	for _, id := range []string{sessionID, ""} {
+		if rec := send(id); rec.Code != http.StatusAccepted {
+			t.Fatalf("session %q: expected 202, got %d %s", id, rec.Code, rec.Body.String())
+		}
+	}
+
+	server.mu.Lock()
+	server.sessionInitialized = false
+	server.mu.Unlock()
+	if rec := send(sessionID); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected expired session to be rejected, got %d", rec.Code)
+	}
+}
+
+// TestReadMessageSkipsNonJSONLines recovers from stray stdout lines and logs each skip.
+func TestReadMessageSkipsNonJSONLines(t *testing.T) {
+	t.Parallel()
+
+	logs := &bytes.Buffer{}
+	cfg := Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	}
+	gateway, err := NewGateway(cfg, NewLogger(logs), tracenoop.NewTracerProvider().Tracer("test"), noop.NewMeterProvider().Meter("test"), noopShutdown, noopShutdown)
+	if err != nil {
+		t.Fatalf("NewGateway failed: %v", err)
+	}
+	server := gateway.servers["unit"]
+
+	stdout := bufio.NewReader(strings.NewReader("starting up\n42 tools loaded\n{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{}}\n"))
+	server.mu.Lock()
+	server.stdin = nopWriteCloser{Buffer: &bytes.Buffer{}}
+	server.stdout = stdout
+	server.decoder = json.NewDecoder(server.stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	response, err := server.call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`), "1")
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	if string(response) != `{"jsonrpc":"2.0","id":1,"result":{}}` {
+		t.Fatalf("unexpected response: %s", response)
+	}
+	if count := strings.Count(logs.String(), "mcp_server_decode_error"); count < 2 {
+		t.Fatalf("expected decode errors to be logged for both stray lines, got %d", count)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.stdout != stdout {
+		t.Fatal("expected resyncs to keep reading from the original stdout reader")
+	}
+}
+
+// TestOrderedDelivery holds a response back until the notification the server sent before it has been written to the stream.
+func TestOrderedDelivery(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", OrderedDelivery: true}},
+	})
+	server := gateway.servers["unit"]
+	stdout, serverOut := io.Pipe()
+	t.Cleanup(func() { _ = serverOut.Close() })
+	server.mu.Lock()
+	server.stdin = nopWriteCloser{Buffer: &bytes.Buffer{}}
+	server.stdout = bufio.NewReader(stdout)
+	server.decoder = json.NewDecoder(server.stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+	subscriber := server.subscribe("")
+	defer server.unsubscribe("", subscriber)
+
+	returned := make(chan serverResponse, 1)
+	go func() {
+		payload, err := server.call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/call"}`), "1")
+		returned <- serverResponse{payload: payload, err: err}
+	}()
+	go func() {
+		_, _ = io.WriteString(serverOut, `{"jsonrpc":"2.0","method":"notifications/progress"}`+"\n"+`{"jsonrpc":"2.0","id":1,"result":{}}`+"\n")
+	}()
+
+	var message streamMessage
+	select {
+	case message = <-subscriber.messages:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the notification on the stream")
+	}
+	select {
+	case resp := <-returned:
+		t.Fatalf("expected the response to wait for the stream, call returned %s", resp.payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(message.written)
+	select {
+	case resp := <-returned:
+		if resp.err != nil || !strings.Contains(string(resp.payload), `"result"`) {
+			t.Fatalf("expected the response after the notification, got %s (%v)", resp.payload, resp.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the response once the notification was written")
+	}
+}
+
+// TestAdminBindSplitsRoutes serves admin routes only on the admin listener with its own allowlist.
+func TestAdminBindSplitsRoutes(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"10.0.0.0/8"},
+		AdminBind:      "127.0.0.1:7412",
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+
+	serve := func(handler http.Handler, remote string) int {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve(gateway.routes(), "10.0.0.1:1234"); code != http.StatusNotFound {
+		t.Fatalf("expected /health to be absent from the RPC listener, got %d", code)
+	}
+	if code := serve(gateway.adminRoutes(), "127.0.0.1:1234"); code != http.StatusOK {
+		t.Fatalf("expected /health on the admin listener, got %d", code)
+	}
+	if code := serve(gateway.adminRoutes(), "10.0.0.1:1234"); code != http.StatusForbidden {
+		t.Fatalf("expected admin allowlist to reject RPC clients, got %d", code)
+	}
+}
+
+// TestShutdownDrainsCallsBeforeStoppingServers answers in-flight calls, then stops children and flushes telemetry.
+func TestShutdownDrainsCallsBeforeStoppingServers(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		close(received)
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":{}}`, rawRequestID(body))
+	}))
+	t.Cleanup(upstream.Close)
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers: []ServerConfig{
+			{ServerID: "remote", Transport: "http", BaseURL: upstream.URL},
+			fakeServerConfig(t, "unit", "echo"),
+		},
+	})
+	child := gateway.servers["unit"]
+	killOnCleanup(t, child)
+	if err := child.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	var flushedAfter string
+	gateway.shutdownTrace = func(context.Context) error {
+		flushedAfter = child.currentStatus()
+		return nil
+	}
+	listener := httptest.NewServer(gateway.routes())
+	t.Cleanup(listener.Close)
+
+	answered := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, listener.URL+"/remote/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/call"}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			answered <- 0
+			return
+		}
+		resp.Body.Close()
+		answered <- resp.StatusCode
+	}()
+	<-received
+	gateway.shutdown(context.Background(), []*http.Server{listener.Config})
+
+	// A call cancelled by the shutdown would have failed with 503.
+	select {
+	case code := <-answered:
+		if code != http.StatusOK {
+			t.Fatalf("expected the in-flight call to finish with 200, got %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the in-flight call to be answered")
+	}
+	if flushedAfter != "stopped" {
+		t.Fatalf("expected telemetry to be flushed after the child stopped, got %q", flushedAfter)
+	}
+	if gateway.lifetime.Err() == nil {
+		t.Fatal("expected the gateway lifetime to end")
+	}
+}
+
+// TestShutdownCancelsInFlightCalls fails pending and new calls with gateway_shutting_down on shutdown.
+func TestShutdownCancelsInFlightCalls(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	t.Cleanup(func() { _ = stdoutWriter.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = &lockedBuffer{}
+	server.decoder = json.NewDecoder(stdoutReader)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`), "1")
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	gateway.beginShutdown()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, errShuttingDown) {
+			t.Fatalf("expected shutdown error, got %v", err)
+		}
+		if status, code := classifyCallError(err); status != http.StatusServiceUnavailable || code != "gateway_shutting_down" {
+			t.Fatalf("expected 503 gateway_shutting_down, got %d %s", status, code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("in-flight call was not cancelled on shutdown")
+	}
+
+	if _, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":2,"method":"tools/list"}`), "2"); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("expected shutdown error for new call, got %v", err)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent writers and readers.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write appends to the buffer under the lock.
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Close satisfies io.WriteCloser.
+func (b *lockedBuffer) Close() error {
+	return nil
+}
+
+// String returns the buffered contents under the lock.
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestCallCoalescesIdenticalReads shares one child round-trip across identical in-flight reads.
+func TestCallCoalescesIdenticalReads(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", CoalesceReads: true}},
+	})
+	server := gateway.servers["unit"]
+
+	stdin := &lockedBuffer{}
+	stdoutReader, stdoutWriter := io.Pipe()
+	t.Cleanup(func() { _ = stdoutWriter.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.decoder = json.NewDecoder(stdoutReader)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	type result struct {
+		payload json.RawMessage
+		err     error
+	}
+	first := make(chan result, 1)
+	second := make(chan result, 1)
+	go func() {
+		payload, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`), "1")
+		first <- result{payload, err}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for stdin.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		payload, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":"b","method":"tools/list"}`), "b")
+		second <- result{payload, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_, _ = stdoutWriter.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"tools":[]}}` + "\n"))
+
+	firstResult := <-first
+	secondResult := <-second
+	if firstResult.err != nil || secondResult.err != nil {
+		t.Fatalf("coalesced calls failed: %v / %v", firstResult.err, secondResult.err)
+	}
+	if lines := strings.Count(stdin.String(), "\n"); lines != 1 {
+		t.Fatalf("expected one child request, got %d", lines)
+	}
+	if rawRequestID(secondResult.payload) == nil || string(rawRequestID(secondResult.payload)) != `"b"` {
+		t.Fatalf("expected second caller id, got %s", secondResult.payload)
+	}
+	if string(rawRequestID(firstResult.payload)) != "1" {
+		t.Fatalf("expected first caller id, got %s", firstResult.payload)
+	}
+
+	if _, _, ok := readKey([]byte(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"x"}}`)); ok {
+		t.Fatal("expected tools/call never to be coalesced")
+	}
+}
+
+// TestReloadAppliesServerDiff adds, removes, and replaces servers from the reloaded config.
+func TestReloadAppliesServerDiff(t *testing.T) {
+	t.Parallel()
+
+	payload := map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers": []map[string]any{
+			{"server_id": "kept", "command": "/bin/echo"},
+			{"server_id": "changed", "command": "/bin/echo"},
+			{"server_id": "removed", "command": "/bin/echo"},
+		},
+	}
+	cfgPath := writeTestConfig(t, payload)
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	gateway := newTestGateway(t, *cfg)
+	kept, _ := gateway.server("kept")
+	changed, _ := gateway.server("changed")
+	removed, _ := gateway.server("removed")
+
+	payload["servers"] = []map[string]any{
+		{"server_id": "kept", "command": "/bin/echo"},
+		{"server_id": "changed", "command": "/bin/echo", "args": []string{"v2"}},
+		{"server_id": "added", "command": "/bin/echo"},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	if err := os.WriteFile(cfgPath, data, 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := gateway.reload(context.Background(), cfgPath); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	if server, _ := gateway.server("kept"); server != kept {
+		t.Fatal("expected unchanged server to be kept")
+	}
+	if server, _ := gateway.server("changed"); server == changed || server.config().Args[0] != "v2" {
+		t.Fatal("expected changed server to be replaced")
+	}
+	if _, ok := gateway.server("removed"); ok {
+		t.Fatal("expected removed server to be gone")
+	}
+	if _, ok := gateway.server("added"); !ok {
+		t.Fatal("expected added server to be registered")
+	}
+	for _, stopped := range []*ManagedServer{changed, removed} {
+		if !errors.Is(context.Cause(stopped.lifetime), errServerStopped) {
+			t.Fatalf("expected %s to be stopped", stopped.config().ServerID)
+		}
+	}
+
+	if err := os.WriteFile(cfgPath, []byte("{"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := gateway.reload(context.Background(), cfgPath); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	if _, ok := gateway.server("added"); !ok {
+		t.Fatal("expected failed reload to leave servers untouched")
+	}
+}
+
+// TestReloadEndpoint reloads over HTTP, accepts with the server diff, and answers 400 for an invalid config.
+func TestReloadEndpoint(t *testing.T) {
+	t.Parallel()
+
+	payload := map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"admin_enabled":   true,
+		"servers":         []map[string]any{{"server_id": "kept", "command": "/bin/echo"}, {"server_id": "removed", "command": "/bin/echo"}},
+	}
+	cfgPath := writeTestConfig(t, payload)
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	gateway := newTestGateway(t, *cfg)
+	gateway.configPath = cfgPath
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	payload["servers"] = []map[string]any{{"server_id": "kept", "command": "/bin/echo"}, {"server_id": "added", "command": "/bin/echo"}}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	if err := os.WriteFile(cfgPath, data, 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	rec := serve()
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d %s", rec.Code, rec.Body.String())
+	}
+	var summary reloadSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("decode summary: %v", err)
+	}
+	if !slices.Equal(summary.Added, []string{"added"}) || !slices.Equal(summary.Removed, []string{"removed"}) || !slices.Equal(summary.Unchanged, []string{"kept"}) || len(summary.Changed) != 0 {
+		t.Fatalf("unexpected reload summary %s", rec.Body.String())
+	}
+
+	if err := os.WriteFile(cfgPath, []byte(`{"servers": []}`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if rec := serve(); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_config") {
+		t.Fatalf("expected 400 invalid_config, got %d %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := gateway.server("added"); !ok {
+		t.Fatal("expected a rejected reload to keep the current servers")
+	}
+}
+
+// TestReloadAllowlistFile merges the allowlist file, re-reads it on reload, and keeps the old list on a bad line.
+func TestReloadAllowlistFile(t *testing.T) {
+	t.Parallel()
+
+	allowFile := filepath.Join(t.TempDir(), "allowed_clients")
+	writeAllowlist := func(contents string) {
+		if err := os.WriteFile(allowFile, []byte(contents), 0o600); err != nil {
+			t.Fatalf("write allowlist: %v", err)
+		}
+	}
+	writeAllowlist("# office\n10.0.0.0/24\n")
+	cfgPath := writeTestConfig(t, map[string]any{
+		"auth_token":           "secret",
+		"allowed_clients":      []string{"127.0.0.1"},
+		"allowed_clients_file": allowFile,
+		"servers":              []map[string]any{{"server_id": "unit", "command": "/bin/echo"}},
+	})
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	gateway := newTestGateway(t, *cfg)
+
+	for remote, want := range map[string]bool{"127.0.0.1:1": true, "10.0.0.9:1": true, "10.0.1.9:1": false} {
+		if got := gateway.allowlist.allows(remote); got != want {
+			t.Fatalf("initial allowlist: allows(%s) = %v, expected %v", remote, got, want)
+		}
+	}
+
+	writeAllowlist("10.0.1.0/24\n")
+	if _, err := gateway.reload(context.Background(), cfgPath); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if gateway.allowlist.allows("10.0.0.9:1") || !gateway.allowlist.allows("10.0.1.9:1") {
+		t.Fatal("expected reload to apply the new allowlist file")
+	}
+
+	writeAllowlist("10.0.2.0/24\nnot-an-ip\n")
+	if _, err := gateway.reload(context.Background(), cfgPath); err == nil || !strings.Contains(err.Error(), allowFile+":2:") {
+		t.Fatalf("expected an error naming line 2, got %v", err)
+	}
+	if !gateway.allowlist.allows("10.0.1.9:1") || gateway.allowlist.allows("10.0.2.9:1") {
+		t.Fatal("expected the previous allowlist to stay active after a bad reload")
+	}
+}
+
+// TestWatchConfigFollowsSymlinkSwap fires on in-place writes and configmap-style symlink swaps.
+func TestWatchConfigFollowsSymlinkSwap(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeVersion := func(name, contents string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "config.json"), []byte(contents), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	writeVersion("v1", `{"version":1}`)
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.Symlink(filepath.Join("..data", "config.json"), configPath); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	changes := make(chan struct{}, 4)
+	if err := watchConfig(ctx, configPath, NewLogger(ioDiscard{}), func() { changes <- struct{}{} }); err != nil {
+		t.Fatalf("watchConfig failed: %v", err)
+	}
+	waitForChange := func(what string) {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reload after %s", what)
+		}
+	}
+
+	writeVersion("v2", `{"version":2}`)
+	if err := os.Symlink("v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	waitForChange("symlink swap")
+
+	if err := os.WriteFile(filepath.Join(dir, "v2", "config.json"), []byte(`{"version":3}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	waitForChange("in-place write")
+}
+
+// TestResponseCacheBounded evicts the oldest cached response once cache_max_entries is reached.
+func TestResponseCacheBounded(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", CacheTTLMS: 60000, CacheMaxEntries: 2}},
+	})
+	server := gateway.servers["unit"]
+	server.cacheMu.Lock()
+	defer server.cacheMu.Unlock()
+	for _, key := range []string{"a", "b", "a", "c"} {
+		server.storeCachedLocked(key, json.RawMessage(`{"jsonrpc":"2.0","id":1,"result":{}}`))
+	}
+	if len(server.cache) != 2 || server.cache["a"] != nil || server.cache["b"] == nil || server.cache["c"] == nil {
+		t.Fatalf("expected only the two newest keys to be kept, got %v", server.cacheOrder)
+	}
+}
+
+// TestCallCachedStaleWhileRevalidate serves fresh and stale entries from cache and refetches past max_stale_ms.
+func TestCallCachedStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers: []ServerConfig{{
+			ServerID:             "unit",
+			Command:              "/bin/echo",
+			CacheTTLMS:           50,
+			StaleWhileRevalidate: true,
+			MaxStaleMS:           10000,
+		}},
+	})
+	server := gateway.servers["unit"]
+
+	stdin := &lockedBuffer{}
+	stdoutReader, stdoutWriter := io.Pipe()
+	t.Cleanup(func() { _ = stdoutWriter.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.decoder = json.NewDecoder(stdoutReader)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	requests := func() int { return strings.Count(stdin.String(), "\n") }
+	waitForRequests := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for requests() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if requests() != n {
+			t.Fatalf("expected %d child requests, got %d", n, requests())
+		}
+	}
+	// Calls reach the server under the gateway's ids, so the nth request is
+	// answered with whatever id it was sent under.
+	respond := func(request, version int) {
+		line := strings.Split(stdin.String(), "\n")[request-1]
+		_, _ = fmt.Fprintf(stdoutWriter, `{"jsonrpc":"2.0","id":%s,"result":{"version":%d}}`+"\n", rawRequestID([]byte(line)), version)
+	}
+	call := func(id string) json.RawMessage {
+		t.Helper()
+		payload, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":"`+id+`","method":"tools/list"}`), id)
+		if err != nil {
+			t.Fatalf("call %s failed: %v", id, err)
+		}
+		return payload
+	}
+	version := func(payload json.RawMessage) int {
+		var message struct {
+			Result struct {
+				Version int `json:"version"`
+			} `json:"result"`
+		}
+		_ = json.Unmarshal(payload, &message)
+		return message.Result.Version
+	}
+
+	done := make(chan json.RawMessage, 1)
+	go func() { done <- call("a") }()
+	waitForRequests(1)
+	respond(1, 1)
+	<-done
+
+	if payload := call("b"); version(payload) != 1 || string(rawRequestID(payload)) != `"b"` || requests() != 1 {
+		t.Fatalf("expected fresh cache hit with caller id, got %s after %d requests", payload, requests())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	timing := &callTiming{}
+	stale, err := server.Call(context.WithValue(context.Background(), callTimingKey{}, timing), []byte(`{"jsonrpc":"2.0","id":"c","method":"tools/list"}`), "c")
+	if err != nil || version(stale) != 1 {
+		t.Fatalf("expected stale entry to be served, got %s (%v)", stale, err)
+	}
+	waitForRequests(2)
+	respond(2, 2)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		server.cacheMu.Lock()
+		refreshed := version(server.cache["tools/list\x00"].response) == 2
+		server.cacheMu.Unlock()
+		if refreshed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if payload := call("d"); version(payload) != 2 {
+		t.Fatalf("expected refreshed entry, got %s", payload)
+	}
+	if timing.server != 0 {
+		t.Fatalf("expected the background refresh to leave the stale call's timing alone, got %v", timing.server)
+	}
+
+	server.cacheMu.Lock()
+	server.cache["tools/list\x00"].fetchedAt = time.Now().Add(-time.Minute)
+	server.cacheMu.Unlock()
+	go func() { done <- call("e") }()
+	waitForRequests(3)
+	select {
+	case payload := <-done:
+		t.Fatalf("expected synchronous refetch past max_stale_ms, got %s", payload)
+	case <-time.After(20 * time.Millisecond):
+	}
+	respond(3, 3)
+	if payload := <-done; version(payload) != 3 {
+		t.Fatalf("expected refetched entry, got %s", payload)
+	}
+}
+
+// TestHTTPTransportProxiesCalls forwards JSON-RPC to an HTTP upstream, following its session and SSE replies.
+func TestHTTPTransportProxiesCalls(t *testing.T) {
+	t.Parallel()
+
+	var sessions []string
+	var mu sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		sessions = append(sessions, r.Header.Get("Mcp-Session-Id"))
+		mu.Unlock()
+		id := rawRequestID(body)
+		switch {
+		case id == nil:
+			w.WriteHeader(http.StatusAccepted)
+		case string(id) == "1":
+			w.Header().Set("Mcp-Session-Id", "upstream-session")
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":{"via":"json"}}`, id)
+		default:
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprint(w, "data: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\"}\n\n")
+			_, _ = fmt.Fprintf(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"id\":%s,\"result\":{\"via\":\"sse\"}}\n\n", id)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "remote", Transport: "http", BaseURL: upstream.URL}},
+	})
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/remote/rpc", strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"via":"json"`) {
+		t.Fatalf("expected JSON reply, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"jsonrpc":"2.0","id":2,"method":"tools/list"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"via":"sse"`) {
+		t.Fatalf("expected SSE reply, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"jsonrpc":"2.0","method":"notifications/initialized"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 for notification, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sessions) != 3 || sessions[0] != "" || sessions[1] != "upstream-session" || sessions[2] != "upstream-session" {
+		t.Fatalf("expected upstream session to be forwarded after the first reply, got %v", sessions)
+	}
+}
+
+// TestStreamableHTTPSessions binds POST, GET, and DELETE to the session from initialize and streams POST replies.
+func TestStreamableHTTPSessions(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		id := rawRequestID(body)
+		if method, _ := parseMethodAndID(body); method == "tools/call" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprint(w, "data: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\"}\n\n")
+			_, _ = fmt.Fprintf(w, "data: {\"jsonrpc\":\"2.0\",\"id\":%s,\"result\":{}}\n\n", id)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":{}}`, id)
+	}))
+	t.Cleanup(upstream.Close)
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		StreamableHTTP: true,
+		Servers:        []ServerConfig{{ServerID: "remote", Transport: "http", BaseURL: upstream.URL}},
+	})
+	listener := httptest.NewServer(gateway.routes())
+	t.Cleanup(listener.Close)
+	send := func(method, sessionID, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, listener.URL+"/remote/rpc", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Accept", "application/json, text/event-stream")
+		if sessionID != "" {
+			req.Header.Set("MCP-Session-Id", sessionID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s failed: %v", method, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := send(http.MethodPost, "", `{"jsonrpc":"2.0","id":1,"method":"initialize"}`)
+	sessionID := resp.Header.Get("MCP-Session-Id")
+	if resp.StatusCode != http.StatusOK || sessionID == "" {
+		t.Fatalf("expected initialize to issue a session, got %d %q", resp.StatusCode, sessionID)
+	}
+	if resp := send(http.MethodPost, "", `{"jsonrpc":"2.0","id":2,"method":"tools/list"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a session, got %d", resp.StatusCode)
+	}
+	if resp := send(http.MethodGet, "other", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a stream on an unknown session, got %d", resp.StatusCode)
+	}
+
+	resp = send(http.MethodPost, sessionID, `{"jsonrpc":"2.0","id":3,"method":"tools/call"}`)
+	streamed, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != "text/event-stream" || !strings.Contains(string(streamed), "notifications/progress") || !strings.Contains(string(streamed), `"id":3`) {
+		t.Fatalf("expected the streamed reply as events, got %q %s", resp.Header.Get("Content-Type"), streamed)
+	}
+
+	stream := send(http.MethodGet, sessionID, "")
+	if stream.StatusCode != http.StatusOK {
+		t.Fatalf("expected the session stream to open, got %d", stream.StatusCode)
+	}
+	ended := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, stream.Body)
+		close(ended)
+	}()
+	if resp := send(http.MethodDelete, sessionID, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 for DELETE, got %d", resp.StatusCode)
+	}
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected DELETE to close the session stream")
+	}
+	if resp := send(http.MethodDelete, sessionID, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a terminated session, got %d", resp.StatusCode)
+	}
+	if resp := send(http.MethodPost, sessionID, `{"jsonrpc":"2.0","id":4,"method":"tools/list"}`); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for requests on a terminated session, got %d", resp.StatusCode)
+	}
+}
+
+// TestSessionDelete ends a session, drops its cached handshake, and notifies the server.
+func TestSessionDelete(t *testing.T) {
+	t.Parallel()
+
+	cfg := ServerConfig{ServerID: "unit", Command: "/bin/echo", CacheInitialize: true, SessionEndMethod: "notifications/session_ended"}
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{cfg},
+	})
+	server := gateway.servers["unit"]
+	stdin := &lockedBuffer{}
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.sessionID = "session-1"
+	server.sessionInitialized = true
+	server.initializeResult = json.RawMessage(`{"jsonrpc":"2.0","id":1,"result":{}}`)
+	server.mu.Unlock()
+	handler := gateway.routes()
+
+	deleteSession := func(sessionID string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/unit/rpc", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("MCP-Session-Id", sessionID)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := deleteSession("other"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown session, got %d", code)
+	}
+	if code := deleteSession("session-1"); code != http.StatusNoContent {
+		t.Fatalf("expected 204 for DELETE, got %d", code)
+	}
+	server.mu.Lock()
+	initializeResult := server.initializeResult
+	server.mu.Unlock()
+	if initializeResult != nil {
+		t.Fatalf("expected the cached initialize response to be dropped, got %s", initializeResult)
+	}
+	if !strings.Contains(stdin.String(), `"method":"notifications/session_ended"`) {
+		t.Fatalf("expected the session end notification, stdin: %s", stdin.String())
+	}
+	if code := deleteSession("session-1"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an ended session, got %d", code)
+	}
+}
+
+// TestServerMessagesRelayedToStreams sends server-initiated messages to the session's event streams.
+func TestServerMessagesRelayedToStreams(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	stdout, serverOut := io.Pipe()
+	t.Cleanup(func() { _ = serverOut.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = &lockedBuffer{}
+	server.decoder = json.NewDecoder(stdout)
+	server.pending = newPendingCalls()
+	server.pending.reading = true
+	pending := server.pending
+	server.mu.Unlock()
+	go server.readLoop(context.Background(), pending)
+
+	listener := httptest.NewServer(gateway.routes())
+	t.Cleanup(listener.Close)
+	req, err := http.NewRequest(http.MethodGet, listener.URL+"/unit/rpc", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	reader := bufio.NewReader(resp.Body)
+	if line, err := reader.ReadString('\n'); err != nil || line != ": ok\n" {
+		t.Fatalf("expected the stream to open, got %q %v", line, err)
+	}
+
+	_, _ = io.WriteString(serverOut, `{"jsonrpc":"2.0","id":99,"result":{}}`+"\n")
+	_, _ = io.WriteString(serverOut, `{"jsonrpc":"2.0","method":"notifications/tools/list_changed"}`+"\n")
+	received := make(chan string, 1)
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "data: ") {
+				received <- line
+				return
+			}
+		}
+	}()
+	select {
+	case line := <-received:
+		if !strings.Contains(line, "notifications/tools/list_changed") {
+			t.Fatalf("expected only the notification to be relayed, got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the notification on the event stream")
+	}
+}
+
+// TestClientResponsesWrittenToServer writes a client's answers to server requests through and acknowledges them with 202.
+func TestClientResponsesWrittenToServer(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:        "secret",
+		AllowedClients:   []string{"127.0.0.1"},
+		RequestTimeoutMS: 200,
+		Servers:          []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	stdin := &lockedBuffer{}
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","id":"srv-1","result":{"action":"accept"}}`,
+		`[{"jsonrpc":"2.0","id":"srv-2","error":{"code":-1,"message":"declined"}},{"jsonrpc":"2.0","method":"notifications/progress"}]`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected 202 for %s, got %d %s", body, rec.Code, rec.Body.String())
+		}
+	}
+	for _, line := range []string{
+		`{"jsonrpc":"2.0","id":"srv-1","result":{"action":"accept"}}` + "\n",
+		`{"jsonrpc":"2.0","id":"srv-2","error":{"code":-1,"message":"declined"}}` + "\n",
+		`{"jsonrpc":"2.0","method":"notifications/progress"}` + "\n",
+	} {
+		if !strings.Contains(stdin.String(), line) {
+			t.Fatalf("expected %q written as is, got %q", line, stdin.String())
+		}
+	}
+}
+
+// TestOnDemandServerRelaysWhileIdle keeps an on-demand server's reader running while a stream is open and no call is.
+func TestOnDemandServerRelaysWhileIdle(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", ReaderMode: "on-demand"}},
+	})
+	server := gateway.servers["unit"]
+	stdout, serverOut := io.Pipe()
+	t.Cleanup(func() { _ = serverOut.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = &lockedBuffer{}
+	server.stdout = bufio.NewReader(stdout)
+	server.decoder = json.NewDecoder(server.stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	subscriber := server.subscribe("")
+	defer server.unsubscribe("", subscriber)
+	// Each message would have let the reader stop if only calls kept it alive.
+	for _, method := range []string{"notifications/tools/list_changed", "notifications/resources/list_changed"} {
+		go func() { _, _ = io.WriteString(serverOut, `{"jsonrpc":"2.0","method":"`+method+`"}`+"\n") }()
+		select {
+		case message := <-subscriber.messages:
+			if !strings.Contains(string(message.payload), method) {
+				t.Fatalf("expected %s to be relayed, got %s", method, message.payload)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %s to be relayed while no call was running", method)
+		}
+	}
+}
+
+// TestClientDisconnectCancelsCall abandons the call when the client hangs up and tells the server to stop.
+func TestClientDisconnectCancelsCall(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	server := gateway.servers["unit"]
+	stdin := &lockedBuffer{}
+	stdout, _ := io.Pipe()
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.decoder = json.NewDecoder(stdout)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":7,"method":"tools/call"}`)).WithContext(ctx)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+
+	if rec.Body.Len() != 0 {
+		t.Fatalf("expected no response for a disconnected client, got %s", rec.Body.String())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(stdin.String(), `"method":"notifications/cancelled"`) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a cancellation notification, stdin: %s", stdin.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The server only knows the request by the id the gateway sent it under.
+	if !strings.Contains(stdin.String(), `"id":1,"method":"tools/call"`) || !strings.Contains(stdin.String(), `"requestId":1`) {
+		t.Fatalf("expected the cancellation to name the request as sent, stdin: %s", stdin.String())
+	}
+}
+
+// TestFailoverToBackup routes reads for a failed primary to its backup until the primary is ready again.
+func TestFailoverToBackup(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "primary", Command: "/bin/echo"}, {ServerID: "spare", Command: "/bin/echo", BackupFor: "primary"}},
+	})
+	setLogger(gateway.servers["primary"], NewLogger(logs))
+	fake := func(server *ManagedServer, lines string) {
+		server.mu.Lock()
+		server.status = "ready"
+		server.stdin = &lockedBuffer{}
+		server.decoder = json.NewDecoder(strings.NewReader(lines))
+		server.pending = newPendingCalls()
+		server.mu.Unlock()
+	}
+	fake(gateway.servers["spare"], `{"jsonrpc":"2.0","id":1,"result":{"from":"spare"}}`+"\n")
+
+	serve := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/primary/rpc", strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	if body := serve(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`); !strings.Contains(body, `"from":"spare"`) {
+		t.Fatalf("expected the backup to answer a read, got %s", body)
+	}
+	if !strings.Contains(logs.String(), `"event":"gateway_failover"`) || !strings.Contains(logs.String(), `"backup_id":"spare"`) {
+		t.Fatalf("expected a gateway_failover log, got %s", logs.String())
+	}
+	if body := serve(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"write"}}`); !strings.Contains(body, "no_healthy_instances") {
+		t.Fatalf("expected a write to fail instead of failing over, got %s", body)
+	}
+
+	// The server answers under the gateway's id for the call, not the client's.
+	fake(gateway.servers["primary"], `{"jsonrpc":"2.0","id":1,"result":{"from":"primary"}}`+"\n")
+	if body := serve(`{"jsonrpc":"2.0","id":3,"method":"tools/list"}`); !strings.Contains(body, `"from":"primary"`) || !strings.Contains(body, `"id":3`) {
+		t.Fatalf("expected the ready primary to answer again, got %s", body)
+	}
+}
+
+// TestTLSSettings rejects unknown TLS names at load and enforces the minimum version on the listener.
+func TestTLSSettings(t *testing.T) {
+	t.Parallel()
+
+	for _, settings := range []map[string]any{
+		{"tls_cert_file": "cert.pem"},
+		{"tls_cert_file": "cert.pem", "tls_key_file": "key.pem", "tls_min_version": "1.4"},
+		{"tls_cert_file": "cert.pem", "tls_key_file": "key.pem", "tls_cipher_suites": []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+	} {
+		payload := map[string]any{
+			"auth_token":      "secret",
+			"allowed_clients": []string{"127.0.0.1"},
+			"servers":         []map[string]any{{"server_id": "unit", "command": "/bin/echo"}},
+		}
+		maps.Copy(payload, settings)
+		if _, err := loadConfig(writeTestConfig(t, payload)); err == nil {
+			t.Fatalf("expected %v to be rejected", settings)
+		}
+	}
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:       "secret",
+		AllowedClients:  []string{"127.0.0.1"},
+		TLSCertFile:     "cert.pem",
+		TLSKeyFile:      "key.pem",
+		TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		Servers:         []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	listener := gateway.newListener("127.0.0.1:0", gateway.routes())
+	if listener.TLSConfig.MinVersion != tls.VersionTLS12 || !slices.Equal(listener.TLSConfig.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}) {
+		t.Fatalf("unexpected tls config: %+v", listener.TLSConfig)
+	}
+	server := httptest.NewUnstartedServer(listener.Handler)
+	server.TLS = listener.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS11
+	if _, err := client.Get(server.URL + "/health"); err == nil {
+		t.Fatal("expected a TLS 1.1 handshake to be refused")
+	}
+	client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS12
+	resp, err := client.Get(server.URL + "/health")
+	if err != nil {
+		t.Fatalf("expected a TLS 1.2 handshake to succeed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// TestToolRouting routes a tools/call without a server_id to the one ready server listing the tool.
+func TestToolRouting(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		ToolRouting:    true,
+		Servers:        []ServerConfig{{ServerID: "alpha", Command: "/bin/echo"}, {ServerID: "beta", Command: "/bin/echo", Priority: 1}},
+	})
+	for id, tools := range map[string]string{"alpha": `[{"name":"search"}]`, "beta": `[{"name":"search"},{"name":"fetch"}]`} {
+		server := gateway.servers[id]
+		stdin, stdout := newReplyingStdio(t, func(string) string { return `{"from":"` + id + `"}` })
+		server.mu.Lock()
+		server.status = "ready"
+		server.stdin = stdin
+		server.decoder = json.NewDecoder(stdout)
+		server.toolList = json.RawMessage(tools)
+		server.pending = newPendingCalls()
+		server.mu.Unlock()
+	}
+
+	serve := func(id int, tool string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"payload":{"jsonrpc":"2.0","id":%d,"method":"tools/call","params":{"name":%q}}}`, id, tool)
+		req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve(1, "fetch"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"server_id":"beta"`) || !strings.Contains(rec.Body.String(), `"from":"beta"`) {
+		t.Fatalf("expected fetch to be routed to beta, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(2, "search"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "tool_ambiguous") {
+		t.Fatalf("expected an ambiguous tool to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(2, "translate"); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "tool_not_found") {
+		t.Fatalf("expected an unlisted tool to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	gateway.cfg.ToolRoutingTieBreak = "priority"
+	if rec := serve(2, "search"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"from":"beta"`) {
+		t.Fatalf("expected the higher priority server to win the tie, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestDirectRouteParsesServerID takes the server_id from the single path segment before /rpc.
+func TestDirectRouteParsesServerID(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":{}}`, rawRequestID(body))
+	}))
+	t.Cleanup(upstream.Close)
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Transport: "http", BaseURL: upstream.URL}},
+	})
+	handler := gateway.routes()
+
+	for path, want := range map[string]int{
+		"/unit/rpc":        http.StatusOK,
+		"/unit/rpc/":       http.StatusOK,
+		"/unit/rpc?x=1":    http.StatusOK,
+		"/unit/rpc/?x=/a":  http.StatusOK,
+		"/other/rpc":       http.StatusNotFound,
+		"/nested/unit/rpc": http.StatusNotFound,
+		"/unit/rpc/rpc":    http.StatusNotFound,
+		"/unit/rpcx":       http.StatusNotFound,
+		"/rpc/":            http.StatusNotFound,
+	} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"ping"}`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("expected %d for %s, got %d %s", want, path, rec.Code, rec.Body.String())
+		}
+	}
+
+	cfgPath := writeTestConfig(t, map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers":         []map[string]any{{"server_id": "nested/unit", "command": "/bin/echo"}},
+	})
+	if _, err := loadConfig(cfgPath); err == nil {
+		t.Fatal("expected a server_id containing / to be rejected")
+	}
+}
+
+// TestOptionsListsAllowedMethods answers OPTIONS on the RPC routes with 204 and an Allow header.
+func TestOptionsListsAllowedMethods(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	for path, allow := range map[string]string{"/rpc": "POST, OPTIONS", "/unit/rpc": "GET, POST, DELETE, OPTIONS"} {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != allow {
+			t.Fatalf("expected 204 with Allow %q for %s, got %d %q", allow, path, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+}
+
+// TestMaxStartWait fails a call with server_starting once max_start_wait_ms passes, without abandoning the start.
+func TestMaxStartWait(t *testing.T) {
+	t.Parallel()
+
+	var ready atomic.Bool
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(probe.Close)
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.Autostart = true
+	serverCfg.ReadinessHTTP = probe.URL
+	serverCfg.ProbeIntervalMS = 10
+	serverCfg.StartupTimeoutMS = 5000
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, MaxStartWaitMS: 100, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+
+	start := time.Now()
+	_, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`), "1")
+	if status, code := classifyCallError(err); status != http.StatusServiceUnavailable || code != "server_starting" {
+		t.Fatalf("expected 503 server_starting, got %d %s (%v)", status, code, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the call to give up after max_start_wait_ms, took %v", elapsed)
+	}
+	if status := server.currentStatus(); status != "starting" {
+		t.Fatalf("expected the start to carry on, got %s", status)
+	}
+
+	ready.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for server.currentStatus() != "ready" {
+		if time.Now().After(deadline) {
+			t.Fatalf("server never became ready, status %s", server.currentStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":2,"method":"ping"}`), "2"); err != nil {
+		t.Fatalf("expected the ready server to answer: %v", err)
+	}
+}
+
+// TestStdioByteCounters counts bytes crossing a server's stdin and stdout.
+func TestStdioByteCounters(t *testing.T) {
+	t.Parallel()
+
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	cfg := Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{fakeServerConfig(t, "unit", "echo")}}
+	gateway, err := NewGateway(cfg, NewLogger(ioDiscard{}), tracenoop.NewTracerProvider().Tracer("test"), meter, noopShutdown, noopShutdown)
+	if err != nil {
+		t.Fatalf("NewGateway failed: %v", err)
+	}
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	payload := []byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`)
+	response, err := server.Call(context.Background(), payload, "1")
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	values := make(map[string]int64)
+	for _, scope := range collected.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "brain.mcp.gateway.stdin_bytes" && m.Name != "brain.mcp.gateway.stdout_bytes" {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				if serverID, _ := point.Attributes.Value("server_id"); serverID.AsString() == "unit" {
+					values[m.Name] += point.Value
+				}
+			}
+		}
+	}
+	if got := values["brain.mcp.gateway.stdin_bytes"]; got != int64(len(payload)+1) {
+		t.Fatalf("expected %d stdin bytes, got %d", len(payload)+1, got)
+	}
+	if got := values["brain.mcp.gateway.stdout_bytes"]; got < int64(len(response)+1) {
+		t.Fatalf("expected at least %d stdout bytes, got %d", len(response)+1, got)
+	}
+}
+
+// TestRequestMetricsBucketUnknownServerIDs labels unconfigured server ids as unknown unless full cardinality is on.
+func TestRequestMetricsBucketUnknownServerIDs(t *testing.T) {
+	t.Parallel()
+
+	for fullCardinality, want := range map[bool]string{false: "unknown", true: "made-up"} {
+		reader := sdkmetric.NewManualReader()
+		meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+		cfg := Config{
+			AuthToken:             "secret",
+			AllowedClients:        []string{"127.0.0.1"},
+			MaxBatchSize:          1,
+			MetricFullCardinality: fullCardinality,
+			Servers:               []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+		}
+		gateway, err := NewGateway(cfg, NewLogger(ioDiscard{}), tracenoop.NewTracerProvider().Tracer("test"), meter, noopShutdown, noopShutdown)
+		if err != nil {
+			t.Fatalf("NewGateway failed: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/made-up/rpc", strings.NewReader(`[{"jsonrpc":"2.0","id":1,"method":"ping"},{"jsonrpc":"2.0","id":2,"method":"ping"}]`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected 413 for the oversized batch, got %d", rec.Code)
+		}
+
+		var collected metricdata.ResourceMetrics
+		if err := reader.Collect(context.Background(), &collected); err != nil {
+			t.Fatalf("collect metrics: %v", err)
+		}
+		var labels []string
+		for _, scope := range collected.ScopeMetrics {
+			for _, m := range scope.Metrics {
+				if m.Name != "brain.mcp.gateway.requests" {
+					continue
+				}
+				for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					serverID, _ := point.Attributes.Value("server_id")
+					labels = append(labels, serverID.AsString())
+				}
+			}
+		}
+		if len(labels) != 1 || labels[0] != want {
+			t.Fatalf("expected server_id %q with metric_full_cardinality %v, got %v", want, fullCardinality, labels)
+		}
+	}
+}
+
+// TestEmptyPayloadRejected answers an empty or whitespace-only payload with 400 on both RPC paths.
+func TestEmptyPayloadRejected(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", Autostart: true}},
+	})
+	for _, tc := range []struct{ path, body string }{
+		{"/unit/rpc", ""},
+		{"/unit/rpc", " \n\t"},
+		{"/rpc", `{"server_id":"unit"}`},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_request") {
+			t.Fatalf("expected 400 invalid_request for %s %q, got %d %s", tc.path, tc.body, rec.Code, rec.Body.String())
+		}
+	}
+	if status := gateway.servers["unit"].currentStatus(); status != "stopped" {
+		t.Fatalf("expected the server to be left alone, got %s", status)
+	}
+}
+
+// TestReloadReconfiguresInPlace keeps a running process when only non-process settings change.
+func TestReloadReconfiguresInPlace(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	payload := map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers":         []ServerConfig{serverCfg},
+	}
+	cfgPath := writeTestConfig(t, payload)
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	logs := &lockedBuffer{}
+	gateway := newTestGateway(t, *cfg)
+	gateway.logger = NewLogger(logs)
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	pid := server.Status()["pid"]
+
+	serverCfg.CacheTTLMS = 500
+	serverCfg.MaxPendingRequests = 2
+	payload["servers"] = []ServerConfig{serverCfg}
+	summary, err := gateway.reload(context.Background(), writeTestConfig(t, payload))
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if !slices.Equal(summary.Reconfigured, []string{"unit"}) || len(summary.Changed) != 0 {
+		t.Fatalf("expected an in-place reconfiguration, got %+v", summary)
+	}
+	if current, _ := gateway.server("unit"); current != server || server.Status()["pid"] != pid || server.currentStatus() != "ready" {
+		t.Fatal("expected the running process to be kept")
+	}
+	if server.settings.Load().cacheTTL != 500*time.Millisecond || cap(server.settings.Load().pendingSlots) != 2 {
+		t.Fatalf("expected the new settings to apply, got cache_ttl %v and %d pending slots", server.settings.Load().cacheTTL, cap(server.settings.Load().pendingSlots))
+	}
+	if !strings.Contains(logs.String(), `"action":"in_place"`) {
+		t.Fatalf("expected the reload path to be logged, got %s", logs.String())
+	}
+
+	serverCfg.Args = []string{"v2"}
+	payload["servers"] = []ServerConfig{serverCfg}
+	if summary, err = gateway.reload(context.Background(), writeTestConfig(t, payload)); err != nil || !slices.Equal(summary.Changed, []string{"unit"}) {
+		t.Fatalf("expected new args to restart the server, got %+v (%v)", summary, err)
+	}
+	if current, _ := gateway.server("unit"); current == server {
+		t.Fatal("expected the server to be replaced")
+	}
+}
+
+// TestReloadDuringCalls reconfigures a server in place while calls are running; the race detector checks the swap.
+func TestReloadDuringCalls(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	payload := map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers":         []ServerConfig{serverCfg},
+	}
+	cfg, err := loadConfig(writeTestConfig(t, payload))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	gateway := newTestGateway(t, *cfg)
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for worker := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := 0; ; id++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				request := fmt.Sprintf(`{"jsonrpc":"2.0","id":"%d-%d","method":"tools/call"}`, worker, id)
+				if _, err := server.Call(context.Background(), []byte(request), ""); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for generation := 1; generation <= 20; generation++ {
+		serverCfg.MethodTimeoutsMS = map[string]int{"tools/call": 10000 + generation}
+		serverCfg.CacheTTLMS = generation
+		serverCfg.LogFields = map[string]any{"generation": generation}
+		payload["servers"] = []ServerConfig{serverCfg}
+		summary, err := gateway.reload(context.Background(), writeTestConfig(t, payload))
+		if err != nil || !slices.Equal(summary.Reconfigured, []string{"unit"}) {
+			t.Fatalf("expected an in-place reconfiguration, got %+v (%v)", summary, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("call failed during reload: %v", err)
+	}
+	if timeout := server.config().MethodTimeoutsMS["tools/call"]; timeout != 10020 {
+		t.Fatalf("expected the last reload to apply, got method timeout %d", timeout)
+	}
+}
+
+// TestServerRateLimit answers 429 once a server's token bucket is empty, whoever is calling.
+func TestServerRateLimit(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":{}}`)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1", "127.0.0.2"},
+		Servers:        []ServerConfig{{ServerID: "remote", Transport: "http", BaseURL: upstream.URL, RateLimitRPS: 0.01, RateLimitBurst: 2}},
+	})
+	post := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/remote/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/call"}`))
+		req.RemoteAddr = client + ":1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+	for _, client := range []string{"127.0.0.1", "127.0.0.2"} {
+		if rec := post(client); rec.Code != http.StatusOK {
+			t.Fatalf("expected the burst to be served, got %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	if rec := post("127.0.0.1"); rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "server_rate_limited") {
+		t.Fatalf("expected 429 server_rate_limited, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestStaleOnOutage serves a cached read flagged as stale while the server is down, within max_stale_on_outage_ms.
+func TestStaleOnOutage(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.Env["GATEWAY_FAKE_MARKER"] = "cached"
+	serverCfg.MaxStaleOnOutageMS = 60_000
+	cfgPath := writeTestConfig(t, map[string]any{"auth_token": "secret", "allowed_clients": []string{"127.0.0.1"}, "servers": []ServerConfig{serverCfg}})
+	if _, err := loadConfig(cfgPath); err == nil || !strings.Contains(err.Error(), "cache_ttl_ms") {
+		t.Fatalf("expected max_stale_on_outage_ms without cache_ttl_ms to be rejected, got %v", err)
+	}
+	serverCfg.CacheTTLMS = 10
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := post(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`); rec.Code != http.StatusOK || rec.Header().Get("MCP-Gateway-Stale") != "" {
+		t.Fatalf("expected a fresh reply, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	server.mu.Lock()
+	_ = server.cmd.Process.Kill()
+	server.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.currentStatus() != "stopped" {
+		if time.Now().After(deadline) {
+			t.Fatalf("server never stopped, status %s", server.currentStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	rec := post(`{"jsonrpc":"2.0","id":2,"method":"tools/list"}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("MCP-Gateway-Stale") != "true" || rec.Header().Get("Age") == "" {
+		t.Fatalf("expected a stale reply, got %d %v %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"marker":"cached"`) || !strings.Contains(rec.Body.String(), `"id":2`) {
+		t.Fatalf("expected the cached result under the new id, got %s", rec.Body.String())
+	}
+	if rec := post(`{"jsonrpc":"2.0","id":3,"method":"resources/list"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected an uncached read to fail, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestStartupDependencies holds dependents until their dependencies are ready, bounded by dependency_timeout_ms.
+func TestStartupDependencies(t *testing.T) {
+	t.Parallel()
+
+	var ready atomic.Bool
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(probe.Close)
+
+	timeout := 100
+	server := func(serverID string, dependsOn ...string) ServerConfig {
+		serverCfg := fakeServerConfig(t, serverID, "echo")
+		serverCfg.Autostart = true
+		serverCfg.DependsOn = dependsOn
+		return serverCfg
+	}
+	base := server("base")
+	base.ReadinessHTTP = probe.URL
+	base.ProbeIntervalMS = 10
+	loose := server("loose", "idle")
+	loose.DependencyTimeoutMS = &timeout
+	strict := server("strict", "idle")
+	strict.DependencyTimeoutMS = &timeout
+	strict.Required = true
+	idle := server("idle")
+	idle.Autostart = false
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{base, server("app", "base"), loose, strict, idle}})
+	for _, managed := range gateway.servers {
+		killOnCleanup(t, managed)
+	}
+
+	done := make(chan []error, 1)
+	go func() { done <- gateway.startServers(context.Background(), gateway.serverList()) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for gateway.servers["loose"].currentStatus() != "ready" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected loose to start anyway after its dependency timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := gateway.servers["app"].currentStatus(); status != "stopped" {
+		t.Fatalf("expected app to wait for base, got %s", status)
+	}
+
+	ready.Store(true)
+	errs := <-done
+	if len(errs) != 1 || !errors.Is(errs[0], errDependencyWait) || !strings.Contains(errs[0].Error(), "strict") {
+		t.Fatalf("expected only the required dependent to fail, got %v", errs)
+	}
+	if status := gateway.servers["app"].currentStatus(); status != "ready" {
+		t.Fatalf("expected app to start once base was ready, got %s", status)
+	}
+	if status := gateway.servers["strict"].currentStatus(); status != "stopped" {
+		t.Fatalf("expected strict to stay stopped, got %s", status)
+	}
+
+	cycle := writeTestConfig(t, map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers": []map[string]any{
+			{"server_id": "a", "command": "/bin/echo", "depends_on": []string{"b"}},
+			{"server_id": "b", "command": "/bin/echo", "depends_on": []string{"a"}},
+		},
+	})
+	if _, err := loadConfig(cycle); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected a depends_on cycle to be rejected, got %v", err)
+	}
+}
+
+// TestLoggedHeadersRedacted logs only the correlation headers of a failed request, masking configured ones.
+func TestLoggedHeadersRedacted(t *testing.T) {
+	t.Parallel()
+
+	logs := &lockedBuffer{}
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		RedactHeaders:  []string{"x-forwarded-for"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}},
+	})
+	gateway.logger = NewLogger(logs)
+	req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(`{}`))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer guessed-token")
+	req.Header.Set("Cookie", "session=cookie-value")
+	req.Header.Set("X-Api-Key", "api-key-value")
+	req.Header.Set("X-Forwarded-For", "10.0.0.7")
+	req.Header.Set("X-Request-Id", "req-42")
+	req.Header.Set("User-Agent", "probe/1.0")
+	rec := httptest.NewRecorder()
+	gateway.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+
+	line := logs.String()
+	for _, leaked := range []string{"guessed-token", "cookie-value", "api-key-value", "Authorization", "10.0.0.7"} {
+		if strings.Contains(line, leaked) {
+			t.Fatalf("expected %q to be kept out of the log, got %s", leaked, line)
+		}
+	}
+	if !strings.Contains(line, `"X-Forwarded-For":"***"`) || !strings.Contains(line, `"X-Request-Id":"req-42"`) || !strings.Contains(line, `"User-Agent":"probe/1.0"`) {
+		t.Fatalf("expected the allowlisted headers in the log, got %s", line)
+	}
+}
+
+// TestDebugErrorsIncludeStderr attaches the server's recent stderr to crash errors only when debug_errors is set.
+func TestDebugErrorsIncludeStderr(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, DebugErrors: true, Servers: []ServerConfig{fakeServerConfig(t, "unit", "crash")}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	post := func(body string) GatewayResponse {
+		req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		var response GatewayResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || response.Error == nil {
+			t.Fatalf("expected an error response, got %d %s", rec.Code, rec.Body.String())
+		}
+		return response
+	}
+
+	response := post(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"boom"}}`)
+	if response.Error.ErrorCode != "server_error" || !strings.Contains(response.Error.Detail, "fatal: tool blew up") {
+		t.Fatalf("expected stderr detail on the crash, got %+v", response.Error)
+	}
+
+	gateway.cfg.DebugErrors = false
+	response = post(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"boom"}}`)
+	if response.Error.Detail != "" {
+		t.Fatalf("expected no detail without debug_errors, got %+v", response.Error)
+	}
+}
+
+// TestReloadStartsInBackground returns from a reload before the added servers are ready.
+func TestReloadStartsInBackground(t *testing.T) {
+	t.Parallel()
+
+	payload := map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers":         []map[string]any{{"server_id": "kept", "command": "/bin/echo"}},
+	}
+	cfg, err := loadConfig(writeTestConfig(t, payload))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	gateway := newTestGateway(t, *cfg)
+
+	added := fakeServerConfig(t, "added", "echo")
+	added.Autostart = true
+	added.StartupDelayMS = 200
+	payload["servers"] = []ServerConfig{{ServerID: "kept", Command: "/bin/echo"}, added}
+	summary, err := gateway.reload(context.Background(), writeTestConfig(t, payload))
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	server, ok := gateway.server("added")
+	if !ok || !slices.Equal(summary.Added, []string{"added"}) {
+		t.Fatalf("expected the added server to be registered, got %+v", summary)
+	}
+	killOnCleanup(t, server)
+	if status := server.currentStatus(); status == "ready" {
+		t.Fatal("expected reload to return before the server started")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.currentStatus() != "ready" {
+		if time.Now().After(deadline) {
+			t.Fatalf("added server never became ready, status %s", server.currentStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestClosedServerNotStarted keeps a background start from spawning a server a later reload already closed.
+func TestClosedServerNotStarted(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.Autostart = true
+	logs := &lockedBuffer{}
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	gateway.logger = NewLogger(logs)
+	server := gateway.servers["unit"]
+	setLogger(server, gateway.logger)
+	killOnCleanup(t, server)
+
+	server.Close(context.Background())
+	if errs := gateway.startServers(context.Background(), []*ManagedServer{server}); len(errs) != 0 {
+		t.Fatalf("expected no start errors, got %v", errs)
+	}
+	if pid := server.pid(); pid != 0 || server.currentStatus() == "ready" {
+		t.Fatalf("expected the closed server to stay down, got pid %d status %s", pid, server.currentStatus())
+	}
+	if strings.Contains(logs.String(), "gateway_server_start_failed") {
+		t.Fatalf("expected no start failure to be logged, got %s", logs.String())
+	}
+}
+
+// TestBindRetry waits out an address in use for up to bind_retry_attempts and logs each retry.
+func TestBindRetry(t *testing.T) {
+	t.Parallel()
+
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := held.Addr().String()
+
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}}})
+	if _, err := gateway.listen(context.Background(), addr); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("expected an immediate address-in-use failure, got %v", err)
+	}
+
+	logs := &lockedBuffer{}
+	gateway.logger = NewLogger(logs)
+	gateway.cfg.BindRetryAttempts = 5
+	gateway.cfg.BindRetryDelayMS = 20
+	time.AfterFunc(50*time.Millisecond, func() { _ = held.Close() })
+	ln, err := gateway.listen(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("expected the bind to succeed once the address was released, got %v", err)
+	}
+	_ = ln.Close()
+	if !strings.Contains(logs.String(), `"event":"gateway_bind_retry"`) {
+		t.Fatalf("expected bind retries to be logged, got %s", logs.String())
+	}
+}
+
+// TestDirectResponseEnvelope wraps direct responses per server or per request.
+func TestDirectResponseEnvelope(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.ResponseEnvelope = true
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg}})
+	server := gateway.servers["unit"]
+	killOnCleanup(t, server)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	post := func(target, body string) string {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	if body := post("/unit/rpc", `{"jsonrpc":"2.0","id":1,"method":"ping"}`); !strings.Contains(body, `"server_id":"unit"`) || !strings.Contains(body, `"payload":`) {
+		t.Fatalf("expected the server default to wrap the response, got %s", body)
+	}
+	if body := post("/unit/rpc", `[{"jsonrpc":"2.0","id":1,"method":"ping"}]`); !strings.HasPrefix(body, `{"server_id":"unit"`) {
+		t.Fatalf("expected a wrapped batch, got %s", body)
+	}
+	if body := post("/unit/rpc?envelope=0", `{"jsonrpc":"2.0","id":2,"method":"ping"}`); strings.Contains(body, `"payload"`) || !strings.Contains(body, `"id":2`) {
+		t.Fatalf("expected envelope=0 to return the raw response, got %s", body)
+	}
+}
+
+// TestMemoryPressureSheds rejects work-bearing requests while RSS is above memory_high_watermark_bytes.
+func TestMemoryPressureSheds(t *testing.T) {
+	t.Parallel()
+
+	if processRSS() == 0 {
+		t.Fatal("expected a non-zero RSS sample")
+	}
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, MemoryHighWatermark: 1 << 30, Servers: []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}}})
+	logs := &lockedBuffer{}
+	gateway.memory.logger = NewLogger(logs)
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/unit/rpc", strings.NewReader(`{"jsonrpc":"2.0","method":"notifications/initialized"}`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	gateway.memory.observe(context.Background(), 2<<30)
+	if rec := post(); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "memory_pressure") {
+		t.Fatalf("expected 503 memory_pressure, got %d %s", rec.Code, rec.Body.String())
+	}
+	gateway.memory.observe(context.Background(), 1<<20)
+	if rec := post(); strings.Contains(rec.Body.String(), "memory_pressure") {
+		t.Fatalf("expected requests to pass once memory receded, got %d %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(logs.String(), "gateway_memory_pressure_started") || !strings.Contains(logs.String(), "gateway_memory_pressure_stopped") {
+		t.Fatalf("expected both transitions to be logged, got %s", logs.String())
+	}
+}
+
+// TestReaderMode keeps the stdout decoder between calls only in persistent mode.
+func TestReaderMode(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{"persistent", "on-demand"} {
+		serverCfg := fakeServerConfig(t, "unit", "echo")
+		serverCfg.ReaderMode = mode
+		gateway := newTestGateway(t, Config{Servers: []ServerConfig{serverCfg}})
+		server := gateway.servers["unit"]
+		killOnCleanup(t, server)
+		if err := server.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		server.mu.Lock()
+		before := server.decoder
+		server.mu.Unlock()
+		if _, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`), "req-1"); err != nil {
+			t.Fatalf("%s: Call failed: %v", mode, err)
+		}
+		server.mu.Lock()
+		kept := server.decoder == before
+		server.mu.Unlock()
+		if kept != (mode == "persistent") {
+			t.Fatalf("%s: expected the decoder to be kept only when persistent, kept=%v", mode, kept)
+		}
+		if _, err := server.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":2,"method":"tools/list"}`), "req-2"); err != nil {
+			t.Fatalf("%s: second Call failed: %v", mode, err)
+		}
+	}
+}
+
+// TestIdempotencyKeyReplay answers a repeated Idempotency-Key from the server's own cache within the window.
+func TestIdempotencyKeyReplay(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.IdempotencyWindowMS = 60_000
+	serverCfg.IdempotencyMaxKeys = 1
+	other := fakeServerConfig(t, "other", "echo")
+	other.IdempotencyWindowMS = 60_000
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{serverCfg, other}})
+	logs := &lockedBuffer{}
+	for _, server := range gateway.servers {
+		killOnCleanup(t, server)
+		if err := server.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		setLogger(server, NewLogger(logs))
+	}
+	replays := func() int { return strings.Count(logs.String(), `"event":"mcp_idempotent_replay"`) }
+	post := func(serverID, key, id string) string {
+		req := httptest.NewRequest(http.MethodPost, "/"+serverID+"/rpc", strings.NewReader(`{"jsonrpc":"2.0","id":`+id+`,"method":"tools/call","params":{"name":"send"}}`))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	post("unit", "k1", "1")
+	if body := post("unit", "k1", "2"); replays() != 1 || !strings.Contains(body, `"id":2`) {
+		t.Fatalf("expected a replay under the new id, got %d replays and %s", replays(), body)
+	}
+	post("other", "k1", "3")
+	if replays() != 1 {
+		t.Fatal("expected keys not to be shared across servers")
+	}
+	// With room for one key, a second key evicts the first.
+	post("unit", "k2", "4")
+	post("unit", "k1", "5")
+	if replays() != 1 {
+		t.Fatal("expected the evicted key to reach the server again")
+	}
+}
+
+// TestIdempotencyKeyInFlight makes a repeat wait for the call holding its key and refuses the key for a different request.
+func TestIdempotencyKeyInFlight(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{
+		AuthToken:      "secret",
+		AllowedClients: []string{"127.0.0.1"},
+		Servers:        []ServerConfig{{ServerID: "unit", Command: "/bin/echo", IdempotencyWindowMS: 60_000}},
+	})
+	server := gateway.servers["unit"]
+	stdin := &lockedBuffer{}
+	stdoutReader, stdoutWriter := io.Pipe()
+	t.Cleanup(func() { _ = stdoutWriter.Close() })
+	server.mu.Lock()
+	server.status = "ready"
+	server.stdin = stdin
+	server.decoder = json.NewDecoder(stdoutReader)
+	server.pending = newPendingCalls()
+	server.mu.Unlock()
+
+	ctx := context.WithValue(context.Background(), idempotencyKey{}, "k1")
+	returned := make(chan serverResponse, 2)
+	for _, id := range []string{"1", "2"} {
+		go func() {
+			payload, err := server.Call(ctx, []byte(`{"jsonrpc":"2.0","id":`+id+`,"method":"tools/call","params":{"name":"send"}}`), id)
+			returned <- serverResponse{payload: payload, err: err}
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(stdin.String(), "\n") < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := server.Call(ctx, []byte(`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"delete"}}`), "3"); !errors.Is(err, errIdempotencyReuse) {
+		t.Fatalf("expected the key to be refused for a different request, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if lines := strings.Count(stdin.String(), "\n"); lines != 1 {
+		t.Fatalf("expected one request to reach the server while the key is in flight, got %d", lines)
+	}
+	sent := rawRequestID([]byte(strings.TrimSpace(stdin.String())))
+	_, _ = fmt.Fprintf(stdoutWriter, `{"jsonrpc":"2.0","id":%s,"result":{"sent":true}}`+"\n", sent)
+
+	ids := map[string]bool{}
+	for range 2 {
+		select {
+		case resp := <-returned:
+			if resp.err != nil || !strings.Contains(string(resp.payload), `"sent":true`) {
+				t.Fatalf("expected both calls to get the response, got %s (%v)", resp.payload, resp.err)
+			}
+			ids[string(rawRequestID(resp.payload))] = true
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected both calls to be answered")
+		}
+	}
+	if !ids["1"] || !ids["2"] {
+		t.Fatalf("expected each call answered under its own id, got %v", ids)
+	}
+}
+
+// TestGracefulReplace keeps the old process serving until its replacement is ready, then swaps and stops it.
+func TestGracefulReplace(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.Env["GATEWAY_FAKE_MARKER"] = "old"
+	serverCfg.RestartMode = "graceful_replace"
+	payload := map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers":         []ServerConfig{serverCfg},
+	}
+	cfg, err := loadConfig(writeTestConfig(t, payload))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	gateway := newTestGateway(t, *cfg)
+	old := gateway.servers["unit"]
+	killOnCleanup(t, old)
+	if err := old.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	oldPID := old.pid()
+
+	// The replacement fails its first probes, which holds the overlap open.
+	nextCfg := fakeServerConfig(t, "unit", "flaky-probe")
+	nextCfg.Env["GATEWAY_FAKE_MARKER"] = "new"
+	nextCfg.RestartMode = "graceful_replace"
+	nextCfg.ReadinessProbe = true
+	nextCfg.ProbeIntervalMS = 100
+	payload["servers"] = []ServerConfig{nextCfg}
+	summary, err := gateway.reload(context.Background(), writeTestConfig(t, payload))
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if !slices.Equal(summary.Changed, []string{"unit"}) {
+		t.Fatalf("expected unit to be changed, got %+v", summary)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := old.Status()
+		if pid, _ := status["replacement_pid"].(int); pid != 0 {
+			if current, _ := gateway.server("unit"); current != old || status["status"] != "ready" {
+				t.Fatal("expected the old process to keep serving while the replacement starts")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replacement pid was never reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var next *ManagedServer
+	for {
+		if current, _ := gateway.server("unit"); current != old {
+			next = current
+			killOnCleanup(t, next)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("traffic never moved to the replacement")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for old.currentStatus() == "ready" {
+		if time.Now().After(deadline) {
+			t.Fatal("old process was never stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if next.pid() == oldPID || next.currentStatus() != "ready" {
+		t.Fatalf("expected a new ready process, got pid %d status %s", next.pid(), next.currentStatus())
+	}
+	response, err := next.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`), "req-1")
+	if err != nil || !strings.Contains(string(response), `"marker":"new"`) {
+		t.Fatalf("expected the replacement to answer, got %s %v", response, err)
+	}
+}
+
+// TestReloadDuringGracefulReplace diffs reloads during the overlap against the pending replacement and supersedes it when the config moves on.
+func TestReloadDuringGracefulReplace(t *testing.T) {
+	t.Parallel()
+
+	serverCfg := fakeServerConfig(t, "unit", "echo")
+	serverCfg.Env["GATEWAY_FAKE_MARKER"] = "old"
+	serverCfg.RestartMode = "graceful_replace"
+	payload := map[string]any{
+		"auth_token":      "secret",
+		"allowed_clients": []string{"127.0.0.1"},
+		"servers":         []ServerConfig{serverCfg},
+	}
+	cfg, err := loadConfig(writeTestConfig(t, payload))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	gateway := newTestGateway(t, *cfg)
+	old := gateway.servers["unit"]
+	killOnCleanup(t, old)
+	if err := old.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// Each replacement fails its first probes, which holds the overlap open.
+	reload := func(marker string) reloadSummary {
+		t.Helper()
+		nextCfg := fakeServerConfig(t, "unit", "flaky-probe")
+		nextCfg.Env["GATEWAY_FAKE_MARKER"] = marker
+		nextCfg.RestartMode = "graceful_replace"
+		nextCfg.ReadinessProbe = true
+		nextCfg.ProbeIntervalMS = 100
+		payload["servers"] = []ServerConfig{nextCfg}
+		summary, err := gateway.reload(context.Background(), writeTestConfig(t, payload))
+		if err != nil {
+			t.Fatalf("reload failed: %v", err)
+		}
+		return summary
+	}
+	pending := func() *ManagedServer {
+		old.mu.Lock()
+		defer old.mu.Unlock()
+		return old.replacement
+	}
+
+	if summary := reload("first"); !slices.Equal(summary.Changed, []string{"unit"}) {
+		t.Fatalf("expected unit to be changed, got %+v", summary)
+	}
+	first := pending()
+	if first == nil {
+		t.Fatal("expected a pending replacement")
+	}
+	killOnCleanup(t, first)
+	if summary := reload("first"); !slices.Equal(summary.Unchanged, []string{"unit"}) || pending() != first {
+		t.Fatalf("expected the same config to keep the pending replacement, got %+v", summary)
+	}
+	if summary := reload("second"); !slices.Equal(summary.Changed, []string{"unit"}) || pending() == first {
+		t.Fatalf("expected a new config to supersede the pending replacement, got %+v", summary)
+	}
+	if first.lifetime.Err() == nil {
+		t.Fatal("expected the superseded replacement to be stopped")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var next *ManagedServer
+	for {
+		if current, _ := gateway.server("unit"); current != old {
+			next = current
+			killOnCleanup(t, next)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("traffic never moved to the replacement")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	response, err := next.Call(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`), "req-1")
+	if err != nil || !strings.Contains(string(response), `"marker":"second"`) {
+		t.Fatalf("expected the latest config to be swapped in, got %s %v", response, err)
+	}
+}
+
+// TestReloadQueueCoalesces folds reload requests that arrive before the next reload into one.
+func TestReloadQueueCoalesces(t *testing.T) {
+	t.Parallel()
+
+	queue := newReloadQueue()
+	for range 3 {
+		queue.request()
+	}
+	<-queue.ready
+	if signals := queue.take(); signals != 3 {
+		t.Fatalf("expected 3 coalesced signals, got %d", signals)
+	}
+	select {
+	case <-queue.ready:
+		t.Fatal("expected a single pending reload")
+	default:
+	}
+
+	queue.request()
+	<-queue.ready
+	if signals := queue.take(); signals != 1 {
+		t.Fatalf("expected 1 signal, got %d", signals)
+	}
+}
+
+// TestVersionHeader adds X-Gateway-Version to authenticated responses only when version_header is set.
+func TestVersionHeader(t *testing.T) {
+	t.Parallel()
+
+	for _, enabled := range []bool{false, true} {
+		gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, VersionHeader: enabled, Servers: []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}}})
+		for _, token := range []string{"", "secret"} {
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rec := httptest.NewRecorder()
+			gateway.routes().ServeHTTP(rec, req)
+			version := rec.Header().Get("X-Gateway-Version")
+			if want := enabled && token != ""; strings.HasPrefix(version, serviceVersion) != want {
+				t.Fatalf("version_header=%v token=%q: expected the header only when enabled and authenticated, got %d %q", enabled, token, rec.Code, version)
+			}
+		}
+	}
+}
+
+// TestWrapperRequiresFields names the missing field when /rpc lacks server_id or payload.
+func TestWrapperRequiresFields(t *testing.T) {
+	t.Parallel()
+
+	gateway := newTestGateway(t, Config{AuthToken: "secret", AllowedClients: []string{"127.0.0.1"}, Servers: []ServerConfig{{ServerID: "unit", Command: "/bin/echo"}}})
+	for _, tc := range []struct{ body, message string }{
+		{`{"payload":{"jsonrpc":"2.0","id":1,"method":"ping"}}`, "missing server_id"},
+		{`{"server_id":"","payload":{"jsonrpc":"2.0","id":1,"method":"ping"}}`, "missing server_id"},
+		{`{"server_id":"unit"}`, "missing payload"},
+		{`{"server_id":"unit","payload":null}`, "missing payload"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(tc.body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		gateway.routes().ServeHTTP(rec, req)
+		var response GatewayResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusBadRequest || response.Error == nil || response.Error.ErrorCode != "invalid_request" || response.Error.Message != tc.message {
+			t.Fatalf("expected 400 invalid_request %q for %s, got %d %s", tc.message, tc.body, rec.Code, rec.Body.String())
+		}
+	}
+	if status := gateway.servers["unit"].currentStatus(); status != "stopped" {
+		t.Fatalf("expected the server to be left alone, got %s", status)
+	}
+}
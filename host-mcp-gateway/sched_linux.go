@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+
+	// renicePasses bounds how often the task list is re-read for threads
+	// started while earlier ones were being reniced.
+	renicePasses = 4
+)
+
+func setIOPriority(pid, class, level int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(class<<ioprioClassShift|level))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setNice renices every thread of pid. Linux keeps niceness per thread, and
+// a runtime may have started threads of its own before the gateway gets to
+// the process; threads started after their creator is reniced inherit it.
+func setNice(pid, nice int) error {
+	reniced := make(map[int]bool)
+	for range renicePasses {
+		entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+		if err != nil {
+			return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+		}
+		found := false
+		for _, entry := range entries {
+			tid, err := strconv.Atoi(entry.Name())
+			if err != nil || reniced[tid] {
+				continue
+			}
+			// A thread that exited since the listing needs no renice.
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return err
+			}
+			reniced[tid] = true
+			found = true
+		}
+		if !found {
+			return nil
+		}
+	}
+	return nil
+}